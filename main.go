@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/corpix/terraform-provider-nixos/provider"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
@@ -9,6 +11,20 @@ import (
 )
 
 func main() {
+	// NOTE: provider executable is used as SSH_ASKPASS helper
+	if socket := os.Getenv(provider.SshAskpassEnvSocket); socket != "" {
+		var prompt string
+		if len(os.Args) > 1 {
+			prompt = os.Args[1]
+		}
+		err := provider.SshAskpassMain(socket, prompt, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var debugMode bool
 
 	flag.BoolVar(&debugMode, "debug", false, "set to true to run the provider with support for debuggers like delve")
@@ -19,4 +35,11 @@ func main() {
 		ProviderAddr: "registry.terraform.io/corpix/nixos",
 		ProviderFunc: func() *schema.Provider { return provider.New() },
 	})
+
+	// NOTE: plugin.Serve returns when terraform shuts the plugin down
+	err := provider.CloseProviders()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
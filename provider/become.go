@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Become escalates privileges of remote commands,
+	// it is used when ssh user is not root.
+	Become struct {
+		Method   string
+		Password *LockedBuffer
+	}
+)
+
+const (
+	BecomeMethodNone = ""
+	BecomeMethodSudo = "sudo"
+	BecomeMethodDoas = "doas"
+	BecomeMethodRun0 = "run0"
+)
+
+var (
+	BecomeMethods = []string{
+		BecomeMethodSudo,
+		BecomeMethodDoas,
+		BecomeMethodRun0,
+	}
+)
+
+// Prefix returns command line prefix which runs command as root.
+func (b *Become) Prefix() []string {
+	switch b.Method {
+	case BecomeMethodSudo:
+		if b.Password != nil {
+			// NOTE: -k makes sudo always read password from stdin (ignoring cached credentials)
+			// so password line will never reach the command
+			return []string{"sudo", "-S", "-k", "-p", "''", "--"}
+		}
+		return []string{"sudo", "-n", "--"}
+	case BecomeMethodDoas:
+		return []string{"doas", "-n", "--"}
+	case BecomeMethodRun0:
+		return []string{"run0", "--no-ask-password", "--"}
+	}
+	return nil
+}
+
+// Wrap returns command wrapped with privileges escalation,
+// password (if any) is prepended to the command stdin.
+func (b *Become) Wrap(command string, arguments []string, options []CommandOption) (string, []string, []CommandOption) {
+	prefix := b.Prefix()
+	if len(prefix) == 0 {
+		return command, arguments, options
+	}
+
+	wrappedArguments := append(append(prefix[1:len(prefix):len(prefix)], command), arguments...)
+	if b.Password != nil {
+		options = append(options[:len(options):len(options)], func(cmd *Cmd) {
+			stdin := cmd.Stdin
+			if stdin == nil {
+				stdin = bytes.NewReader(nil)
+			}
+			cmd.Stdin = io.MultiReader(
+				bytes.NewReader(b.Password.Bytes()),
+				strings.NewReader("\n"),
+				stdin,
+			)
+		})
+	}
+
+	return prefix[0], wrappedArguments, options
+}
+
+// RemoteProgram returns nix remote program which runs as root,
+// it is possible only when escalation does not require password.
+func (b *Become) RemoteProgram(program string) (string, bool) {
+	switch b.Method {
+	case BecomeMethodSudo, BecomeMethodDoas:
+		if b.Password != nil {
+			return "", false
+		}
+		return strings.Join(append(b.Prefix(), program), " "), true
+	}
+	return "", false
+}
+
+func NewBecome(method string, password *LockedBuffer) (*Become, error) {
+	switch method {
+	case BecomeMethodNone:
+		return nil, nil
+	case BecomeMethodSudo:
+	case BecomeMethodDoas, BecomeMethodRun0:
+		if password != nil {
+			return nil, errors.Errorf(
+				"become method %q could not read password non-interactively, configure it to not require password for the ssh user",
+				method,
+			)
+		}
+	default:
+		return nil, errors.Errorf(
+			"unsupported become method %q, supported methods are: %v",
+			method, BecomeMethods,
+		)
+	}
+	return &Become{
+		Method:   method,
+		Password: password,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBecome(t *testing.T) {
+	b, err := NewBecome(BecomeMethodNone, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, b)
+
+	_, err = NewBecome(BecomeMethodDoas, NewLockedBuffer([]byte("secret")))
+	assert.Error(t, err)
+	_, err = NewBecome("su", nil)
+	assert.Error(t, err)
+
+	b, err = NewBecome(BecomeMethodSudo, nil)
+	assert.NoError(t, err)
+	command, arguments, _ := b.Wrap("id", []string{"-u"}, nil)
+	assert.Equal(t, "sudo", command)
+	assert.Equal(t, []string{"-n", "--", "id", "-u"}, arguments)
+	program, ok := b.RemoteProgram("nix-store")
+	assert.True(t, ok)
+	assert.Equal(t, "sudo -n -- nix-store", program)
+
+	b, err = NewBecome(BecomeMethodSudo, NewLockedBuffer([]byte("secret")))
+	assert.NoError(t, err)
+	_, ok = b.RemoteProgram("nix-store")
+	assert.False(t, ok)
+	command, arguments, options := b.Wrap("cat", nil, []CommandOption{
+		CommandOptionStdin(strings.NewReader("input")),
+	})
+	assert.Equal(t, "sudo", command)
+	assert.Equal(t, []string{"-S", "-k", "-p", "''", "--", "cat"}, arguments)
+
+	cmd := &Cmd{Cmd: exec.Command(command)}
+	for _, option := range options {
+		option(cmd)
+	}
+	stdin, err := io.ReadAll(cmd.Stdin)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret\ninput", string(stdin))
+}
+
+func TestNixParseTrustedUser(t *testing.T) {
+	u, err := NixParseTrustedUser("deploy\nusers wheel\ntrusted-users = root @wheel\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "deploy", u.User)
+	assert.Equal(t, []string{"users", "wheel"}, u.Groups)
+	assert.True(t, u.Trusted())
+
+	u, err = NixParseTrustedUser("deploy\nusers\ntrusted-users = root\n")
+	assert.NoError(t, err)
+	assert.False(t, u.Trusted())
+
+	_, err = NixParseTrustedUser("deploy\n")
+	assert.Error(t, err)
+}
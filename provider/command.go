@@ -77,6 +77,25 @@ func (c *StringCommand) Execute(v interface{}) error {
 
 func (c *StringCommand) Close() error { return nil }
 
+// ShellQuote quotes the string to be interpreted by the shell as a single word.
+func ShellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, shellUnsafe) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func shellUnsafe(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("@%+=:,./-_", r)
+}
+
 func CommandFromString(command string, arguments ...string) *StringCommand {
 	return &StringCommand{
 		Cmd:       command,
@@ -92,6 +111,17 @@ func (c *RemoteCommand) Command() (string, []string, []CommandOption) {
 
 func (c *RemoteCommand) Execute(v interface{}) error {
 	command, arguments, options := c.Cmd.Command()
+	if c.Ssh.Become != nil {
+		command, arguments, options = c.Ssh.Become.Wrap(command, arguments, options)
+	}
+	if c.Ssh.Client != nil {
+		return CommandExecuteRemoteUnmarshal(
+			c.Ssh.Client,
+			command, arguments,
+			nil, v,
+			options...,
+		)
+	}
 	sshCommand, sshArguments, sshOptions := c.Ssh.Command()
 	return CommandExecuteUnmarshal(
 		sshCommand,
@@ -188,13 +218,16 @@ func CommandExecuteUnmarshal(command string, arguments []string, unmarshaler Unm
 	if err != nil {
 		return err
 	}
+	return CommandUnmarshal(output, unmarshaler, result)
+}
 
+func CommandUnmarshal(output []byte, unmarshaler Unmarshaler, result interface{}) error {
 	if result != nil {
 		if unmarshaler == nil {
 			unmarshaler = NewUnmarshalerPassthrough()
 		}
 
-		err = unmarshaler.Unmarshal(output, &result)
+		err := unmarshaler.Unmarshal(output, &result)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,170 @@
+package provider
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	Facts struct {
+		NixosVersion          string
+		System                string
+		CurrentSystem         string
+		BootedSystem          string
+		HostKeys              map[string]string
+		Interfaces            []FactsInterface
+		HardwareConfiguration string
+	}
+	FactsInterface struct {
+		Name      string                  `json:"ifname"`
+		Addresses []FactsInterfaceAddress `json:"addr_info"`
+	}
+	FactsInterfaceAddress struct {
+		Family    string `json:"family"`
+		Local     string `json:"local"`
+		PrefixLen int    `json:"prefixlen"`
+		Scope     string `json:"scope"`
+	}
+)
+
+const (
+	FactsAddressScopeGlobal = "global"
+)
+
+var (
+	// FactsSystems maps `uname -m` output to the Nix system name.
+	FactsSystems = map[string]string{
+		"x86_64":  "x86_64-linux",
+		"amd64":   "x86_64-linux",
+		"i686":    "i686-linux",
+		"i386":    "i686-linux",
+		"aarch64": "aarch64-linux",
+		"arm64":   "aarch64-linux",
+		"armv6l":  "armv6l-linux",
+		"armv7l":  "armv7l-linux",
+		"riscv64": "riscv64-linux",
+		"ppc64le": "powerpc64le-linux",
+	}
+)
+
+func (a FactsInterfaceAddress) String() string {
+	return a.Local + "/" + strconv.Itoa(a.PrefixLen)
+}
+
+//
+
+func (f *Facts) Addresses(scope string) []string {
+	addrs := []string{}
+	for _, iface := range f.Interfaces {
+		for _, addr := range iface.Addresses {
+			if scope != "" && addr.Scope != scope {
+				continue
+			}
+			addrs = append(addrs, addr.Local)
+		}
+	}
+	return addrs
+}
+
+//
+
+func factsRun(ssh *Ssh, options []CommandOption, command string, arguments ...string) (string, error) {
+	var buf []byte
+	cmd := NewRemoteCommand(ssh, &StringCommand{
+		Cmd:       command,
+		Arguments: arguments,
+		Options:   options,
+	})
+	defer cmd.Close()
+
+	err := cmd.Execute(&buf)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(buf)), nil
+}
+
+func FactsParseSystem(machine string) (string, error) {
+	system, ok := FactsSystems[strings.TrimSpace(machine)]
+	if !ok {
+		return "", errors.Errorf("unsupported machine type %q, could not map it to the Nix system", machine)
+	}
+	return system, nil
+}
+
+func FactsParseHostKeys(buf string) map[string]string {
+	keys := map[string]string{}
+	for _, line := range strings.Split(buf, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		keys[fields[0]] = fields[0] + " " + fields[1]
+	}
+	return keys
+}
+
+func FactsParseInterfaces(buf string) ([]FactsInterface, error) {
+	ifaces := []FactsInterface{}
+	err := NewUnmarshalerJSON().Unmarshal([]byte(buf), &ifaces)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse network interfaces information")
+	}
+	sort.SliceStable(ifaces, func(i, j int) bool {
+		return ifaces[i].Name < ifaces[j].Name
+	})
+	return ifaces, nil
+}
+
+// GatherFacts collects information about the NixOS host reachable with ssh.
+func GatherFacts(ssh *Ssh, options ...CommandOption) (*Facts, error) {
+	var (
+		facts = &Facts{}
+		buf   string
+		err   error
+	)
+
+	facts.NixosVersion, err = factsRun(ssh, options, "nixos-version")
+	if err != nil {
+		return nil, err
+	}
+	buf, err = factsRun(ssh, options, "uname", "-m")
+	if err != nil {
+		return nil, err
+	}
+	facts.System, err = FactsParseSystem(buf)
+	if err != nil {
+		return nil, err
+	}
+	facts.CurrentSystem, err = factsRun(ssh, options, "readlink", "-f", "/run/current-system")
+	if err != nil {
+		return nil, err
+	}
+	facts.BootedSystem, err = factsRun(ssh, options, "readlink", "-f", "/run/booted-system")
+	if err != nil {
+		return nil, err
+	}
+	buf, err = factsRun(ssh, options, "cat", "/etc/ssh/ssh_host_*_key.pub")
+	if err != nil {
+		return nil, err
+	}
+	facts.HostKeys = FactsParseHostKeys(buf)
+	buf, err = factsRun(ssh, options, "ip", "-json", "address", "show")
+	if err != nil {
+		return nil, err
+	}
+	facts.Interfaces, err = FactsParseInterfaces(buf)
+	if err != nil {
+		return nil, err
+	}
+	facts.HardwareConfiguration, err = factsRun(ssh, options, "nixos-generate-config", "--show-hardware-config")
+	if err != nil {
+		return nil, err
+	}
+
+	return facts, nil
+}
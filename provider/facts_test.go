@@ -0,0 +1,75 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFactsParseSystem(t *testing.T) {
+	for machine, expected := range map[string]string{
+		"x86_64\n": "x86_64-linux",
+		"aarch64":  "aarch64-linux",
+		" arm64 ":  "aarch64-linux",
+		"riscv64":  "riscv64-linux",
+	} {
+		system, err := FactsParseSystem(machine)
+		assert.NoError(t, err, machine)
+		assert.Equal(t, expected, system, machine)
+	}
+
+	_, err := FactsParseSystem("sparc64")
+	assert.ErrorContains(t, err, `unsupported machine type "sparc64"`)
+}
+
+func TestFactsParseHostKeys(t *testing.T) {
+	for buf, expected := range map[string]map[string]string{
+		"": {},
+		"ssh-ed25519 AAAAC3Nza root@host\nssh-rsa AAAAB3Nza root@host\n": {
+			"ssh-ed25519": "ssh-ed25519 AAAAC3Nza",
+			"ssh-rsa":     "ssh-rsa AAAAB3Nza",
+		},
+		"\nssh-ed25519 AAAAC3Nza\ngarbage\n": {
+			"ssh-ed25519": "ssh-ed25519 AAAAC3Nza",
+		},
+	} {
+		assert.Equal(t, expected, FactsParseHostKeys(buf), buf)
+	}
+}
+
+func TestFactsParseInterfaces(t *testing.T) {
+	ifaces, err := FactsParseInterfaces(`[
+		{"ifname": "lo", "addr_info": [{"family": "inet", "local": "127.0.0.1", "prefixlen": 8, "scope": "host"}]},
+		{"ifname": "eth0", "addr_info": [
+			{"family": "inet", "local": "192.0.2.10", "prefixlen": 24, "scope": "global"},
+			{"family": "inet6", "local": "fe80::1", "prefixlen": 64, "scope": "link"}
+		]}
+	]`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"eth0", "lo"}, []string{ifaces[0].Name, ifaces[1].Name})
+	assert.Equal(t, "192.0.2.10/24", ifaces[0].Addresses[0].String())
+
+	facts := &Facts{Interfaces: ifaces}
+	assert.Equal(t, []string{"192.0.2.10"}, facts.Addresses(FactsAddressScopeGlobal))
+	assert.Equal(t, []string{"192.0.2.10", "fe80::1", "127.0.0.1"}, facts.Addresses(""))
+
+	_, err = FactsParseInterfaces("not json")
+	assert.ErrorContains(t, err, "failed to parse network interfaces information")
+}
+
+func TestUnmarshalerPassthrough(t *testing.T) {
+	unmarshaler := NewUnmarshalerPassthrough()
+
+	var buf []byte
+	assert.NoError(t, unmarshaler.Unmarshal([]byte("direct"), &buf))
+	assert.Equal(t, "direct", string(buf))
+
+	// NOTE: commands receive result as interface{} holding a pointer
+	var result interface{} = &buf
+	assert.NoError(t, unmarshaler.Unmarshal([]byte("through interface"), &result))
+	assert.Equal(t, "through interface", string(buf))
+
+	var empty interface{}
+	assert.NoError(t, unmarshaler.Unmarshal([]byte("empty interface"), &empty))
+	assert.Equal(t, []byte("empty interface"), empty)
+}
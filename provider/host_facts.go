@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+type HostFacts struct{}
+
+func (h HostFacts) interfacesToSchema(ifaces []FactsInterface) []interface{} {
+	schema := make([]interface{}, len(ifaces))
+	for n, iface := range ifaces {
+		addrs := make([]interface{}, len(iface.Addresses))
+		for k, addr := range iface.Addresses {
+			addrs[k] = addr.String()
+		}
+		schema[n] = map[string]interface{}{
+			KeyHostFactsInterfaceName:      iface.Name,
+			KeyHostFactsInterfaceAddresses: addrs,
+		}
+	}
+	return schema
+}
+
+func (h HostFacts) fail(err error) diag.Diagnostics {
+	return diag.Diagnostics{{
+		Severity: diag.Error,
+		Summary:  err.Error(),
+	}}
+}
+
+//
+
+func (h HostFacts) Read(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	ctx = WithAddressCache(ctx)
+	provider := meta.(*Provider)
+
+	address, err := provider.Address(ctx, resource.Get(KeyAddress))
+	if err != nil {
+		return h.fail(err)
+	}
+	facts, err := provider.Facts(ctx, resource)
+	if err != nil {
+		return h.fail(err)
+	}
+
+	values := map[string]interface{}{
+		KeyHostFactsNixosVersion:          facts.NixosVersion,
+		KeySystem:                         facts.System,
+		KeyHostFactsCurrentSystem:         facts.CurrentSystem,
+		KeyHostFactsBootedSystem:          facts.BootedSystem,
+		KeyHostFactsHostKeys:              facts.HostKeys,
+		KeyHostFactsInterfaces:            h.interfacesToSchema(facts.Interfaces),
+		KeyHostFactsAddresses:             facts.Addresses(FactsAddressScopeGlobal),
+		KeyHostFactsHardwareConfiguration: facts.HardwareConfiguration,
+	}
+	for key, value := range values {
+		err = resource.Set(key, value)
+		if err != nil {
+			return h.fail(err)
+		}
+	}
+
+	resource.SetId(address.String())
+
+	return nil
+}
+
+var hostFacts HostFacts
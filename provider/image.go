@@ -0,0 +1,215 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/pkg/errors"
+)
+
+type (
+	Image     struct{}
+	ImageFile struct {
+		Path   string
+		Size   int64
+		Sha256 string
+	}
+)
+
+const (
+	ImageFormatRaw   = "raw"
+	ImageFormatQcow2 = "qcow2"
+	ImageFormatVhd   = "vhd"
+	ImageFormatIso   = "iso"
+)
+
+var (
+	// ImageFormats maps image format to the image file extension
+	// produced by the image wrapper.
+	ImageFormats = map[string]string{
+		ImageFormatRaw:   ".img",
+		ImageFormatQcow2: ".qcow2",
+		ImageFormatVhd:   ".vhd",
+		ImageFormatIso:   ".iso",
+	}
+)
+
+func ImageFormatsList() []string {
+	formats := make([]string, 0, len(ImageFormats))
+	for format := range ImageFormats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// FindImageFile looks up the image file with extension matching format
+// inside derivation output and calculates its size & checksum.
+func FindImageFile(drvs Derivations, output string, format string) (*ImageFile, error) {
+	if len(drvs) == 0 {
+		return nil, errors.New("no derivations to look up image file in")
+	}
+	extension, ok := ImageFormats[format]
+	if !ok {
+		return nil, errors.Errorf("unsupported image format %q", format)
+	}
+	root, ok := drvs[len(drvs)-1].Outputs[output]
+	if !ok {
+		return nil, errors.Errorf("derivation has no output named %q", output)
+	}
+
+	var path string
+	err := filepath.WalkDir(root, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "" && entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), extension) {
+			path = current
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up image file in %q", root)
+	}
+	if path == "" {
+		return nil, errors.Errorf("no image file with extension %q was found in %q", extension, root)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to calculate checksum of %q", path)
+	}
+
+	return &ImageFile{
+		Path:   path,
+		Size:   size,
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+//
+
+func (i Image) fail(err error) diag.Diagnostics {
+	return diag.Diagnostics{{
+		Severity: diag.Error,
+		Summary:  err.Error(),
+	}}
+}
+
+func (i Image) Diff(ctx context.Context, resource *schema.ResourceDiff, meta interface{}) error {
+	provider := meta.(*Provider)
+
+	if resource.HasChange(KeyDerivations) {
+		_ = resource.SetNewComputed(KeyDerivations)
+	} else {
+		derivationsSchema, ok := resource.Get(KeyDerivations).([]interface{})
+		if ok {
+			oldDerivations, err := instance.schemaToDerivations(derivationsSchema)
+			if err != nil {
+				return err
+			}
+			newDerivations, err := provider.BuildImage(ctx, resource)
+			if err != nil {
+				return err
+			}
+
+			if oldDerivations.Hash() == newDerivations.Hash() {
+				return nil
+			}
+			_ = resource.SetNewComputed(KeyDerivations)
+		}
+	}
+
+	_ = resource.SetNewComputed(KeyImagePath)
+	_ = resource.SetNewComputed(KeyImageSize)
+	_ = resource.SetNewComputed(KeyImageSha256)
+
+	return nil
+}
+
+func (i Image) Create(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	provider := meta.(*Provider)
+
+	derivations, err := provider.BuildImage(ctx, resource)
+	if err != nil {
+		return i.fail(err)
+	}
+
+	outName := provider.NixSettings(resource)[KeyNixOutputName].(string)
+	file, err := FindImageFile(derivations, outName, resource.Get(KeyImageFormat).(string))
+	if err != nil {
+		return i.fail(err)
+	}
+
+	//
+
+	if resource.Id() == "" {
+		resource.SetId(instance.generateId())
+	}
+
+	derivationsSchema, err := instance.derivationsToSchema(derivations)
+	if err != nil {
+		return i.fail(err)
+	}
+
+	values := map[string]interface{}{
+		KeyDerivations: derivationsSchema,
+		KeyImagePath:   file.Path,
+		KeyImageSize:   int(file.Size),
+		KeyImageSha256: file.Sha256,
+	}
+	for key, value := range values {
+		err = resource.Set(key, value)
+		if err != nil {
+			return i.fail(err)
+		}
+	}
+
+	return nil
+}
+
+func (i Image) Read(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	path, _ := resource.Get(KeyImagePath).(string)
+	if path == "" {
+		return nil
+	}
+
+	// NOTE: image may be garbage collected from the Nix store,
+	// forget about derivations to rebuild it on next apply
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		err = resource.Set(KeyDerivations, []interface{}{})
+	}
+	if err != nil {
+		return i.fail(err)
+	}
+
+	return nil
+}
+
+func (i Image) Update(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return i.Create(ctx, resource, meta)
+}
+
+func (i Image) Delete(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	resource.SetId("")
+	return nil
+}
+
+var image Image
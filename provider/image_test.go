@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindImageFile(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"nix-support", "iso", "a.iso"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0700))
+	}
+	for name, content := range map[string]string{
+		"nix-support/hydra-build-products": "file iso iso/nixos.iso",
+		"iso/nixos.iso":                    "image",
+		"iso/nixos.iso.sha256":             "checksum",
+		"nixos.qcow2":                      "qcow2 image",
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0600))
+	}
+	// NOTE: symlinks & directories with matching extension are not images
+	assert.NoError(t, os.Symlink(filepath.Join(root, "nixos.qcow2"), filepath.Join(root, "0-link.iso")))
+
+	drvs := Derivations{
+		{Path: "/nix/store/dependency.drv", Outputs: map[string]string{"out": "/nonexistent"}},
+		{Path: "/nix/store/image.drv", Outputs: map[string]string{"out": root}},
+	}
+
+	sum := sha256.Sum256([]byte("image"))
+	file, err := FindImageFile(drvs, "out", ImageFormatIso)
+	assert.NoError(t, err)
+	assert.Equal(t, &ImageFile{
+		Path:   filepath.Join(root, "iso", "nixos.iso"),
+		Size:   5,
+		Sha256: hex.EncodeToString(sum[:]),
+	}, file)
+
+	file, err = FindImageFile(drvs, "out", ImageFormatQcow2)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "nixos.qcow2"), file.Path)
+
+	_, err = FindImageFile(drvs, "out", ImageFormatVhd)
+	assert.ErrorContains(t, err, `no image file with extension ".vhd"`)
+	_, err = FindImageFile(drvs, "out", "vmdk")
+	assert.ErrorContains(t, err, `unsupported image format "vmdk"`)
+	_, err = FindImageFile(drvs, "lib", ImageFormatIso)
+	assert.ErrorContains(t, err, `no output named "lib"`)
+	_, err = FindImageFile(nil, "out", ImageFormatIso)
+	assert.Error(t, err)
+}
@@ -0,0 +1,428 @@
+package provider
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/pkg/errors"
+)
+
+type (
+	Install struct{}
+
+	// installerResource pins host key of the installer which is observed after kexec,
+	// installer generates new host keys on each boot, so keys of the host could not be used.
+	installerResource struct {
+		ResourceBox
+		hostKey string
+	}
+)
+
+const (
+	InstallPhaseKexec   = "kexec"
+	InstallPhaseDisko   = "disko"
+	InstallPhaseInstall = "install"
+	InstallPhaseReboot  = "reboot"
+)
+
+const (
+	InstallAttributeSystem = "out_path"
+	InstallAttributeDisko  = "disko_script"
+	InstallAttributeKexec  = "kexec_tree"
+)
+
+const (
+	// InstallKexecDirectory is a directory on the target host
+	// where kexec tree is unpacked before booting into installer.
+	InstallKexecDirectory = "/root/kexec"
+	// InstallRoot is a mount point of the partitioned disks inside installer.
+	InstallRoot = "/mnt"
+)
+
+var (
+	InstallPhases = []string{
+		InstallPhaseKexec,
+		InstallPhaseDisko,
+		InstallPhaseInstall,
+		InstallPhaseReboot,
+	}
+	// NOTE: order matters, derivations are returned in the same order
+	InstallAttributes = []string{
+		InstallAttributeSystem,
+		InstallAttributeDisko,
+		InstallAttributeKexec,
+	}
+)
+
+//
+
+func (r *installerResource) Get(key string) interface{} {
+	switch key {
+	case KeyHostKey:
+		return r.hostKey
+	case KeyHostKeyTofu:
+		return false
+	}
+	return r.ResourceBox.Get(key)
+}
+
+// observe records host key of the running installer.
+// NOTE: installer is trusted on first use, it was booted by us over verified connection
+func (r *installerResource) observe(ctx context.Context, p *Provider) error {
+	r.hostKey = ""
+	hostKey, err := p.ObserveHostKey(ctx, r)
+	if err != nil {
+		return err
+	}
+	r.hostKey = hostKey
+	return nil
+}
+
+//
+
+func (p *Provider) BuildInstall(ctx context.Context, resource ResourceBox) (Derivations, error) {
+	arguments, err := p.configurationArguments(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	diskLayout := resource.Get(KeyInstallDiskLayout).(string)
+	diskLayoutAbs, err := filepath.Abs(diskLayout)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "failed to determine absolute path for disk layout %q",
+			diskLayout,
+		)
+	}
+	arguments["disk_layout"] = diskLayoutAbs
+	arguments["installer_settings"] = resource.Get(KeyInstallInstallerSettings).(string)
+	if disko, _ := resource.Get(KeyInstallDisko).(string); disko != "" {
+		arguments["disko"] = disko
+	}
+
+	nixSettings := p.NixSettings(resource)
+	installWrapperPath, _ := nixSettings[KeyNixInstallWrapper].(string)
+
+	return p.build(ctx, resource, installWrapperPath, NixInstallWrapper, arguments, InstallAttributes...)
+}
+
+// Install boots the target host into the NixOS installer with kexec,
+// partitions disks with disko, copies the system closure and installs it.
+func (p *Provider) Install(ctx context.Context, resource ResourceBox, drvs Derivations) error {
+	address, err := p.ResourceAddress(ctx, resource)
+	if err != nil {
+		return err
+	}
+
+	nix, err := p.NewNix(ctx, resource)
+	if err != nil {
+		return err
+	}
+	defer nix.Close()
+
+	var (
+		nixSettings = p.NixSettings(resource)
+		outName     = nixSettings[KeyNixOutputName].(string)
+
+		systemPath = drvs[0].Outputs[outName]
+		diskoPath  = drvs[1].Outputs[outName]
+		kexecPath  = drvs[2].Outputs[outName]
+
+		installer = &installerResource{ResourceBox: resource}
+	)
+
+	err = p.WaitReady(ctx, resource, address.String())
+	if err != nil {
+		return err
+	}
+
+	return RunInstallPhases(ctx, InstallPhasesOf(resource), func(ctx context.Context, phase string) error {
+		// NOTE: connection is established per phase because
+		// target host is replaced by the installer after kexec
+		phaseResource := resource
+		if phase != InstallPhaseKexec {
+			if installer.hostKey == "" {
+				err := installer.observe(ctx, p)
+				if err != nil {
+					return err
+				}
+			}
+			phaseResource = installer
+		}
+		ssh, err := p.NewSshHost(ctx, phaseResource, address.String())
+		if err != nil {
+			return err
+		}
+		defer ssh.Close()
+
+		switch phase {
+		case InstallPhaseKexec:
+			return p.installKexec(ctx, resource, installer, ssh, address.String(), kexecPath)
+		case InstallPhaseDisko:
+			return p.installDisko(ctx, nix, ssh, address.String(), diskoPath)
+		case InstallPhaseInstall:
+			return p.installSystem(ctx, nix, ssh, address.String(), systemPath)
+		case InstallPhaseReboot:
+			return p.installDetached(ctx, ssh, "reboot", "")
+		default:
+			return errors.Errorf(
+				"unsupported install phase %q, supported phases are: %v",
+				phase, InstallPhases,
+			)
+		}
+	})
+}
+
+// InstallPhasesOf returns install phases of the resource, all phases are returned if none are set.
+// NOTE: DefaultFunc is not applied to list attributes by the sdk
+func InstallPhasesOf(resource ResourceBox) []string {
+	values, _ := resource.Get(KeyInstallPhases).([]interface{})
+	if len(values) == 0 {
+		return InstallPhases
+	}
+	phases := make([]string, len(values))
+	for n, phase := range values {
+		phases[n], _ = phase.(string)
+	}
+	return phases
+}
+
+// RunInstallPhases runs phases in order until one fails or context is done.
+func RunInstallPhases(ctx context.Context, phases []string, run func(ctx context.Context, phase string) error) error {
+	for _, phase := range phases {
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "install phase %q was not started", phase)
+		default:
+		}
+
+		tflog.Info(ctx, "running install phase "+phase)
+		err := run(ctx, phase)
+		if err != nil {
+			return errors.Wrapf(err, "install phase %q failed", phase)
+		}
+	}
+	return nil
+}
+
+// installDetached runs command on the target host in background
+// so it could drop the connection (reboot, kexec) without failing the phase.
+func (p *Provider) installDetached(ctx context.Context, ssh *Ssh, command string, log string) error {
+	if log == "" {
+		log = "/dev/null"
+	}
+	script := "setsid sh -c " + ShellQuote("sleep 1 && exec "+command) +
+		" < /dev/null > " + ShellQuote(log) + " 2>&1 &"
+
+	detached := NewRemoteCommand(ssh, &StringCommand{
+		Cmd:       "sh",
+		Arguments: []string{"-c", ShellQuote(script)},
+		Options:   []CommandOption{CommandOptionTflogTee(ctx)},
+	})
+	defer detached.Close()
+
+	return detached.Execute(nil)
+}
+
+func (p *Provider) installKexec(ctx context.Context, resource ResourceBox, installer *installerResource, ssh *Ssh, address string, kexecPath string) error {
+	archive, err := CreateTemp("kexec.tar.*")
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	err = NewTar(
+		TarOptionCreate(),
+		TarOptionDereference(),
+		TarOptionFile(archive.Name()),
+		TarOptionChDir(kexecPath),
+		TarOptionPaths("."),
+	).Execute(nil)
+	if err != nil {
+		return err
+	}
+
+	mkdir := NewRemoteCommand(ssh, CommandFromString("mkdir", "-p", InstallKexecDirectory))
+	defer mkdir.Close()
+	err = mkdir.Execute(nil)
+	if err != nil {
+		return err
+	}
+
+	unpack := NewRemoteCommand(ssh, NewTar(
+		TarOptionExtract(),
+		TarOptionChDir(InstallKexecDirectory),
+		TarOptionCommandOptions(CommandOptionStdin(archive)),
+	))
+	defer unpack.Close()
+	release, err := p.copySlots.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = unpack.Execute(nil)
+	release()
+	if err != nil {
+		return err
+	}
+
+	err = p.installDetached(
+		ctx, ssh,
+		ShellQuote(InstallKexecDirectory+"/kexec-boot"),
+		InstallKexecDirectory+"/kexec-boot.log",
+	)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: installer runs from tmpfs, so kexec directory
+	// will disappear as soon as we are inside the installer
+	timeout := time.Duration(resource.Get(KeyInstallKexecTimeout).(int)) * time.Second
+	return NewReady("installer", timeout).Wait(
+		ctx,
+		func(ctx context.Context) error { return p.installProbe(ctx, installer, address) },
+	)
+}
+
+// installProbe checks the installer is running on the target host,
+// connection is established each time because the old one is gone with kexec.
+// Host key is observed on each attempt, so it is key of the installer once probe succeeds.
+func (p *Provider) installProbe(ctx context.Context, installer *installerResource, address string) error {
+	err := installer.observe(ctx, p)
+	if err != nil {
+		return err
+	}
+	ssh, err := p.NewSshHost(ctx, installer, address)
+	if err != nil {
+		return err
+	}
+	defer ssh.Close()
+
+	probe := NewRemoteCommand(ssh, CommandFromString("test", "!", "-e", InstallKexecDirectory))
+	defer probe.Close()
+
+	return probe.Execute(nil)
+}
+
+func (p *Provider) installDisko(ctx context.Context, nix *Nix, ssh *Ssh, address string, diskoPath string) error {
+	target, err := p.nixCopyTarget(nix, ssh, address)
+	if err != nil {
+		return err
+	}
+	nixCopy := target.Copy(diskoPath, nil)
+	defer nixCopy.Close()
+	release, err := p.copySlots.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = nixCopy.Execute(nil)
+	release()
+	if err != nil {
+		return err
+	}
+
+	disko := NewRemoteCommand(ssh, &StringCommand{
+		Cmd:     diskoPath,
+		Options: []CommandOption{CommandOptionTflogTee(ctx)},
+	})
+	defer disko.Close()
+
+	return disko.Execute(nil)
+}
+
+func (p *Provider) installSystem(ctx context.Context, nix *Nix, ssh *Ssh, address string, systemPath string) error {
+	target, err := p.nixCopyTarget(nix, ssh, address)
+	if err != nil {
+		return err
+	}
+	nixCopy := target.Copy(
+		systemPath,
+		url.Values{"remote-store": {"local?root=" + InstallRoot}},
+	)
+	defer nixCopy.Close()
+	release, err := p.copySlots.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = nixCopy.Execute(nil)
+	release()
+	if err != nil {
+		return err
+	}
+
+	nixosInstall := NewRemoteCommand(ssh, &StringCommand{
+		Cmd: "nixos-install",
+		Arguments: []string{
+			"--root", InstallRoot,
+			"--system", systemPath,
+			"--no-root-passwd",
+			"--no-channel-copy",
+		},
+		Options: []CommandOption{CommandOptionTflogTee(ctx)},
+	})
+	defer nixosInstall.Close()
+
+	return nixosInstall.Execute(nil)
+}
+
+//
+
+func (i Install) fail(err error) diag.Diagnostics {
+	return diag.Diagnostics{{
+		Severity: diag.Error,
+		Summary:  err.Error(),
+	}}
+}
+
+func (i Install) Create(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	ctx = WithAddressCache(ctx)
+	provider := meta.(*Provider)
+
+	derivations, err := provider.BuildInstall(ctx, resource)
+	if err != nil {
+		return i.fail(err)
+	}
+
+	err = provider.Install(ctx, resource, derivations)
+	if err != nil {
+		return i.fail(err)
+	}
+
+	//
+
+	if resource.Id() == "" {
+		resource.SetId(instance.generateId())
+	}
+
+	derivationsSchema, err := instance.derivationsToSchema(derivations)
+	if err != nil {
+		return i.fail(err)
+	}
+	err = resource.Set(KeyDerivations, derivationsSchema)
+	if err != nil {
+		return i.fail(err)
+	}
+
+	return nil
+}
+
+func (i Install) Read(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return nil
+}
+
+// Update does nothing, installation is a one-shot bootstrap operation
+// and further configuration changes should be delivered with nixos_instance.
+func (i Install) Update(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return nil
+}
+
+func (i Install) Delete(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	resource.SetId("")
+	return nil
+}
+
+var install Install
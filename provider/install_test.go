@@ -0,0 +1,65 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type mapResource map[string]interface{}
+
+func (r mapResource) Get(key string) interface{} { return r[key] }
+
+func TestInstallerResource(t *testing.T) {
+	var (
+		p        = &Provider{}
+		resource = mapResource{
+			KeyAddress:     []interface{}{"192.0.2.10"},
+			KeyHostKey:     "ssh-ed25519 AAAAhost",
+			KeyHostKeyTofu: true,
+		}
+		installer = &installerResource{ResourceBox: resource}
+	)
+
+	// NOTE: host key of the system being replaced is never used for the installer
+	assert.Equal(t, "ssh-ed25519 AAAAhost", p.HostKey(resource))
+	assert.Equal(t, "", p.HostKey(installer))
+
+	installer.hostKey = "ssh-ed25519 AAAAinstaller"
+	assert.Equal(t, "ssh-ed25519 AAAAinstaller", p.HostKey(installer))
+	assert.Equal(t, resource[KeyAddress], installer.Get(KeyAddress))
+}
+
+func TestInstallPhasesOf(t *testing.T) {
+	assert.Equal(t, InstallPhases, InstallPhasesOf(mapResource{KeyInstallPhases: []interface{}{}}))
+	assert.Equal(t, InstallPhases, InstallPhasesOf(mapResource{}))
+	assert.Equal(
+		t, []string{InstallPhaseDisko, InstallPhaseInstall},
+		InstallPhasesOf(mapResource{KeyInstallPhases: []interface{}{InstallPhaseDisko, InstallPhaseInstall}}),
+	)
+}
+
+func TestRunInstallPhases(t *testing.T) {
+	executed := []string{}
+	run := func(ctx context.Context, phase string) error {
+		executed = append(executed, phase)
+		if phase == InstallPhaseInstall {
+			return errors.New("no space left on device")
+		}
+		return nil
+	}
+
+	err := RunInstallPhases(context.Background(), InstallPhasesOf(mapResource{}), run)
+	assert.EqualError(t, err, `install phase "install" failed: no space left on device`)
+	assert.Equal(t, []string{InstallPhaseKexec, InstallPhaseDisko, InstallPhaseInstall}, executed)
+
+	// NOTE: cancelled install is an error, so it is not recorded as completed
+	executed = []string{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = RunInstallPhases(ctx, InstallPhases, run)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, executed)
+}
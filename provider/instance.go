@@ -5,14 +5,19 @@ import (
 	"context"
 	cryptoRand "crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	mathRand "math/rand"
+	"sort"
 	"strconv"
 	"time"
 
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
 )
 
 func init() {
@@ -41,28 +46,174 @@ func (i Instance) schemaToDerivations(schema []interface{}) (Derivations, error)
 	return derivations, nil
 }
 
-func (i Instance) secretsFingerprintToSchema(secrets SecretsData) (map[string]interface{}, error) {
+// secretsFingerprintToSchema returns fingerprint of the secrets, salt & kdf iterations are generated if salt is nil,
+// fingerprints in override (by origin) are saved instead of computed ones (empty fingerprint is not saved).
+func (i Instance) secretsFingerprintToSchema(
+	secrets SecretsData, directories map[string][]string,
+	salt []byte, kdfIterations int, override map[string]string,
+) (map[string]interface{}, error) {
 	saltSize := 32
 	minIterations := 32
 	maxIterations := 64
 
 	//
 
-	salt := make([]byte, saltSize)
-	_, err := cryptoRand.Read(salt)
+	if salt == nil {
+		salt = make([]byte, saltSize)
+		_, err := cryptoRand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		kdfIterations = mathRand.Intn((maxIterations - minIterations + 1) + minIterations)
+	}
+	sum := secrets.Hash(salt, kdfIterations)
+
+	fingerprints := map[string]string{}
+	for origin, fingerprint := range secrets.Fingerprints(salt, kdfIterations) {
+		if overridden, ok := override[origin]; ok {
+			if overridden != "" {
+				fingerprints[origin] = overridden
+			}
+			continue
+		}
+		fingerprints[origin] = hex.EncodeToString(fingerprint)
+	}
+	fingerprintsJson, err := json.Marshal(fingerprints)
+	if err != nil {
+		return nil, err
+	}
+	directoriesJson, err := json.Marshal(directories)
 	if err != nil {
 		return nil, err
 	}
-	kdfIterations := mathRand.Intn((maxIterations - minIterations + 1) + minIterations)
-	sum := secrets.Hash(salt, kdfIterations)
 
 	return map[string]interface{}{
 		KeySecretFingerprintSum:           hex.EncodeToString(sum),
 		KeySecretFingerprintSalt:          hex.EncodeToString(salt),
 		KeySecretFingerprintKdfIterations: strconv.Itoa(kdfIterations),
+		KeySecretFingerprintSecrets:       string(fingerprintsJson),
+		KeySecretFingerprintDirectories:   string(directoriesJson),
 	}, nil
 }
 
+// secretsFingerprintRetry returns fingerprint which is saved when hooks of the failed secrets (by origin) did not succeed,
+// previous sum is kept, so secrets change is planned again, and previous fingerprints of the failed secrets are kept,
+// so their hooks are executed on the next apply (nil if there is no previous fingerprint).
+func (i Instance) secretsFingerprintRetry(schema interface{}, secrets SecretsData, directories map[string][]string, failed map[string]bool) (map[string]interface{}, error) {
+	fingerprint, _ := schema.(map[string]interface{})
+	sum, salt, kdfIterations, err := i.schemaToSecretFingerprint(fingerprint)
+	if err != nil || sum == nil {
+		return nil, err
+	}
+
+	previous := map[string]string{}
+	if fingerprintsJson, ok := fingerprint[KeySecretFingerprintSecrets].(string); ok {
+		err = json.Unmarshal([]byte(fingerprintsJson), &previous)
+		if err != nil {
+			return nil, err
+		}
+	}
+	override := make(map[string]string, len(failed))
+	for origin := range failed {
+		override[origin] = previous[origin]
+	}
+	retry, err := i.secretsFingerprintToSchema(secrets, directories, salt, kdfIterations, override)
+	if err != nil {
+		return nil, err
+	}
+	retry[KeySecretFingerprintSum] = hex.EncodeToString(sum)
+	return retry, nil
+}
+
+// runSecretsHooks executes hooks of the changed secrets, if some of them fail
+// previous fingerprints of these secrets are saved, so hooks are retried on the next apply.
+func (i Instance) runSecretsHooks(
+	ctx context.Context, resource *schema.ResourceData, provider *Provider, secrets *Secrets,
+	previousFingerprint interface{}, secretsData SecretsData, secretsDirectories map[string][]string, changed map[string]bool,
+) error {
+	err := provider.RunSecretsHooks(ctx, resource, secrets, changed)
+	if err == nil {
+		return nil
+	}
+
+	failed := changed
+	if errs, ok := err.(SecretsHookErrors); ok {
+		failed = errs.Origins()
+	}
+	fingerprint, fingerprintErr := i.secretsFingerprintRetry(previousFingerprint, secretsData, secretsDirectories, failed)
+	if fingerprintErr != nil {
+		return fingerprintErr
+	}
+	if fingerprint != nil {
+		fingerprintErr = resource.Set(KeySecretFingerprint, fingerprint)
+		if fingerprintErr != nil {
+			return fingerprintErr
+		}
+	}
+	return err
+}
+
+// secretsDeployed returns files of directory secrets saved with previous fingerprint (by directory),
+// nil if fingerprint has no files saved.
+func (i Instance) secretsDeployed(schema interface{}) (map[string][]string, error) {
+	fingerprint, _ := schema.(map[string]interface{})
+	directoriesJson, ok := fingerprint[KeySecretFingerprintDirectories].(string)
+	if !ok {
+		return nil, nil
+	}
+	directories := map[string][]string{}
+	err := json.Unmarshal([]byte(directoriesJson), &directories)
+	if err != nil {
+		return nil, err
+	}
+	return directories, nil
+}
+
+// secretsDeployedOrigins returns origins of the secrets saved with previous fingerprint (sorted).
+func (i Instance) secretsDeployedOrigins(schema interface{}) ([]string, error) {
+	fingerprint, _ := schema.(map[string]interface{})
+	fingerprintsJson, ok := fingerprint[KeySecretFingerprintSecrets].(string)
+	if !ok {
+		return nil, nil
+	}
+	fingerprints := map[string]string{}
+	err := json.Unmarshal([]byte(fingerprintsJson), &fingerprints)
+	if err != nil {
+		return nil, err
+	}
+	origins := make([]string, 0, len(fingerprints))
+	for origin := range fingerprints {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	return origins, nil
+}
+
+// secretsChanged returns origins of the secrets which changed since previous fingerprint,
+// nothing is changed if there is no previous fingerprint (secrets are installed first time).
+func (i Instance) secretsChanged(schema interface{}, secrets SecretsData) (map[string]bool, error) {
+	fingerprint, _ := schema.(map[string]interface{})
+	sum, salt, kdfIterations, err := i.schemaToSecretFingerprint(fingerprint)
+	if err != nil || sum == nil {
+		return nil, err
+	}
+
+	previous := map[string]string{}
+	fingerprintsJson, ok := fingerprint[KeySecretFingerprintSecrets].(string)
+	if ok {
+		err = json.Unmarshal([]byte(fingerprintsJson), &previous)
+		if err != nil {
+			return nil, err
+		}
+	} else if bytes.Equal(secrets.Hash(salt, kdfIterations), sum) {
+		// NOTE: fingerprint was saved without per secret fingerprints,
+		// all secrets are changed if any of them is changed
+		return nil, nil
+	}
+
+	return SecretsChanged(secrets, previous, salt, kdfIterations), nil
+}
+
 func (i Instance) schemaToSecretFingerprint(schema map[string]interface{}) (
 	sumBytes []byte,
 	saltBytes []byte,
@@ -117,34 +268,107 @@ func (i Instance) fail(err error) diag.Diagnostics {
 
 //
 
+func (i Instance) diffSecrets(resource *schema.ResourceDiff, provider *Provider) error {
+	// NOTE: content generated by other resources (random_password, tls_private_key, etc)
+	// is not known during plan, fingerprint could not be computed until apply,
+	// unknown values nested into the set are not reported by NewValueKnown, so raw configuration is checked too
+	if !resource.NewValueKnown(KeySecret) || !rawConfigKnown(resource.GetRawConfig(), KeySecret) {
+		_ = resource.SetNewComputed(KeySecretFingerprint)
+		return nil
+	}
+	if resource.HasChange(KeySecretFingerprint) {
+		_ = resource.SetNewComputed(KeySecretFingerprint)
+		return nil
+	}
+
+	fingerprint, ok := resource.Get(KeySecretFingerprint).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	sum, salt, kdfIterations, err := i.schemaToSecretFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := provider.NewSecrets(resource)
+	if err != nil {
+		return err
+	}
+	defer secrets.Close()
+	secretsData, err := secrets.Data()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(secretsData.Hash(salt, kdfIterations), sum) {
+		_ = resource.SetNewComputed(KeySecretFingerprint)
+	}
+	return nil
+}
+
+//
+
+func (i Instance) diffHostKey(resource *schema.ResourceDiff, provider *Provider) error {
+	hostKeys := []string{
+		resource.Get(KeyHostKey).(string),
+	}
+	for _, hopSettings := range provider.BastionSettings(resource) {
+		if bastionHostKey, ok := hopSettings[KeyHostKey].(string); ok {
+			hostKeys = append(hostKeys, bastionHostKey)
+		}
+	}
+	for _, hostKey := range hostKeys {
+		if hostKey == "" {
+			continue
+		}
+		_, err := SshParseHostKey(hostKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resource.HasChange(KeyHostKey) {
+		_ = resource.SetNewComputed(KeyHostKeyObserved)
+	}
+	return nil
+}
+
+// trustHostKey records host key the server presented, on first use (if enabled)
+// it will be pinned by all following connections, pinned key should match it.
+func (i Instance) trustHostKey(ctx context.Context, resource *schema.ResourceData, provider *Provider) error {
+	pinned := provider.HostKey(resource)
+	if pinned == "" && !resource.Get(KeyHostKeyTofu).(bool) {
+		return resource.Set(KeyHostKeyObserved, "")
+	}
+	observed, err := provider.ObserveHostKey(ctx, resource)
+	if err != nil {
+		return err
+	}
+	err = resource.Set(KeyHostKeyObserved, observed)
+	if err != nil {
+		return err
+	}
+	if pinned != "" && !SshHostKeyEqual(pinned, observed) {
+		return errors.Errorf("host key mismatch, expected %q, server presented %q", pinned, observed)
+	}
+	return nil
+}
+
 func (i Instance) Diff(ctx context.Context, resource *schema.ResourceDiff, meta interface{}) error {
 	provider := meta.(*Provider)
 
 	//
 
-	if resource.HasChange(KeySecretFingerprint) {
-		_ = resource.SetNewComputed(KeySecretFingerprint)
-	} else {
-		fingerprint, ok := resource.Get(KeySecretFingerprint).(map[string]interface{})
-		if ok {
-			sum, salt, kdfIterations, err := i.schemaToSecretFingerprint(fingerprint)
-			if err != nil {
-				return err
-			}
+	err := i.diffSecrets(resource, provider)
+	if err != nil {
+		return err
+	}
 
-			secrets, err := provider.NewSecrets(resource)
-			if err != nil {
-				return err
-			}
-			secretsData, err := secrets.Data()
-			if err != nil {
-				return err
-			}
+	//
 
-			if !bytes.Equal(secretsData.Hash(salt, kdfIterations), sum) {
-				_ = resource.SetNewComputed(KeySecretFingerprint)
-			}
-		}
+	err = i.diffHostKey(resource, provider)
+	if err != nil {
+		return err
 	}
 
 	//
@@ -169,27 +393,35 @@ func (i Instance) Diff(ctx context.Context, resource *schema.ResourceDiff, meta
 		}
 	}
 
-	return nil
-}
-
-func (i Instance) Create(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
-	provider := meta.(*Provider)
+	//
 
-	derivations, err := provider.Build(ctx, resource)
-	if err != nil {
-		return i.fail(err)
+	// NOTE: address is selected again on every apply
+	if len(resource.GetChangedKeysPrefix("")) > 0 {
+		_ = resource.SetNewComputed(KeyAddressUsed)
 	}
 
-	//
+	return nil
+}
 
-	secrets, err := provider.NewSecrets(resource)
+// deploy copies secrets & derivations to the address used (system is switched by the caller),
+// connection errors are returned without retries unless it is the last address candidate.
+func (i Instance) deploy(ctx context.Context, resource *schema.ResourceData, provider *Provider, secrets *Secrets, derivations Derivations, last bool) error {
+	address, err := provider.ResourceAddress(ctx, resource)
 	if err != nil {
-		return i.fail(err)
+		return err
 	}
-	defer secrets.Close()
-	secretsData, err := secrets.Data()
+	// NOTE: address candidate which is not the last one gets short readiness budget,
+	// so failover to the next candidate is not delayed for the whole ready_timeout
+	timeout := time.Duration(provider.Get(KeyReadyTimeout).(int)) * time.Second
+	if !last && timeout > ReadyCandidateTimeout {
+		timeout = ReadyCandidateTimeout
+	}
+	err = provider.WaitReadyTimeout(
+		ctx, resource, address.String(), timeout,
+		func(ctx context.Context) error { return i.trustHostKey(ctx, resource, provider) },
+	)
 	if err != nil {
-		return i.fail(err)
+		return err
 	}
 
 	//
@@ -208,17 +440,79 @@ func (i Instance) Create(ctx context.Context, resource *schema.ResourceData, met
 		break
 
 	retry:
-		if retry > 0 {
+		if retry > 0 && (last || !IsSshConnectionError(err)) {
 			retry--
 			// TODO: progressive wait time? (need limit)
 			time.Sleep(retryWait)
 			continue
 		}
+		return err
+	}
+	return nil
+}
+
+func (i Instance) Create(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	ctx = WithAddressCache(ctx)
+	provider := meta.(*Provider)
+
+	derivations, err := provider.Build(ctx, resource)
+	if err != nil {
+		return i.fail(err)
+	}
+
+	//
+
+	secrets, err := provider.NewSecrets(resource)
+	if err != nil {
+		return i.fail(err)
+	}
+	defer secrets.Close()
+	secretsData, err := secrets.Data()
+	if err != nil {
+		return i.fail(err)
+	}
+	previousFingerprint, _ := resource.GetChange(KeySecretFingerprint)
+	secretsChanged, err := i.secretsChanged(previousFingerprint, secretsData)
+	if err != nil {
+		return i.fail(err)
+	}
+	secrets.Deployed, err = i.secretsDeployed(previousFingerprint)
+	if err != nil {
+		return i.fail(err)
+	}
+	secrets.DeployedOrigins, err = i.secretsDeployedOrigins(previousFingerprint)
+	if err != nil {
+		return i.fail(err)
+	}
+	secretsDirectories, err := secrets.Directories()
+	if err != nil {
 		return i.fail(err)
 	}
 
 	//
 
+	addresses, err := provider.AddressCandidates(ctx, resource)
+	if err != nil {
+		return i.fail(err)
+	}
+	for n, address := range addresses {
+		last := n == len(addresses)-1
+		err = resource.Set(KeyAddressUsed, address.String())
+		if err != nil {
+			return i.fail(err)
+		}
+		err = i.deploy(ctx, resource, provider, secrets, derivations, last)
+		if err == nil {
+			break
+		}
+		if last || !IsSshConnectionError(err) {
+			return i.fail(err)
+		}
+		tflog.Warn(ctx, fmt.Sprintf("failed to connect to %q, trying next address: %s", address.String(), err))
+	}
+
+	// NOTE: switch is not retried on the next address candidate,
+	// system activation failure is not a connection issue even if it reports one
 	err = provider.Switch(ctx, resource, derivations)
 	if err != nil {
 		return i.fail(err)
@@ -230,7 +524,7 @@ func (i Instance) Create(ctx context.Context, resource *schema.ResourceData, met
 		resource.SetId(i.generateId())
 	}
 
-	secretsFingerprintSchema, err := i.secretsFingerprintToSchema(secretsData)
+	secretsFingerprintSchema, err := i.secretsFingerprintToSchema(secretsData, secretsDirectories, nil, 0, nil)
 	if err != nil {
 		return i.fail(err)
 	}
@@ -248,6 +542,17 @@ func (i Instance) Create(ctx context.Context, resource *schema.ResourceData, met
 		return i.fail(err)
 	}
 
+	//
+
+	// NOTE: hooks are executed after system switch, so units they affect are up to date
+	err = i.runSecretsHooks(ctx, resource, provider, secrets, previousFingerprint, secretsData, secretsDirectories, secretsChanged)
+	if err != nil {
+		if errs, ok := err.(SecretsHookErrors); ok {
+			return errs.Diagnostics()
+		}
+		return i.fail(err)
+	}
+
 	return nil
 }
 
@@ -14,8 +14,14 @@ type (
 )
 
 func (*UnmarshalerPassthrough) Unmarshal(buf []byte, v interface{}) error {
-	rv := reflect.ValueOf(v)
-	rv.Elem().Set(reflect.ValueOf(buf))
+	rv := reflect.ValueOf(v).Elem()
+	// NOTE: commands receive result as interface{}
+	// so we should set the value behind the pointer (if any)
+	// otherwise it will be lost after return
+	if rv.Kind() == reflect.Interface && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		rv = rv.Elem().Elem()
+	}
+	rv.Set(reflect.ValueOf(buf))
 	return nil
 }
 
@@ -1,8 +1,12 @@
 package provider
 
 import (
+	"context"
 	"net"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -14,6 +18,14 @@ type (
 		IP IP
 		*net.IPNet
 	}
+
+	// Address is an ip address of the host,
+	// Name is set when host should be connected by name.
+	Address struct {
+		IP   IP
+		Zone string
+		Name string
+	}
 )
 
 func ParseCIDR(addr string) (*CIDR, error) {
@@ -28,60 +40,218 @@ func ParseIP(addr string) IP {
 	return net.ParseIP(addr)
 }
 
-func ToIPAddrs(in interface{}) []IP {
+// ParseAddress parses ip address (optionally with ipv6 zone, like fe80::1%eth0) or hostname.
+func ParseAddress(addr string) Address {
+	host, zone := addr, ""
+	if i := strings.LastIndexByte(addr, '%'); i >= 0 {
+		host, zone = addr[:i], addr[i+1:]
+	}
+	if ip := ParseIP(host); ip != nil {
+		return Address{IP: ip, Zone: zone}
+	}
+	return Address{Name: addr}
+}
+
+func ToAddresses(in interface{}) []Address {
 	var (
 		inSlice = in.([]interface{})
-		addrs   = make([]IP, len(inSlice))
+		addrs   = make([]Address, len(inSlice))
 	)
 	for i, addr := range inSlice {
-		addrs[i] = ParseIP(addr.(string))
+		addrs[i] = ParseAddress(addr.(string))
+	}
+	return addrs
+}
+
+// String returns address which is used to connect to the host,
+// name takes precedence over ip address when it is set.
+func (a Address) String() string {
+	switch {
+	case a.Name != "":
+		return a.Name
+	case a.Zone != "":
+		return a.IP.String() + "%" + a.Zone
+	default:
+		return a.IP.String()
+	}
+}
+
+type (
+	addressCacheKey struct{}
+	// addressCache holds hostnames resolved during the resource operation.
+	addressCache struct {
+		sync.Mutex
+		resolved map[string][]net.IPAddr
+	}
+)
+
+// WithAddressCache returns context in which each hostname is resolved once,
+// it wraps a single resource operation, so DNS changes are picked up by the next one.
+func WithAddressCache(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(addressCacheKey{}).(*addressCache); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, addressCacheKey{}, &addressCache{resolved: map[string][]net.IPAddr{}})
+}
+
+func lookupIPAddr(ctx context.Context, resolver *net.Resolver, name string) ([]net.IPAddr, error) {
+	cache, ok := ctx.Value(addressCacheKey{}).(*addressCache)
+	if !ok {
+		return resolver.LookupIPAddr(ctx, name)
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	if resolved, ok := cache.resolved[name]; ok {
+		return resolved, nil
+	}
+	resolved, err := resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	cache.resolved[name] = resolved
+	return resolved, nil
+}
+
+// ResolveAddresses resolves hostnames into ip addresses (A & AAAA records),
+// resolved addresses keep the name (to connect by name) only when byName is true.
+// Hostnames are resolved once when ctx is created with WithAddressCache.
+func ResolveAddresses(ctx context.Context, resolver *net.Resolver, in []Address, byName bool) ([]Address, error) {
+	addrs := make([]Address, 0, len(in))
+	for _, addr := range in {
+		if addr.IP != nil {
+			addrs = append(addrs, addr)
+			continue
+		}
+		resolved, err := lookupIPAddr(ctx, resolver, addr.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve address %q", addr.Name)
+		}
+		for _, ipAddr := range resolved {
+			resolvedAddr := Address{IP: ipAddr.IP, Zone: ipAddr.Zone}
+			if byName {
+				resolvedAddr.Name = addr.Name
+			}
+			addrs = append(addrs, resolvedAddr)
+		}
+	}
+	return addrs, nil
+}
+
+// UniqueAddresses removes addresses which connect to the same host (the first one is kept),
+// so hostname resolved into multiple ip addresses is tried once.
+func UniqueAddresses(in []Address) []Address {
+	var (
+		addrs = make([]Address, 0, len(in))
+		seen  = make(map[string]bool, len(in))
+	)
+	for _, addr := range in {
+		key := addr.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		addrs = append(addrs, addr)
 	}
 	return addrs
 }
 
-func SortIPAddress(priority map[*IPNet]int, in []IP) []IP {
-	addrs := make([]IP, len(in))
+func AddressWeight(priority map[*IPNet]int, addr Address) int {
+	weight := 0
+	for network, networkWeight := range priority {
+		if network.Contains(addr.IP) && networkWeight > weight {
+			weight = networkWeight
+		}
+	}
+	return weight
+}
+
+func SortAddress(priority map[*IPNet]int, in []Address) []Address {
+	addrs := make([]Address, len(in))
 	copy(addrs, in)
 	if len(priority) == 0 {
 		return addrs
 	}
 	sort.SliceStable(addrs, func(i, j int) bool {
-		iaddr, jaddr := in[i], in[j]
-		iweight, jweight := 0, 0
-		for network, weight := range priority {
-			if network.Contains(iaddr) {
-				if weight > iweight {
-					iweight = weight
-				}
-			}
-			if network.Contains(jaddr) {
-				if weight > jweight {
-					jweight = weight
-				}
-			}
-		}
-		return iweight > jweight
+		return AddressWeight(priority, addrs[i]) > AddressWeight(priority, addrs[j])
 	})
 	return addrs
 }
 
-func FilterIPAddress(filter []*CIDR, in []IP) []IP {
-	var (
-		addrs = make([]IP, len(in))
-		i     int
-	)
+func FilterAddress(filter []*CIDR, in []Address) []Address {
+	addrs := make([]Address, 0, len(in))
 	if len(filter) == 0 {
-		copy(addrs, in)
-		return addrs
+		return append(addrs, in...)
 	}
 	for _, addr := range in {
 		for _, cidr := range filter {
-			if cidr.Contains(addr) {
-				addrs[i] = addr
-				i++
+			if cidr.Contains(addr.IP) {
+				addrs = append(addrs, addr)
+				break
 			}
 		}
 	}
+	return addrs
+}
+
+const (
+	// AddressProbeDelay is a delay between connection attempts (RFC 8305).
+	AddressProbeDelay = 250 * time.Millisecond
+)
+
+// ProbeAddress races tcp connections to the port of each address (happy eyeballs),
+// next attempt starts after delay or as soon as previous attempt fails.
+// It returns the first address which accepted connection.
+func ProbeAddress(ctx context.Context, in []Address, port string, delay time.Duration, timeout time.Duration) (Address, error) {
+	if len(in) == 0 {
+		return Address{}, errors.New("no addresses to probe")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		addr Address
+		err  error
+	}
+	var (
+		results = make(chan result, len(in))
+		dialer  = &net.Dialer{}
+		timer   = time.NewTimer(0)
+		errs    = make([]string, 0, len(in))
+		pending int
+		next    int
+	)
+	defer timer.Stop()
 
-	return addrs[:i]
+	for {
+		select {
+		case <-timer.C:
+			if next >= len(in) {
+				continue
+			}
+			addr := in[next]
+			next++
+			pending++
+			go func() {
+				conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+				if err == nil {
+					_ = conn.Close()
+				}
+				results <- result{addr: addr, err: err}
+			}()
+			timer.Reset(delay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.addr, nil
+			}
+			errs = append(errs, r.err.Error())
+			if next < len(in) {
+				timer.Reset(0)
+			} else if pending == 0 {
+				return Address{}, errors.Errorf("no address is reachable on port %s: %s", port, strings.Join(errs, "; "))
+			}
+		case <-ctx.Done():
+			return Address{}, errors.Wrapf(ctx.Err(), "no address is reachable on port %s", port)
+		}
+	}
 }
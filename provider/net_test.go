@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, err)
+
+	closed, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("127.0.0.2 is not available")
+	}
+	closed.Close()
+
+	addr, err := ProbeAddress(
+		context.Background(),
+		[]Address{ParseAddress("127.0.0.2"), ParseAddress("127.0.0.1")},
+		port, 10*time.Millisecond, time.Second,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", addr.String())
+
+	_, err = ProbeAddress(
+		context.Background(),
+		[]Address{ParseAddress("127.0.0.2")},
+		port, 10*time.Millisecond, time.Second,
+	)
+	assert.Error(t, err)
+}
+
+func TestIsSshConnectionError(t *testing.T) {
+	assert.True(t, IsSshConnectionError(errors.New("ssh: connect to host 2001:db8::1 port 22: Network is unreachable")))
+	assert.True(t, IsSshConnectionError(errors.Wrap(&net.OpError{Op: "dial", Err: errors.New("refused")}, "failed to connect")))
+	assert.False(t, IsSshConnectionError(errors.New("remote command \"false\" exited with: ")))
+}
+
+func TestParseAddress(t *testing.T) {
+	addr := ParseAddress("fe80::1%eth0")
+	assert.Equal(t, "fe80::1", addr.IP.String())
+	assert.Equal(t, "eth0", addr.Zone)
+	assert.Equal(t, "fe80::1%eth0", addr.String())
+
+	addr = ParseAddress("192.168.1.1")
+	assert.Equal(t, "192.168.1.1", addr.String())
+	assert.Empty(t, addr.Name)
+
+	addr = ParseAddress("web01.internal")
+	assert.Nil(t, addr.IP)
+	assert.Equal(t, "web01.internal", addr.String())
+}
+
+func TestResolveAddresses(t *testing.T) {
+	in := []Address{ParseAddress("localhost"), ParseAddress("10.0.0.1")}
+
+	addrs, err := ResolveAddresses(context.Background(), net.DefaultResolver, in, false)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(addrs), 2)
+	for _, addr := range addrs {
+		assert.NotNil(t, addr.IP)
+		assert.Empty(t, addr.Name)
+	}
+
+	addrs, err = ResolveAddresses(context.Background(), net.DefaultResolver, in, true)
+	assert.NoError(t, err)
+	addrs = UniqueAddresses(addrs)
+	assert.Equal(t, []string{"localhost", "10.0.0.1"}, []string{addrs[0].String(), addrs[1].String()})
+	assert.Len(t, addrs, 2)
+}
+
+func TestResolveAddressesCache(t *testing.T) {
+	in := []Address{ParseAddress("web01.invalid")}
+
+	ctx := WithAddressCache(context.Background())
+	assert.Equal(t, ctx, WithAddressCache(ctx))
+	ctx.Value(addressCacheKey{}).(*addressCache).resolved["web01.invalid"] = []net.IPAddr{{IP: ParseIP("192.0.2.1")}}
+
+	// NOTE: cached hostname is not resolved again (even if context is done)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	addrs, err := ResolveAddresses(cancelled, net.DefaultResolver, in, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, []string{addrs[0].String()})
+
+	_, err = ResolveAddresses(cancelled, net.DefaultResolver, []Address{ParseAddress("web02.invalid")}, false)
+	assert.Error(t, err)
+}
+
+func TestFilterSortAddress(t *testing.T) {
+	ipv4, err := ParseCIDR("0.0.0.0/0")
+	assert.NoError(t, err)
+	ipv6, err := ParseCIDR("::/0")
+	assert.NoError(t, err)
+	private, err := ParseCIDR("10.0.0.0/8")
+	assert.NoError(t, err)
+
+	in := []Address{
+		ParseAddress("2001:db8::1"),
+		ParseAddress("192.0.2.1"),
+		ParseAddress("fe80::1%eth0"),
+		ParseAddress("10.0.0.1"),
+	}
+	addrs := SortAddress(
+		map[*IPNet]int{ipv4.IPNet: 1, private.IPNet: 2},
+		FilterAddress([]*CIDR{ipv4, ipv6}, in),
+	)
+	result := make([]string, len(addrs))
+	for n, addr := range addrs {
+		result[n] = addr.String()
+	}
+	assert.Equal(t, []string{"10.0.0.1", "192.0.2.1", "2001:db8::1", "fe80::1%eth0"}, result)
+
+	assert.Len(t, FilterAddress([]*CIDR{private}, in), 1)
+}
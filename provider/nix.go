@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/pkg/errors"
 )
 
 type (
@@ -40,6 +42,18 @@ type (
 		Arguments []string
 	}
 	NixCopyCommandOption func(*NixCopyCommand)
+	NixCopyTarget        struct {
+		Nix         *Nix
+		Host        string
+		Parameters  url.Values
+		NoCheckSigs bool
+	}
+
+	NixTrustedUser struct {
+		User         string
+		Groups       []string
+		TrustedUsers []string
+	}
 
 	//
 
@@ -79,6 +93,14 @@ const (
 	NixEnvironmentSshOpts = "NIX_SSHOPTS"
 )
 
+const (
+	// NixTrustedUserScript prints ssh user, its groups and nix trusted-users,
+	// nix config show is not available in older nix versions.
+	NixTrustedUserScript = `id -un; id -Gn; printf 'trusted-users = %s\n' "$(` +
+		`nix --extra-experimental-features nix-command config show trusted-users 2>/dev/null || ` +
+		`nix --extra-experimental-features nix-command show-config 2>/dev/null | sed -n 's/^trusted-users = //p')"`
+)
+
 const (
 	// NixMode exists to address some bugs in nix
 	// - https://github.com/NixOS/nix/pull/6522
@@ -114,11 +136,19 @@ var (
 )
 
 func (n NixCopyProtocol) Path(path string) string {
+	return n.PathWithParameters(path, nil)
+}
+
+func (n NixCopyProtocol) PathWithParameters(path string, parameters url.Values) string {
 	u := &url.URL{}
 	if len(n) > 0 {
 		u.Scheme = string(n)
 	}
 	u.Path = path
+	if len(parameters) > 0 {
+		// NOTE: nix does not decode + as a space in query parameters
+		u.RawQuery = strings.ReplaceAll(parameters.Encode(), "+", "%20")
+	}
 	return u.String()
 }
 
@@ -126,11 +156,14 @@ func (n NixCopyProtocol) Path(path string) string {
 
 func (n *Nix) With(options ...NixOption) *Nix {
 	nn := &Nix{
-		Arguments:   make([]string, len(n.Arguments)),
-		Environment: n.Environment.Copy(),
-		Ssh:         n.Ssh.With(),
+		Mode:           n.Mode,
+		Arguments:      make([]string, len(n.Arguments)),
+		Environment:    n.Environment.Copy(),
+		Ssh:            n.Ssh.With(),
+		CommandOptions: make([]CommandOption, len(n.CommandOptions)),
 	}
 	copy(nn.Arguments, n.Arguments)
+	copy(nn.CommandOptions, n.CommandOptions)
 
 	for _, option := range options {
 		option(nn)
@@ -182,6 +215,12 @@ func NixBuildCommandOptionArgStr(name string, value string) NixBuildCommandOptio
 	}
 }
 
+func NixBuildCommandOptionAttributes(attributes ...string) NixBuildCommandOption {
+	return func(n *NixBuildCommand) {
+		n.Arguments = append(n.Arguments, attributes...)
+	}
+}
+
 func NixBuildCommandOptionNoLink() NixBuildCommandOption {
 	return func(n *NixBuildCommand) {
 		n.Arguments = append(n.Arguments, "--no-link")
@@ -261,6 +300,12 @@ func NixCopyCommandOptionTo(protocol NixCopyProtocol, to string) NixCopyCommandO
 	}
 }
 
+func NixCopyCommandOptionToWithParameters(protocol NixCopyProtocol, to string, parameters url.Values) NixCopyCommandOption {
+	return func(b *NixCopyCommand) {
+		b.Arguments = append(b.Arguments, "--to", protocol.PathWithParameters(to, parameters))
+	}
+}
+
 func NixCopyCommandOptionFrom(protocol NixCopyProtocol, from string) NixCopyCommandOption {
 	return func(n *NixCopyCommand) {
 		n.Arguments = append(n.Arguments, "--from", protocol.Path(from))
@@ -279,6 +324,12 @@ func NixCopyCommandOptionUseSubstitutes() NixCopyCommandOption {
 	}
 }
 
+func NixCopyCommandOptionNoCheckSigs() NixCopyCommandOption {
+	return func(n *NixCopyCommand) {
+		n.Arguments = append(n.Arguments, "--no-check-sigs")
+	}
+}
+
 func (n *NixCopyCommand) Command() (string, []string, []CommandOption) {
 	command, arguments, options := n.Nix.Command()
 	return command, append(append(arguments, "copy"), n.Arguments...), options
@@ -291,6 +342,61 @@ func (n *NixCopyCommand) Execute(result interface{}) error {
 
 func (n *NixCopyCommand) Close() error { return nil }
 
+// Copy returns command which copies path to the target,
+// parameters are merged with target parameters.
+func (t *NixCopyTarget) Copy(path string, parameters url.Values) *NixCopyCommand {
+	merged := url.Values{}
+	for key, values := range t.Parameters {
+		merged[key] = values
+	}
+	for key, values := range parameters {
+		merged[key] = values
+	}
+	options := []NixCopyCommandOption{
+		NixCopyCommandOptionToWithParameters(NixCopyProtocolSSH, t.Host, merged),
+	}
+	if t.NoCheckSigs {
+		options = append(options, NixCopyCommandOptionNoCheckSigs())
+	}
+	return t.Nix.Copy(append(options, NixCopyCommandOptionPath(path))...)
+}
+
+//
+
+// Trusted reports whether user is allowed to import unsigned paths.
+func (u *NixTrustedUser) Trusted() bool {
+	for _, trusted := range u.TrustedUsers {
+		switch {
+		case trusted == "*", trusted == u.User:
+			return true
+		case strings.HasPrefix(trusted, "@"):
+			for _, group := range u.Groups {
+				if trusted[1:] == group {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func NixParseTrustedUser(buf string) (*NixTrustedUser, error) {
+	lines := strings.Split(strings.TrimSpace(buf), "\n")
+	if len(lines) < 3 {
+		return nil, errors.Errorf("unexpected nix trusted-users output: %q", buf)
+	}
+	trustedUsers := strings.TrimSpace(lines[len(lines)-1])
+	if !strings.HasPrefix(trustedUsers, "trusted-users =") {
+		return nil, errors.Errorf("unexpected nix trusted-users output: %q", buf)
+	}
+	trustedUsers = strings.TrimPrefix(trustedUsers, "trusted-users =")
+	return &NixTrustedUser{
+		User:         strings.TrimSpace(lines[0]),
+		Groups:       strings.Fields(lines[1]),
+		TrustedUsers: strings.Fields(trustedUsers),
+	}, nil
+}
+
 //
 
 func (n *Nix) Profile(options ...NixProfileCommandOption) *NixProfileCommand {
@@ -368,6 +474,8 @@ func NixOptionSsh(s *Ssh) NixOption {
 	return func(n *Nix) {
 		n.Ssh = s
 		setOpts(n)
+		// NOTE: nix runs ssh, so it should get ssh environment (agent, askpass)
+		n.Environment = n.Environment.With(s.Environment)
 	}
 }
 
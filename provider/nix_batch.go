@@ -0,0 +1,187 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// NixBuildRequest describes single wrapper evaluation
+	// which may be built alone or batched with other requests.
+	NixBuildRequest struct {
+		WrapperPath string
+		Wrapper     []byte
+		Arguments   map[string]string
+		Attributes  []string
+		// Context of the submitter, batch is cancelled only when contexts of all requests are done.
+		Context context.Context
+
+		Derivations Derivations
+		Err         error
+		done        chan struct{}
+	}
+
+	// NixBuildBatcher coalesces build requests submitted within
+	// a time window into a single batch (per batch key).
+	NixBuildBatcher struct {
+		sync.Mutex
+		Window  time.Duration
+		batches map[string]*nixBuildBatch
+	}
+	nixBuildBatch struct {
+		requests []*NixBuildRequest
+	}
+	NixBuildBatchExecutor func(requests []*NixBuildRequest)
+	// nixBuildBatchContext keeps values of the parent context but is never cancelled with it.
+	nixBuildBatchContext struct {
+		context.Context
+	}
+
+	NixBuildBatchEntry struct {
+		Wrapper   string            `json:"wrapper"`
+		Arguments map[string]string `json:"arguments"`
+	}
+)
+
+//go:embed nix_batch_wrapper.nix
+var NixBatchWrapper []byte
+
+//
+
+func (r *NixBuildRequest) ArgumentsNames() []string {
+	names := make([]string, 0, len(r.Arguments))
+	for name := range r.Arguments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Key uniquely identifies request, it is used for memoization & deduplication.
+func (r *NixBuildRequest) Key() string {
+	key := sha1.New()
+	if r.WrapperPath != "" {
+		_, _ = key.Write([]byte(r.WrapperPath))
+	} else {
+		_, _ = key.Write(r.Wrapper)
+	}
+	for _, name := range r.ArgumentsNames() {
+		_, _ = key.Write([]byte(name + "=" + r.Arguments[name] + "\n"))
+	}
+	for _, attribute := range r.Attributes {
+		_, _ = key.Write([]byte(attribute + "\n"))
+	}
+	return hex.EncodeToString(key.Sum(nil))
+}
+
+// Installables returns attribute paths to build inside batch expression
+// where request is available under name.
+func (r *NixBuildRequest) Installables(name string) []string {
+	if len(r.Attributes) == 0 {
+		return []string{name + ".out_path"}
+	}
+	installables := make([]string, len(r.Attributes))
+	for n, attribute := range r.Attributes {
+		installables[n] = name + "." + attribute
+	}
+	return installables
+}
+
+func (r *NixBuildRequest) Done(derivations Derivations, err error) {
+	r.Derivations = derivations
+	r.Err = err
+	close(r.done)
+}
+
+func (r *NixBuildRequest) Wait() (Derivations, error) {
+	<-r.done
+	return r.Derivations, r.Err
+}
+
+func NewNixBuildRequest(wrapperPath string, wrapper []byte, arguments map[string]string, attributes ...string) *NixBuildRequest {
+	return &NixBuildRequest{
+		WrapperPath: wrapperPath,
+		Wrapper:     wrapper,
+		Arguments:   arguments,
+		Attributes:  attributes,
+		done:        make(chan struct{}),
+	}
+}
+
+//
+
+func NixBuildBatchName(n int) string {
+	return "r" + strconv.Itoa(n)
+}
+
+func (nixBuildBatchContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (nixBuildBatchContext) Done() <-chan struct{}       { return nil }
+func (nixBuildBatchContext) Err() error                  { return nil }
+
+// NixBuildBatchContext returns context which is used to build the batch of requests,
+// it has values of the first request context (logger) and it is cancelled when all requests are cancelled,
+// so cancellation of a single resource does not affect builds of others.
+func NixBuildBatchContext(requests []*NixBuildRequest) (context.Context, context.CancelFunc) {
+	parent := context.Background()
+	if len(requests) > 0 && requests[0].Context != nil {
+		parent = requests[0].Context
+	}
+	ctx, cancel := context.WithCancel(nixBuildBatchContext{parent})
+	go func() {
+		for _, request := range requests {
+			if request.Context == nil {
+				return
+			}
+			select {
+			case <-request.Context.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+//
+
+// Submit adds request to the batch identified by key and waits for results.
+// Executor of the first request in the batch will be used to build the whole batch
+// after the window is passed.
+func (b *NixBuildBatcher) Submit(key string, request *NixBuildRequest, execute NixBuildBatchExecutor) (Derivations, error) {
+	if b.Window <= 0 {
+		execute([]*NixBuildRequest{request})
+		return request.Wait()
+	}
+
+	b.Lock()
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &nixBuildBatch{}
+		b.batches[key] = batch
+		time.AfterFunc(b.Window, func() {
+			b.Lock()
+			delete(b.batches, key)
+			b.Unlock()
+
+			execute(batch.requests)
+		})
+	}
+	batch.requests = append(batch.requests, request)
+	b.Unlock()
+
+	return request.Wait()
+}
+
+func NewNixBuildBatcher(window time.Duration) *NixBuildBatcher {
+	return &NixBuildBatcher{
+		Window:  window,
+		batches: map[string]*nixBuildBatch{},
+	}
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNixBuildBatcher(t *testing.T) {
+	var (
+		batcher = NewNixBuildBatcher(50 * time.Millisecond)
+		batches = make(chan int, 4)
+		wg      sync.WaitGroup
+	)
+	execute := func(requests []*NixBuildRequest) {
+		batches <- len(requests)
+		for _, request := range requests {
+			request.Done(Derivations{{Path: request.Arguments["configuration"]}}, nil)
+		}
+	}
+
+	for _, configuration := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(configuration string) {
+			defer wg.Done()
+			request := NewNixBuildRequest("", NixWrapper, map[string]string{"configuration": configuration})
+			derivations, err := batcher.Submit("key", request, execute)
+			assert.NoError(t, err)
+			assert.Equal(t, configuration, derivations[0].Path)
+		}(configuration)
+	}
+	wg.Wait()
+	close(batches)
+
+	sizes := []int{}
+	for size := range batches {
+		sizes = append(sizes, size)
+	}
+	assert.Equal(t, []int{3}, sizes)
+}
+
+func TestNixBuildRequestKey(t *testing.T) {
+	a := NewNixBuildRequest("", NixWrapper, map[string]string{"system": "x86_64-linux", "configuration": "a"})
+	b := NewNixBuildRequest("", NixWrapper, map[string]string{"configuration": "a", "system": "x86_64-linux"})
+	c := NewNixBuildRequest("", NixWrapper, map[string]string{"configuration": "a", "system": "aarch64-linux"})
+	d := NewNixBuildRequest("", NixImageWrapper, map[string]string{"configuration": "a", "system": "x86_64-linux"})
+
+	assert.Equal(t, a.Key(), b.Key())
+	assert.NotEqual(t, a.Key(), c.Key())
+	assert.NotEqual(t, a.Key(), d.Key())
+	assert.Equal(t, []string{"r0.out_path"}, a.Installables(NixBuildBatchName(0)))
+}
+
+func TestNixBuildBatchContext(t *testing.T) {
+	type key struct{}
+	var (
+		first, cancelFirst   = context.WithCancel(context.WithValue(context.Background(), key{}, "logger"))
+		second, cancelSecond = context.WithCancel(context.Background())
+		requests             = []*NixBuildRequest{{Context: first}, {Context: second}}
+	)
+	defer cancelSecond()
+
+	ctx, cancel := NixBuildBatchContext(requests)
+	defer cancel()
+	assert.Equal(t, "logger", ctx.Value(key{}))
+
+	// NOTE: batch is not cancelled while some of the submitters are waiting for it
+	cancelFirst()
+	select {
+	case <-ctx.Done():
+		t.Fatal("batch context is cancelled with the first request context")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("batch context is not cancelled when all request contexts are done")
+	}
+}
@@ -0,0 +1,18 @@
+{ requests }:
+let
+  inherit (builtins)
+    fromJSON
+    functionArgs
+    intersectAttrs
+    mapAttrs
+    readFile
+  ;
+
+  # NOTE: nix passes only arguments which wrapper function accepts
+  # when it is called with --argstr, so do we
+  call = wrapper: arguments:
+    let f = import wrapper;
+    in f (intersectAttrs (functionArgs f) arguments);
+in mapAttrs
+  (name: request: call request.wrapper request.arguments)
+  (fromJSON (readFile requests))
@@ -8,7 +8,13 @@ import (
 //go:embed nix_conf_wrapper.nix
 var NixWrapper []byte
 
-func NewNixWrapperFile(path string) (File, error) {
+//go:embed nix_image_wrapper.nix
+var NixImageWrapper []byte
+
+//go:embed nix_install_wrapper.nix
+var NixInstallWrapper []byte
+
+func NewNixWrapperFile(path string, wrapper []byte) (File, error) {
 	var (
 		fd  File
 		err error
@@ -18,7 +24,7 @@ func NewNixWrapperFile(path string) (File, error) {
 		if err != nil {
 			return nil, err
 		}
-		_, err = fd.Write(NixWrapper)
+		_, err = fd.Write(wrapper)
 		if err != nil {
 			fd.Close()
 			return nil, err
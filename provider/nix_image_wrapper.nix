@@ -0,0 +1,48 @@
+{ nixpkgs   ? <nixpkgs>
+, system    ? builtins.currentSystem
+, settings  ? "{}"
+, format    ? "qcow2"
+, disk_size ? "auto"
+, configuration
+}:
+let
+  inherit (builtins)
+    fromJSON
+  ;
+
+  # maps image format to make-disk-image.nix format
+  diskFormats = {
+    raw   = "raw";
+    qcow2 = "qcow2";
+    vhd   = "vpc";
+  };
+
+  ##
+
+  configurationModule = { config, lib, pkgs, ... }:
+    { imports = [ configuration ]
+        ++ (if format == "iso"
+            then [ "${nixpkgs}/nixos/modules/installer/cd-dvd/iso-image.nix" ]
+            else []);
+      config = fromJSON settings;
+    };
+  os = import "${nixpkgs}/nixos"
+    { inherit system;
+      configuration = configurationModule;
+    };
+
+  image =
+    if format == "iso"
+    then os.config.system.build.isoImage
+    else import "${nixpkgs}/nixos/lib/make-disk-image.nix" {
+      inherit (os) config pkgs;
+      inherit (os.pkgs) lib;
+      diskSize = if disk_size == "auto" then disk_size else fromJSON disk_size;
+      format = diskFormats.${format};
+    };
+in {
+  currentSystem = system;
+
+  drv_path = image.drvPath;
+  out_path = image;
+}
@@ -0,0 +1,54 @@
+{ nixpkgs            ? <nixpkgs>
+, system             ? builtins.currentSystem
+, settings           ? "{}"
+, installer_settings ? "{}"
+, disko              ? "https://github.com/nix-community/disko/archive/master.tar.gz"
+, disk_layout
+, configuration
+}:
+let
+  inherit (builtins)
+    fetchTarball
+    fromJSON
+    match
+  ;
+
+  diskoSource =
+    if match "https?://.*" disko != null
+    then fetchTarball disko
+    else disko;
+
+  ##
+
+  configurationModule = { config, lib, pkgs, ... }:
+    { imports = [
+        configuration
+        disk_layout
+        "${diskoSource}/module.nix"
+      ];
+      config = fromJSON settings;
+    };
+  installerModule = { config, lib, pkgs, ... }:
+    { imports = [
+        "${nixpkgs}/nixos/modules/installer/netboot/netboot-minimal.nix"
+        { services.openssh.enable = true; }
+      ];
+      config = fromJSON installer_settings;
+    };
+
+  os = import "${nixpkgs}/nixos"
+    { inherit system;
+      configuration = configurationModule;
+    };
+  installer = import "${nixpkgs}/nixos"
+    { inherit system;
+      configuration = installerModule;
+    };
+in {
+  currentSystem = system;
+
+  drv_path     = os.config.system.build.toplevel.drvPath;
+  out_path     = os.config.system.build.toplevel;
+  disko_script = os.config.system.build.diskoScript;
+  kexec_tree   = installer.config.system.build.kexecTree;
+}
@@ -29,6 +29,26 @@ func CreateTemp(name string) (*TempFile, error) {
 	return &TempFile{File: fd}, nil
 }
 
+type TempDir struct {
+	Path string
+}
+
+func (d TempDir) Name() string {
+	return d.Path
+}
+
+func (d TempDir) Close() error {
+	return os.RemoveAll(d.Path)
+}
+
+func CreateTempDir(name string) (*TempDir, error) {
+	path, err := os.MkdirTemp("", name)
+	if err != nil {
+		return nil, err
+	}
+	return &TempDir{Path: path}, nil
+}
+
 var (
 	_ File = TempFile{}
 )
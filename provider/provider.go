@@ -1,16 +1,31 @@
 package provider
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 //
@@ -21,23 +36,127 @@ type (
 
 		addressFilter   []*CIDR
 		addressPriority map[*IPNet]int
+		builds          *NixBuildBatcher
+		buildSlots      *Semaphore
+		copySlots       *Semaphore
+		activationSlots *Semaphore
+
+		sshClientsLock sync.Mutex
+		sshClients     map[string]*SshClient
+		// sshClientLocks serialize dialing per pool key (hosts are dialed in parallel)
+		sshClientLocks map[string]*sync.Mutex
+		sshDirLock     sync.Mutex
+		sshDir         *TempDir
+		sshAgent       *SshAgent
+		// sshCertificates holds expiration time of certificates in the agent
+		sshCertificates map[string]time.Time
+		sshAskpass      *SshAskpass
+
+		secretBuffersLock sync.Mutex
+		secretBuffers     map[string]*LockedBuffer
+
+		vaultClientsLock sync.Mutex
+		vaultClients     map[string]*VaultClient
+	}
+
+	// sshConfigs is ssh configuration of the target & bastions (in order of connection)
+	// with environment ssh should be executed with.
+	sshConfigs struct {
+		Target      *SshConfigMap
+		Bastions    []*SshConfigMap
+		Environment Environment
+		Become      *Become
+		// TunnelPort is a port sshd listens on the target itself (native transport).
+		TunnelPort int
+	}
+	// sshCredentials tracks credentials resolution for the resource,
+	// secrets provider is created only if credentials sources are defined.
+	sshCredentials struct {
+		resource ResourceBox
+		provider SecretsProvider
+		askpass  bool
 	}
 )
 
-func (p *Provider) Address(rawAddrs interface{}) (IP, error) {
-	var ip IP
+func (c *sshCredentials) secretsProvider(p *Provider) (SecretsProvider, error) {
+	if c.provider != nil {
+		return c.provider, nil
+	}
+	var err error
+	c.provider, err = p.NewSecretsProvider(c.resource)
+	return c.provider, err
+}
+
+// Addresses returns addresses filtered and ordered by priority,
+// hostnames are resolved (once per operation, see WithAddressCache) and filters are applied to resolved addresses.
+func (p *Provider) Addresses(ctx context.Context, rawAddrs interface{}) ([]Address, error) {
 	if rawAddrs == nil {
-		return ip, errors.Errorf("rawAddrs should not be nil")
+		return nil, errors.Errorf("rawAddrs should not be nil")
 	}
 
-	var addrs = FilterIPAddress(p.addressFilter, ToIPAddrs(rawAddrs))
+	addrs, err := ResolveAddresses(
+		ctx, net.DefaultResolver,
+		ToAddresses(rawAddrs),
+		p.Get(KeyConnectByName).(bool),
+	)
+	if err != nil {
+		return nil, err
+	}
+	addrs = FilterAddress(p.addressFilter, addrs)
 	if len(addrs) == 0 {
-		return ip, errors.Errorf("no address from list %q matched with current address filters", addrs)
+		return nil, errors.Errorf("no address from list %q matched with current address filters", rawAddrs)
+	}
+
+	return UniqueAddresses(SortAddress(p.addressPriority, addrs)), nil
+}
+
+func (p *Provider) Address(ctx context.Context, rawAddrs interface{}) (Address, error) {
+	addrs, err := p.Addresses(ctx, rawAddrs)
+	if err != nil {
+		return Address{}, err
+	}
+	return addrs[0], nil
+}
+
+// ResourceAddress returns address which is used to connect to the resource host,
+// address selected during apply (address_used) takes precedence.
+func (p *Provider) ResourceAddress(ctx context.Context, resource ResourceBox) (Address, error) {
+	if used, _ := resource.Get(KeyAddressUsed).(string); used != "" {
+		return ParseAddress(used), nil
+	}
+	return p.Address(ctx, resource.Get(KeyAddress))
+}
+
+// AddressCandidates returns resource addresses in order they should be tried to connect,
+// when address probing is enabled the first address accepting ssh connections goes first.
+// NOTE: probing is skipped for connections through bastion hosts (target is not reachable directly).
+func (p *Provider) AddressCandidates(ctx context.Context, resource ResourceBox) ([]Address, error) {
+	addrs, err := p.Addresses(ctx, resource.Get(KeyAddress))
+	if err != nil {
+		return nil, err
+	}
+	if !p.Get(KeyAddressProbe).(bool) || len(addrs) < 2 || len(p.BastionSettings(resource)) > 0 {
+		return addrs, nil
 	}
 
-	ip = SortIPAddress(p.addressPriority, addrs)[0]
+	port, _ := p.SshConfigMap(p.SshSettings(resource)).Get(SshConfigKeyPort)
+	if port == "" {
+		port = strconv.Itoa(SshDefaultPort)
+	}
+	reachable, err := ProbeAddress(ctx, addrs, port, AddressProbeDelay, ReadyProbeTimeout)
+	if err != nil {
+		tflog.Warn(ctx, "address probing failed: "+err.Error())
+		return addrs, nil
+	}
 
-	return ip, nil
+	candidates := make([]Address, 0, len(addrs))
+	candidates = append(candidates, reachable)
+	for _, addr := range addrs {
+		if addr.String() != reachable.String() {
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates, nil
 }
 
 //
@@ -76,10 +195,58 @@ func (p *Provider) initAddressPriority() error {
 	return nil
 }
 
+func (p *Provider) initBuilds() error {
+	window := time.Duration(p.Get(KeyBuildBatchWindow).(int)) * time.Millisecond
+	p.builds = NewNixBuildBatcher(window)
+	return nil
+}
+
+func (p *Provider) initSlots() error {
+	p.buildSlots = NewSemaphore("build", p.Get(KeyMaxParallelBuilds).(int))
+	p.copySlots = NewSemaphore("copy", p.Get(KeyMaxParallelCopies).(int))
+	p.activationSlots = NewSemaphore("activation", p.Get(KeyMaxParallelActivations).(int))
+	return nil
+}
+
+func (p *Provider) initSshClients() error {
+	p.sshClients = map[string]*SshClient{}
+	p.sshClientLocks = map[string]*sync.Mutex{}
+	return nil
+}
+
+func (p *Provider) initSecretBuffers() error {
+	p.secretBuffers = map[string]*LockedBuffer{}
+	return nil
+}
+
+func (p *Provider) initVaultClients() error {
+	p.vaultClients = map[string]*VaultClient{}
+	return nil
+}
+
+// sshDirectory returns provider ssh directory (created lazily, so it is recreated after Close),
+// sshDirLock should be held by the caller.
+func (p *Provider) sshDirectory() (string, error) {
+	if p.sshDir == nil {
+		// NOTE: keep it short, unix socket path length is limited
+		dir, err := CreateTempDir("ssh.*")
+		if err != nil {
+			return "", err
+		}
+		p.sshDir = dir
+	}
+	return p.sshDir.Name(), nil
+}
+
 func (p *Provider) init() error {
 	initializers := []func() error{
 		p.initAddressFilter,
 		p.initAddressPriority,
+		p.initBuilds,
+		p.initSlots,
+		p.initSshClients,
+		p.initSecretBuffers,
+		p.initVaultClients,
 	}
 	for _, initializer := range initializers {
 		err := initializer()
@@ -194,6 +361,22 @@ func (p *Provider) settings(resource ResourceBox, path ...string) map[string]int
 	return providerLevel
 }
 
+// settingsBlock returns nested block (set or list with maxItems == 1) value, nil if block is empty.
+func settingsBlock(value interface{}) map[string]interface{} {
+	var items []interface{}
+	switch v := value.(type) {
+	case *schema.Set:
+		items = v.List()
+	case []interface{}:
+		items = v
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	block, _ := items[0].(map[string]interface{})
+	return block
+}
+
 // retrieve list of hashmap's from set with maxItems == infinity
 func (p *Provider) settingsSet(resource ResourceBox, path ...string) []map[string]interface{} {
 	settings, _ := p.resolveSettings(p, path...).([]interface{})
@@ -229,8 +412,33 @@ func (p *Provider) SshSettings(resource ResourceBox) map[string]interface{} {
 	return p.settings(resource, KeySsh)
 }
 
-func (p *Provider) BastionSettings(resource ResourceBox) map[string]interface{} {
-	return p.settings(resource, KeyBastion)
+// BastionSettings returns ordered list of bastion hops settings,
+// resource level list replaces provider level list (chains are not merged).
+func (p *Provider) BastionSettings(resource ResourceBox) []map[string]interface{} {
+	hops, _ := p.resolveSettings(p, KeyBastion).([]interface{})
+	if resource != nil {
+		resourceHops, _ := p.resolveSettings(resource, KeyBastion).([]interface{})
+		if len(resourceHops) > 0 {
+			hops = resourceHops
+		}
+	}
+
+	settings := make([]map[string]interface{}, 0, len(hops))
+	for _, hop := range hops {
+		hopSettings, ok := hop.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if host, _ := hopSettings[KeySshHost].(string); host == "" {
+			continue
+		}
+		settings = append(settings, hopSettings)
+	}
+	return settings
+}
+
+func (p *Provider) BecomeSettings(resource ResourceBox) map[string]interface{} {
+	return p.settings(resource, KeyBecome)
 }
 
 func (p *Provider) SshConfigMap(settings map[string]interface{}) *SshConfigMap {
@@ -245,13 +453,50 @@ func (p *Provider) SshConfigMap(settings map[string]interface{}) *SshConfigMap {
 		sshConfigMap.Set(SshConfigKeyPort, strconv.Itoa(sshPort))
 	}
 	if sshConfig, ok := settings[KeySshConfig].(map[string]interface{}); ok {
-		for k, v := range sshConfig {
-			sshConfigMap.Set(k, v.(string))
+		keys := make([]string, 0, len(sshConfig))
+		for k := range sshConfig {
+			keys = append(keys, k)
+		}
+		// NOTE: map has no order, keep configuration (and native connection pool keys) stable
+		sort.Strings(keys)
+		for _, k := range keys {
+			sshConfigMap.Set(k, sshConfig[k].(string))
+		}
+	}
+	for _, directive := range sshConfigDirectivesSettings(settings[KeySshConfigDirective]) {
+		sshConfigMap.Add(directive.Key, directive.Value)
+	}
+	if blocks, ok := settings[KeySshConfigBlock].([]interface{}); ok {
+		for _, rawBlock := range blocks {
+			block := rawBlock.(map[string]interface{})
+			blockConfigMap := NewSshConfigMap()
+			for _, directive := range sshConfigDirectivesSettings(block[KeySshConfigDirective]) {
+				blockConfigMap.Add(directive.Key, directive.Value)
+			}
+			sshConfigMap.AddBlock(block[KeySshConfigBlockCondition].(string), blockConfigMap)
+		}
+	}
+	if includes, ok := settings[KeySshConfigInclude].([]interface{}); ok {
+		for _, include := range includes {
+			sshConfigMap.AddInclude(include.(string))
 		}
 	}
 	return sshConfigMap
 }
 
+func sshConfigDirectivesSettings(value interface{}) SshConfigPairs {
+	directives, _ := value.([]interface{})
+	pairs := make(SshConfigPairs, 0, len(directives))
+	for _, rawDirective := range directives {
+		directive := rawDirective.(map[string]interface{})
+		pairs = append(pairs, SshConfigKeyValue{
+			Key:   directive[KeySshConfigDirectiveName].(string),
+			Value: directive[KeySshConfigDirectiveValue].(string),
+		})
+	}
+	return pairs
+}
+
 func (p *Provider) SecretsSettings(resource ResourceBox) map[string]interface{} {
 	return p.settings(resource, KeySecrets)
 }
@@ -262,7 +507,7 @@ func (p *Provider) SecretsSet(resource ResourceBox) []map[string]interface{} {
 
 //
 
-func (p *Provider) NewNix(ctx context.Context, resource ResourceBox) *Nix {
+func (p *Provider) NewNix(ctx context.Context, resource ResourceBox) (*Nix, error) {
 	settings := p.NixSettings(resource)
 	options := []NixOption{
 		NixOptionWithCommandOptions(CommandOptionTflogTee(ctx)),
@@ -284,213 +529,1430 @@ func (p *Provider) NewNix(ctx context.Context, resource ResourceBox) *Nix {
 		options = append(options, NixOptionUseSubstitutes())
 	}
 
+	ssh, err := p.NewSsh(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
 	options = append(
 		options,
-		NixOptionSsh(p.NewSsh(resource)),
+		NixOptionSsh(ssh),
 	)
 
-	return NewNix(options...)
+	return NewNix(options...), nil
 }
 
-func (p *Provider) NewSsh(resource ResourceBox) *Ssh {
-	var (
-		options []SshOption
+func (p *Provider) NewSsh(ctx context.Context, resource ResourceBox) (*Ssh, error) {
+	configs, err := p.sshConfigs(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	return p.newSsh(configs), nil
+}
 
+// sshConfigs returns target & bastion hops (in order of connection)
+// ssh configurations for the resource.
+func (p *Provider) sshConfigs(ctx context.Context, resource ResourceBox) (*sshConfigs, error) {
+	var (
 		settings        = p.SshSettings(resource)
 		configMap       = p.SshConfigMap(settings)
 		bastionSettings = p.BastionSettings(resource)
+		configs         = &sshConfigs{
+			Target:   configMap,
+			Bastions: make([]*SshConfigMap, len(bastionSettings)),
+		}
+		credentials = &sshCredentials{resource: resource}
 	)
 
-	bastionHost, _ := bastionSettings[KeySshHost].(string)
-	if bastionHost != "" {
-		bastionConfigMap := p.SshConfigMap(bastionSettings)
-		// NOTE: base ssh configuration (ssh {}) extended with bastion ssh configuration (ssh { bastion {} })
-		extendedBastionConfigMap := configMap.Copy()
-		extendedBastionConfigMap.Extend(bastionConfigMap)
-
-		bastion := NewSsh(
-			SshOptionConfigMap(extendedBastionConfigMap),
-			SshOptionNonInteractive(),
-			SshOptionIORedirection("%h", "%p"),
-			SshOptionHost(bastionHost),
-		)
-		command, arguments, _ := bastion.Command()
-		configMap.Set(
-			SshConfigKeyProxyCommand,
-			strings.Join(append([]string{command}, arguments...), " "),
-		)
+	if port, ok := settings[KeySshTunnelPort].(int); ok && port > 0 {
+		configs.TunnelPort = port
 	}
 
-	if configMap.Len() > 0 {
-		options = append(
-			options,
-			SshOptionConfigMap(configMap),
-		)
+	if multiplex, ok := settings[KeySshMultiplex].(bool); ok && multiplex {
+		// NOTE: control options are set before bastion configuration is derived
+		// so bastion gets it's own master connection too (%C is a hash of host, port & user)
+		err := p.sshMultiplex(configMap)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return NewSsh(options...)
-}
-
-func (p *Provider) NewSecrets(resource ResourceBox) (*Secrets, error) {
-	schemaSecrets := p.SecretsSettings(resource)
-	providerName := schemaSecrets[KeySecretsProvider].(string)
+	// NOTE: private key is added to the agent before bastion configuration
+	// is derived, so bastions could use it too
+	err := p.sshPrivateKey(credentials, configMap, settings)
+	if err != nil {
+		return nil, err
+	}
+	err = p.sshCertificate(credentials, configMap, settings)
+	if err != nil {
+		return nil, err
+	}
 
-	var provider SecretsProvider
-	switch strings.ToLower(providerName) {
-	case string(SecretsProviderNameFilesystem):
-		// NOTE: this does nothing now, but we may have filesystem options in future
-		_ = p.settings(resource, KeySecrets, KeySecretsProviderFilesystem)
-		provider = NewSecretsProviderFilesystem()
-	case string(SecretsProviderNameCommand):
-		settings := p.settings(resource, KeySecrets, KeySecretsProviderCommand)
+	for n, hopSettings := range bastionSettings {
+		// NOTE: base ssh configuration (ssh {}) extended with bastion ssh configuration (bastion {})
+		bastionConfigMap := configMap.Copy()
+		bastionConfigMap.Extend(p.SshConfigMap(hopSettings))
 
-		name := settings[KeySecretsProviderCommandName].(string)
-		argumentsRaw := settings[KeySecretsProviderCommandArguments].([]interface{})
-		arguments := make([]string, len(argumentsRaw))
-		for n, argument := range argumentsRaw {
-			arguments[n] = argument.(string)
+		err = p.sshPrivateKey(credentials, bastionConfigMap, hopSettings)
+		if err != nil {
+			return nil, err
 		}
-		environmentRaw := settings[KeySecretsProviderCommandEnvironment].(map[string]interface{})
-		environment := make(map[string]string, len(environmentRaw))
-		for k, value := range environmentRaw {
-			environment[k] = value.(string)
+		err = p.sshCertificate(credentials, bastionConfigMap, hopSettings, settings)
+		if err != nil {
+			return nil, err
+		}
+		hopHost, _ := hopSettings[KeySshHost].(string)
+		err = p.sshPassword(credentials, bastionConfigMap, hopHost, hopSettings, settings)
+		if err != nil {
+			return nil, err
 		}
 
-		provider = NewSecretsProviderCommand(
-			name,
-			arguments,
-			environment,
-		)
-	case string(SecretsProviderNameGopass):
-		settings := p.settings(resource, KeySecrets, KeySecretsProviderGopass)
-		store, _ := settings[KeySecretsProviderGopassStore].(string)
-		provider = NewSecretsProviderGopass(store)
-	default:
-		return nil, errors.Errorf(
-			"unsupported secrets provider %q, supported providers are: %v",
-			providerName, SecretsProviders,
-		)
+		if hostKey, _ := hopSettings[KeyHostKey].(string); hostKey != "" {
+			err = p.sshHostKeyPin(bastionConfigMap, SshHostKeyAliasBastion(n), hostKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		configs.Bastions[n] = bastionConfigMap
 	}
 
-	//
-
-	schemaSecretsSet := p.SecretsSet(resource)
-	definedSecrets := make([]*SecretDescription, len(schemaSecretsSet))
-
-	n := 0
-	for _, schemaSecret := range schemaSecretsSet {
-		if schemaSecret[KeySecretSource] == nil && schemaSecret[KeySecretDestination] == nil {
-			// FIXME: in case no secrets providen set will contain
-			// single item with defaults values
-			// probably this is because of my wrapper around schema sets
-			continue
+	if source, _ := settings[KeySshPasswordSource].(string); source != "" {
+		var address string
+		if resource.Get(KeyAddress) != nil {
+			ip, err := p.ResourceAddress(ctx, resource)
+			if err != nil {
+				return nil, err
+			}
+			address = ip.String()
 		}
-
-		definedSecrets[n] = &SecretDescription{
-			Source:      schemaSecret[KeySecretSource].(string),
-			Destination: schemaSecret[KeySecretDestination].(string),
-			Owner:       schemaSecret[KeySecretOwner].(string),
-			Group:       schemaSecret[KeySecretGroup].(string),
-			Permissions: schemaSecret[KeySecretPermissions].(int),
+		err = p.sshPassword(credentials, configMap, address, settings)
+		if err != nil {
+			return nil, err
 		}
-		n++
 	}
-	return NewSecrets(provider, definedSecrets[:n]), nil
-}
 
-//
-
-func (p *Provider) Build(ctx context.Context, resource ResourceBox) (Derivations, error) {
-	nix := p.NewNix(ctx, resource)
-	defer nix.Close()
+	if hostKey := p.HostKey(resource); hostKey != "" {
+		err = p.sshHostKeyPin(configMap, SshHostKeyAliasTarget, hostKey)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	system := resource.Get(KeySystem).(string)
+	if credentials.askpass {
+		configs.Environment, err = p.sshAskpass.Environment()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	nixSettings := p.NixSettings(resource)
-	buildWrapperPath, _ := nixSettings[KeyNixBuildWrapper].(string)
-	buildWrapper, err := NewNixWrapperFile(buildWrapperPath)
+	configs.Become, err = p.become(credentials)
 	if err != nil {
 		return nil, err
 	}
-	defer buildWrapper.Close()
 
-	configuration := resource.Get(KeyConfiguration).(string)
-	configurationAbs, err := filepath.Abs(configuration)
-	if err != nil {
-		return nil, errors.Wrapf(
-			err, "failed to determine absolute path for configuration %q",
-			configuration,
-		)
+	return configs, nil
+}
+
+// become returns privileges escalation for remote commands (nil if it is not configured).
+func (p *Provider) become(credentials *sshCredentials) (*Become, error) {
+	var (
+		settings  = p.BecomeSettings(credentials.resource)
+		method, _ = settings[KeyBecomeMethod].(string)
+		source, _ = settings[KeyBecomePasswordSource].(string)
+		password  *LockedBuffer
+	)
+	if method != BecomeMethodNone && source != "" {
+		provider, err := credentials.secretsProvider(p)
+		if err != nil {
+			return nil, err
+		}
+		password, err = p.secretBuffer(provider, source)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get become password")
+		}
 	}
-	configurationSettings := resource.Get(KeySettings).(string)
+	return NewBecome(method, password)
+}
 
-	command := nix.Build(
-		NixBuildCommandOptionFile(buildWrapper),
-		NixBuildCommandOptionArgStr("system", system),
-		NixBuildCommandOptionArgStr("settings", configurationSettings),
-		NixBuildCommandOptionArgStr("configuration", configurationAbs),
-		NixBuildCommandOptionJSON(),
-		NixBuildCommandOptionNoLink(),
-		NixBuildCommandOptionMemoize(configurationAbs),
+// secretBuffer returns secret from the secrets provider,
+// secret is retrieved once and kept in locked memory until provider is closed.
+func (p *Provider) secretBuffer(provider SecretsProvider, source string) (*LockedBuffer, error) {
+	p.secretBuffersLock.Lock()
+	defer p.secretBuffersLock.Unlock()
+
+	id := provider.Name() + ":" + source
+	buffer := p.secretBuffers[id]
+	if buffer == nil {
+		buf, err := provider.Get(source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get %q from %q secrets provider", source, provider.Name())
+		}
+		buffer = NewLockedBuffer(buf)
+		p.secretBuffers[id] = buffer
+	}
+	return buffer, nil
+}
+
+// newSsh chains bastion hops with nested proxy commands,
+// each hop is connected through the previous one.
+func (p *Provider) newSsh(configs *sshConfigs) *Ssh {
+	var (
+		options      []SshOption
+		finalizers   []func()
+		proxyCommand string
 	)
-	defer command.Close()
 
-	select {
-	case <-ctx.Done():
-		return nil, nil
-	default:
+	for _, bastionConfigMap := range configs.Bastions {
+		bastionConfigMap = bastionConfigMap.Copy()
+		if proxyCommand != "" {
+			bastionConfigMap.Set(SshConfigKeyProxyCommand, proxyCommand)
+		}
+		bastionHost, _ := bastionConfigMap.Get(SshConfigKeyHost)
+		bastion := NewSsh(
+			SshOptionConfigMap(bastionConfigMap),
+			SshOptionNonInteractive(),
+			SshOptionIORedirection("%h", "%p"),
+			SshOptionHost(bastionHost),
+		)
+		command, arguments, _ := bastion.Command()
+		proxyCommand = SshProxyCommand(command, arguments...)
+		finalizers = append(finalizers, bastion.Finalizers...)
 	}
 
-	derivations := Derivations{}
-	err = command.Execute(&derivations)
-	if err != nil {
-		return nil, err
+	configMap := configs.Target.Copy()
+	if proxyCommand != "" {
+		configMap.Set(SshConfigKeyProxyCommand, proxyCommand)
 	}
-	if len(derivations) == 0 {
-		return nil, errors.Errorf(
-			"no derivations was build for %q configuration",
-			configuration,
+
+	if configMap.Len() > 0 {
+		options = append(
+			options,
+			SshOptionConfigMap(configMap),
 		)
 	}
-	if len(derivations) > 1 {
-		return nil, errors.Errorf(
-			"multiple derivations was build for %q configuration (expecting single derivation)",
-			configuration,
-		)
+	// NOTE: hops configuration files live as long as the target ssh
+	options = append(options, SshOptionFinalizers(finalizers...))
+	// NOTE: proxy commands inherit environment of the target ssh
+	if len(configs.Environment) > 0 {
+		options = append(options, SshOptionEnv(configs.Environment))
 	}
+	options = append(options, SshOptionBecome(configs.Become))
 
-	return derivations, nil
+	return NewSsh(options...)
 }
 
-func (p *Provider) CopySecrets(ctx context.Context, resource ResourceBox, secrets *Secrets) error {
-	address, err := p.Address(resource.Get(KeyAddress))
+// sshPrivateKey adds private key from the secrets provider into the in-process agent
+// and makes ssh use this agent.
+func (p *Provider) sshPrivateKey(credentials *sshCredentials, configMap *SshConfigMap, settings map[string]interface{}) error {
+	source, _ := settings[KeySshPrivateKeySource].(string)
+	if source == "" {
+		return nil
+	}
+	provider, err := credentials.secretsProvider(p)
 	if err != nil {
 		return err
 	}
-	ssh := p.NewSsh(resource).With(SshOptionHost(address.String()))
-	defer ssh.Close()
-
-	secretsCopy, err := secrets.Copy(ssh)
+	err = p.initSshAgent()
 	if err != nil {
 		return err
 	}
-	defer secretsCopy.Close()
 
-	err = secretsCopy.Execute(nil)
+	err = p.sshAgent.AddSource(provider, source)
 	if err != nil {
 		return err
 	}
-
+	configMap.Set(SshConfigKeyIdentityAgent, p.sshAgent.Path)
 	return nil
 }
 
-func (p *Provider) Push(ctx context.Context, resource ResourceBox, drvs Derivations) error {
-	nix := p.NewNix(ctx, resource)
-	defer nix.Close()
-
-	address, err := p.Address(resource.Get(KeyAddress))
-	if err != nil {
-		return err
+// sshCertificate signs user certificate for the ephemeral key with certificate authority key
+// from the secrets provider and adds it to the agent (first settings with certificate authority wins).
+// Certificate principals default to the ssh user.
+func (p *Provider) sshCertificate(credentials *sshCredentials, configMap *SshConfigMap, settings ...map[string]interface{}) error {
+	var authority map[string]interface{}
+	for _, s := range settings {
+		authority = settingsBlock(s[KeySshCertificateAuthority])
+		if authority != nil {
+			break
+		}
+	}
+	if authority == nil {
+		return nil
+	}
+
+	var (
+		source, _      = authority[KeySshCertificateAuthorityKeySource].(string)
+		principalsRaw  = authority[KeySshCertificateAuthorityPrincipals]
+		validitySec, _ = authority[KeySshCertificateAuthorityValidity].(int)
+		principals     = []string{}
+	)
+	if raw, ok := principalsRaw.([]interface{}); ok {
+		for _, principal := range raw {
+			principals = append(principals, principal.(string))
+		}
+	}
+	if len(principals) == 0 {
+		user, _ := configMap.Get(SshConfigKeyUser)
+		principals = append(principals, user)
+	}
+
+	provider, err := credentials.secretsProvider(p)
+	if err != nil {
+		return err
+	}
+	err = p.initSshAgent()
+	if err != nil {
+		return err
+	}
+	configMap.Set(SshConfigKeyIdentityAgent, p.sshAgent.Path)
+
+	// NOTE: certificate is reused while it is valid for more than a half of validity,
+	// so agent does not offer too many keys to the server (MaxAuthTries)
+	var (
+		validity = time.Duration(validitySec) * time.Second
+		id       = provider.Name() + ":" + source + ":" + strings.Join(principals, ",")
+	)
+	p.sshDirLock.Lock()
+	defer p.sshDirLock.Unlock()
+	if expires, ok := p.sshCertificates[id]; ok && time.Until(expires) > validity/2 {
+		return nil
+	}
+
+	buffer, err := p.secretBuffer(provider, source)
+	if err != nil {
+		return errors.Wrap(err, "failed to get ssh certificate authority key")
+	}
+	key, certificate, err := SshSignCertificate(buffer.Bytes(), principals, validity)
+	if err != nil {
+		return errors.Wrapf(err, "failed to sign ssh certificate with authority key %q", source)
+	}
+	err = p.sshAgent.Add(agent.AddedKey{
+		PrivateKey:   key,
+		Certificate:  certificate,
+		Comment:      certificate.KeyId,
+		LifetimeSecs: uint32(validitySec),
+	})
+	if err != nil {
+		return err
+	}
+	p.sshCertificates[id] = time.Now().Add(validity)
+	return nil
+}
+
+// initSshAgent lazily starts in-process ssh agent.
+func (p *Provider) initSshAgent() error {
+	p.sshDirLock.Lock()
+	defer p.sshDirLock.Unlock()
+	if p.sshAgent != nil {
+		return nil
+	}
+	dir, err := p.sshDirectory()
+	if err != nil {
+		return err
+	}
+	p.sshAgent, err = NewSshAgent(filepath.Join(dir, "agent"))
+	if err != nil {
+		return err
+	}
+	p.sshCertificates = map[string]time.Time{}
+	return nil
+}
+
+// sshPassword registers password from the secrets provider for user@host
+// in the askpass server (first settings with password source wins).
+func (p *Provider) sshPassword(credentials *sshCredentials, configMap *SshConfigMap, host string, settings ...map[string]interface{}) error {
+	var source string
+	for _, s := range settings {
+		source, _ = s[KeySshPasswordSource].(string)
+		if source != "" {
+			break
+		}
+	}
+	if source == "" || host == "" {
+		return nil
+	}
+	provider, err := credentials.secretsProvider(p)
+	if err != nil {
+		return err
+	}
+
+	p.sshDirLock.Lock()
+	if p.sshAskpass == nil {
+		var dir string
+		dir, err = p.sshDirectory()
+		if err == nil {
+			p.sshAskpass, err = NewSshAskpass(filepath.Join(dir, "askpass"))
+		}
+	}
+	p.sshDirLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	user, ok := configMap.Get(SshConfigKeyUser)
+	if !ok {
+		user = DefaultUser
+	}
+	err = p.sshAskpass.AddSource(provider, source, user, host)
+	if err != nil {
+		return err
+	}
+	configMap.Set(SshConfigKeyPasswordAuthentication, "yes")
+	credentials.askpass = true
+	return nil
+}
+
+// HostKey returns host key of the resource target which should be pinned,
+// this is either key set by the user or key observed on first use.
+func (p *Provider) HostKey(resource ResourceBox) string {
+	if hostKey, _ := resource.Get(KeyHostKey).(string); hostKey != "" {
+		return hostKey
+	}
+	if tofu, _ := resource.Get(KeyHostKeyTofu).(bool); tofu {
+		observed, _ := resource.Get(KeyHostKeyObserved).(string)
+		return observed
+	}
+	return ""
+}
+
+// ObserveHostKey connects to the resource target accepting any host key
+// (of the same type as pinned key, ed25519 if it is not pinned) and returns it,
+// it is used to implement trust on first use and to record key the server presented.
+// NOTE: authentication failure is not an error here, key is received before authentication
+func (p *Provider) ObserveHostKey(ctx context.Context, resource ResourceBox) (string, error) {
+	address, err := p.ResourceAddress(ctx, resource)
+	if err != nil {
+		return "", err
+	}
+	knownHosts, err := CreateTemp("known_hosts.*")
+	if err != nil {
+		return "", err
+	}
+	defer knownHosts.Close()
+
+	configs, err := p.sshConfigs(ctx, resource)
+	if err != nil {
+		return "", err
+	}
+	SshConfigHostKeyObserve(configs.Target, SshHostKeyAliasTarget, SshHostKeyAlgorithms(p.HostKey(resource)), knownHosts.Name())
+	// NOTE: observing connection should not become a master for pinned connections
+	configs.Target.Set(SshConfigKeyControlMaster, "no")
+	configs.Target.Set(SshConfigKeyControlPath, "none")
+
+	var connectErr error
+	transport, _ := p.SshSettings(resource)[KeySshTransport].(string)
+	switch transport {
+	case SshTransportNative:
+		var client *SshClient
+		client, connectErr = p.dialSsh(ctx, address.String(), configs)
+		if connectErr == nil {
+			connectErr = client.Run("true", nil, io.Discard, io.Discard)
+			client.Close()
+		}
+	default:
+		ssh := p.newSsh(configs).With(SshOptionHost(address.String()))
+		defer ssh.Close()
+		probe := NewRemoteCommand(ssh, CommandFromString("true"))
+		defer probe.Close()
+		connectErr = probe.Execute(nil)
+	}
+
+	buf, err := os.ReadFile(knownHosts.Name())
+	if err != nil {
+		return "", err
+	}
+	if len(bytes.TrimSpace(buf)) == 0 && connectErr != nil {
+		return "", connectErr
+	}
+	hostKey, err := SshKnownHostsKey(buf)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to observe host key of %q", address.String())
+	}
+	return hostKey, nil
+}
+
+// sshHostKeyPin writes known hosts file with the host key into provider ssh directory
+// and makes ssh configuration use it, file name is stable so native connections could be pooled.
+func (p *Provider) sshHostKeyPin(configMap *SshConfigMap, alias string, hostKey string) error {
+	line, err := SshKnownHostsLine(alias, hostKey)
+	if err != nil {
+		return err
+	}
+	hash := sha1.Sum([]byte(line))
+
+	p.sshDirLock.Lock()
+	defer p.sshDirLock.Unlock()
+	dir, err := p.sshDirectory()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "known_hosts."+hex.EncodeToString(hash[:]))
+	if !sshExists(path) {
+		err = os.WriteFile(path, []byte(line), 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	SshConfigHostKeyPin(configMap, alias, path)
+	return nil
+}
+
+// sshMultiplex makes ssh share master connection between invocations,
+// values set by the user in ssh configuration map take precedence.
+func (p *Provider) sshMultiplex(configMap *SshConfigMap) error {
+	p.sshDirLock.Lock()
+	dir, err := p.sshDirectory()
+	p.sshDirLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	control := map[string]string{
+		SshConfigKeyControlMaster:  "auto",
+		SshConfigKeyControlPath:    filepath.Join(dir, "%C"),
+		SshConfigKeyControlPersist: SshControlPersist,
+	}
+	for _, key := range []string{
+		SshConfigKeyControlMaster,
+		SshConfigKeyControlPath,
+		SshConfigKeyControlPersist,
+	} {
+		if _, ok := configMap.Get(key); !ok {
+			configMap.Set(key, control[key])
+		}
+	}
+	return nil
+}
+
+// closeSsh stops agent & askpass servers, asks master connections
+// started by ssh multiplexing to exit and removes provider ssh directory.
+func (p *Provider) closeSsh() error {
+	p.sshDirLock.Lock()
+	defer p.sshDirLock.Unlock()
+
+	if p.sshAgent != nil {
+		p.sshAgent.Close()
+		p.sshAgent = nil
+		p.sshCertificates = nil
+	}
+	if p.sshAskpass != nil {
+		p.sshAskpass.Close()
+		p.sshAskpass = nil
+	}
+	if p.sshDir == nil {
+		return nil
+	}
+
+	entries, err := os.ReadDir(p.sshDir.Name())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSocket == 0 {
+			continue
+		}
+		ssh := NewSsh(
+			SshOptionControl(filepath.Join(p.sshDir.Name(), entry.Name()), "exit"),
+			// NOTE: host is required by ssh, but with literal control path it is not used
+			SshOptionHost("localhost"),
+		)
+		// NOTE: master may already be gone (ControlPersist), so errors are ignored
+		_ = ssh.Execute(nil)
+	}
+	err = p.sshDir.Close()
+	p.sshDir = nil
+	return err
+}
+
+// NewSshHost returns ssh connected to the address, with native transport
+// connection is established (or reused from the pool) right away.
+func (p *Provider) NewSshHost(ctx context.Context, resource ResourceBox, address string) (*Ssh, error) {
+	configs, err := p.sshConfigs(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	ssh := p.newSsh(configs).With(SshOptionHost(address))
+
+	transport, _ := p.SshSettings(resource)[KeySshTransport].(string)
+	switch transport {
+	case SshTransportOpenSSH, "":
+		return ssh, nil
+	case SshTransportNative:
+		client, err := p.sshClient(ctx, address, configs)
+		if err != nil {
+			ssh.Close()
+			return nil, err
+		}
+		return ssh.With(SshOptionClient(client)), nil
+	default:
+		ssh.Close()
+		return nil, errors.Errorf(
+			"unsupported ssh transport %q, supported transports are: %v",
+			transport, SshTransports,
+		)
+	}
+}
+
+// sshClient returns native connection to the address from the pool
+// or dials a new one (through bastions if they are configured).
+func (p *Provider) sshClient(ctx context.Context, address string, configs *sshConfigs) (*SshClient, error) {
+	key := address + "\n" + SshSerializeConfig(configs.Target)
+	for _, bastionConfigMap := range configs.Bastions {
+		key += SshSerializeConfig(bastionConfigMap)
+	}
+
+	// NOTE: pool lock is held only to access maps, so slow or dead host
+	// does not block connections to other hosts
+	p.sshClientsLock.Lock()
+	lock, ok := p.sshClientLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.sshClientLocks[key] = lock
+	}
+	p.sshClientsLock.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	p.sshClientsLock.Lock()
+	client, ok := p.sshClients[key]
+	p.sshClientsLock.Unlock()
+	if ok {
+		if client.Alive() {
+			return client, nil
+		}
+		client.Close()
+		p.sshClientsLock.Lock()
+		delete(p.sshClients, key)
+		p.sshClientsLock.Unlock()
+	}
+
+	client, err := p.dialSsh(ctx, address, configs)
+	if err != nil {
+		return nil, err
+	}
+	p.sshClientsLock.Lock()
+	p.sshClients[key] = client
+	p.sshClientsLock.Unlock()
+
+	return client, nil
+}
+
+func (p *Provider) dialSsh(ctx context.Context, address string, configs *sshConfigs) (*SshClient, error) {
+	clientConfig := func(configMap *SshConfigMap) (*SshClientConfig, error) {
+		config, err := NewSshClientConfig(configMap)
+		if err != nil {
+			return nil, err
+		}
+		if p.sshAskpass != nil && config.PasswordAuthentication {
+			config.PasswordCallback = func(user string, host string) (string, error) {
+				password := bytes.NewBuffer(nil)
+				_, err := p.sshAskpass.Password(user, host, password)
+				return password.String(), err
+			}
+		}
+		return config, nil
+	}
+
+	jumps := make([]*SshClientConfig, len(configs.Bastions))
+	for n, bastionConfigMap := range configs.Bastions {
+		bastion, err := clientConfig(bastionConfigMap)
+		if err != nil {
+			return nil, err
+		}
+		jumps[n] = bastion
+	}
+
+	configMap := configs.Target.Copy()
+	configMap.Set(SshConfigKeyHost, address)
+	target, err := clientConfig(configMap)
+	if err != nil {
+		return nil, err
+	}
+	if configs.TunnelPort > 0 {
+		target.TunnelPort = configs.TunnelPort
+	}
+
+	tflog.Info(ctx, "connecting to "+target.Address())
+	return DialSsh(ctx, target, jumps...)
+}
+
+// nixCopyTarget returns target which should be used to copy paths to the address.
+// Native ssh client is exposed to nix through the local tunnel.
+// When ssh user is not root paths are copied with escalated nix-store or as a trusted user.
+func (p *Provider) nixCopyTarget(nix *Nix, ssh *Ssh, address string) (*NixCopyTarget, error) {
+	target := &NixCopyTarget{
+		Nix:        nix,
+		Host:       address,
+		Parameters: url.Values{},
+	}
+	if ssh.Client != nil {
+		tunnel, err := ssh.Client.Tunnel()
+		if err != nil {
+			return nil, err
+		}
+		host, port, err := net.SplitHostPort(tunnel)
+		if err != nil {
+			return nil, err
+		}
+		alias := ssh.Client.Config.HostKeyAlias
+		if alias == "" {
+			alias = address
+		}
+		if p.sshAskpass != nil {
+			// NOTE: askpass prompt will contain tunnel host instead of the address
+			p.sshAskpass.Alias(ssh.Client.Config.User, address, host)
+		}
+		target.Nix = nix.With(NixOptionSshOpts(
+			"-p", port,
+			"-o", "ProxyCommand=none",
+			"-o", "HostKeyAlias="+alias,
+		))
+		target.Host = host
+	} else if strings.Contains(address, "%") {
+		// NOTE: nix store uri could not contain ipv6 zone, so address is passed with HostName
+		// (percent sign is escaped because HostName supports tokens)
+		target.Nix = nix.With(NixOptionSshOpts("-o", "HostName="+strings.ReplaceAll(address, "%", "%%")))
+		target.Host = SshHostKeyAliasTarget
+	}
+
+	if ssh.Become != nil {
+		program, ok := ssh.Become.RemoteProgram("nix-store")
+		if ok {
+			target.Parameters.Set("remote-program", program)
+			return target, nil
+		}
+	}
+
+	if ssh.Client != nil && ssh.Client.Config.User == "root" {
+		return target, nil
+	}
+	trusted, err := nixTrustedUser(ssh, address)
+	if err != nil {
+		return nil, err
+	}
+	if trusted.User != "root" {
+		if !trusted.Trusted() {
+			return nil, errors.Errorf(
+				"ssh user %q is not in nix trusted-users (%s) on %q, add it to nix.settings.trusted-users or configure become method which does not require password",
+				trusted.User, strings.Join(trusted.TrustedUsers, " "), address,
+			)
+		}
+		// NOTE: paths built locally are not signed, trusted users are allowed to import them
+		target.NoCheckSigs = true
+	}
+	return target, nil
+}
+
+// nixTrustedUser retrieves ssh user, its groups and nix trusted-users from the remote host.
+// It runs without privileges escalation because nix daemon checks the ssh user.
+func nixTrustedUser(ssh *Ssh, address string) (*NixTrustedUser, error) {
+	var buf []byte
+	cmd := NewRemoteCommand(
+		ssh.With(SshOptionBecome(nil)),
+		CommandFromString("sh", "-c", ShellQuote(NixTrustedUserScript)),
+	)
+	defer cmd.Close()
+
+	err := cmd.Execute(&buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to retrieve nix trusted-users from %q", address)
+	}
+	return NixParseTrustedUser(string(buf))
+}
+
+func (p *Provider) NewSecretsProvider(resource ResourceBox) (SecretsProvider, error) {
+	schemaSecrets := p.SecretsSettings(resource)
+	providerName := schemaSecrets[KeySecretsProvider].(string)
+
+	return p.newSecretsProvider(resource, providerName)
+}
+
+func (p *Provider) newSecretsProvider(resource ResourceBox, providerName string) (SecretsProvider, error) {
+	var provider SecretsProvider
+	switch strings.ToLower(providerName) {
+	case string(SecretsProviderNameFilesystem):
+		// NOTE: this does nothing now, but we may have filesystem options in future
+		_ = p.settings(resource, KeySecrets, KeySecretsProviderFilesystem)
+		provider = NewSecretsProviderFilesystem()
+	case string(SecretsProviderNameCommand):
+		settings := p.settings(resource, KeySecrets, KeySecretsProviderCommand)
+
+		name := settings[KeySecretsProviderCommandName].(string)
+		argumentsRaw := settings[KeySecretsProviderCommandArguments].([]interface{})
+		arguments := make([]string, len(argumentsRaw))
+		for n, argument := range argumentsRaw {
+			arguments[n] = argument.(string)
+		}
+		environmentRaw := settings[KeySecretsProviderCommandEnvironment].(map[string]interface{})
+		environment := make(map[string]string, len(environmentRaw))
+		for k, value := range environmentRaw {
+			environment[k] = value.(string)
+		}
+
+		provider = NewSecretsProviderCommand(
+			name,
+			arguments,
+			environment,
+		)
+	case string(SecretsProviderNameGopass):
+		settings := p.settings(resource, KeySecrets, KeySecretsProviderGopass)
+		store, _ := settings[KeySecretsProviderGopassStore].(string)
+		provider = NewSecretsProviderGopass(store)
+	case string(SecretsProviderNameAge):
+		settings := p.settings(resource, KeySecrets, KeySecretsProviderAge)
+		age, err := p.newSecretsProviderAge(resource, settings)
+		if err != nil {
+			return nil, err
+		}
+		provider = age
+	case string(SecretsProviderNameSops):
+		settings := p.settings(resource, KeySecrets, KeySecretsProviderSops)
+		age, err := p.newSecretsProviderAge(resource, settings)
+		if err != nil {
+			return nil, err
+		}
+		pgpKeyringsRaw, _ := settings[KeySecretsProviderSopsPgpKeyring].([]interface{})
+		pgpKeyrings := make([]string, len(pgpKeyringsRaw))
+		for n, pgpKeyring := range pgpKeyringsRaw {
+			pgpKeyrings[n] = pgpKeyring.(string)
+		}
+		provider = NewSecretsProviderSops(age, pgpKeyrings)
+	case string(SecretsProviderNameVault):
+		settings := p.settings(resource, KeySecrets, KeySecretsProviderVault)
+		client, err := p.vaultClient(settings)
+		if err != nil {
+			return nil, err
+		}
+		provider = NewSecretsProviderVault(client)
+	default:
+		return nil, errors.Errorf(
+			"unsupported secrets provider %q, supported providers are: %v",
+			providerName, SecretsProviders,
+		)
+	}
+
+	return provider, nil
+}
+
+// vaultClient returns vault client for the settings from the pool,
+// client is shared between resources, so token is renewed during long applies.
+func (p *Provider) vaultClient(settings map[string]interface{}) (*VaultClient, error) {
+	config := &VaultConfig{}
+	config.Address, _ = settings[KeySecretsProviderVaultAddress].(string)
+	config.Namespace, _ = settings[KeySecretsProviderVaultNamespace].(string)
+	config.Token, _ = settings[KeySecretsProviderVaultToken].(string)
+	config.TokenFile, _ = settings[KeySecretsProviderVaultTokenFile].(string)
+	config.KvVersion, _ = settings[KeySecretsProviderVaultKvVersion].(int)
+	config.TLS.CACert, _ = settings[KeySecretsProviderVaultCACert].(string)
+	config.TLS.ClientCert, _ = settings[KeySecretsProviderVaultClientCert].(string)
+	config.TLS.ClientKey, _ = settings[KeySecretsProviderVaultClientKey].(string)
+	config.TLS.ServerName, _ = settings[KeySecretsProviderVaultTLSServerName].(string)
+	config.TLS.SkipVerify, _ = settings[KeySecretsProviderVaultSkipVerify].(bool)
+	if appRole := settingsBlock(settings[KeySecretsProviderVaultAppRole]); appRole != nil {
+		config.AppRole = &VaultAppRole{}
+		config.AppRole.Mount, _ = appRole[KeySecretsProviderVaultAppRoleMount].(string)
+		config.AppRole.RoleId, _ = appRole[KeySecretsProviderVaultAppRoleRoleId].(string)
+		config.AppRole.SecretId, _ = appRole[KeySecretsProviderVaultAppRoleSecretId].(string)
+		config.AppRole.SecretIdFile, _ = appRole[KeySecretsProviderVaultAppRoleSecretIdFile].(string)
+	}
+	if config.KvVersion != 0 && config.KvVersion != 1 && config.KvVersion != 2 {
+		return nil, errors.Errorf("unsupported vault kv version %d, supported versions are: 1, 2", config.KvVersion)
+	}
+
+	key := config.PoolKey()
+
+	p.vaultClientsLock.Lock()
+	defer p.vaultClientsLock.Unlock()
+
+	client, ok := p.vaultClients[key]
+	if !ok {
+		var err error
+		client, err = NewVaultClient(config)
+		if err != nil {
+			return nil, err
+		}
+		p.vaultClients[key] = client
+	}
+	return client, nil
+}
+
+// newSecretsProviderAge creates age provider from identity settings (shared by age & sops providers).
+func (p *Provider) newSecretsProviderAge(resource ResourceBox, settings map[string]interface{}) (*SecretsProviderAge, error) {
+	identityFilesRaw, _ := settings[KeySecretsProviderAgeIdentityFile].([]interface{})
+	identityFiles := make([]string, len(identityFilesRaw))
+	for n, identityFile := range identityFilesRaw {
+		identityFiles[n] = identityFile.(string)
+	}
+
+	var (
+		identityProviderName, _ = settings[KeySecretsProviderAgeIdentityProvider].(string)
+		identitySource, _       = settings[KeySecretsProviderAgeIdentitySource].(string)
+		identityProvider        SecretsProvider
+	)
+	switch strings.ToLower(identityProviderName) {
+	case "":
+	case string(SecretsProviderNameAge), string(SecretsProviderNameSops):
+		return nil, errors.Errorf("age identity could not be retrieved from %q secrets provider", identityProviderName)
+	default:
+		var err error
+		identityProvider, err = p.newSecretsProvider(resource, identityProviderName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewSecretsProviderAge(identityFiles, identityProvider, identitySource), nil
+}
+
+// rawConfigKnown reports whether value of the key in raw configuration is wholly known.
+func rawConfigKnown(config cty.Value, key string) bool {
+	if !config.IsKnown() {
+		return false
+	}
+	if config.IsNull() || !config.Type().IsObjectType() || !config.Type().HasAttribute(key) {
+		return true
+	}
+	return config.GetAttr(key).IsWhollyKnown()
+}
+
+// secretsContentDefined returns destinations of secrets with content defined in the configuration,
+// empty content could not be distinguished from content which is not set by the set element value.
+func secretsContentDefined(resource ResourceBox) map[string]bool {
+	raw, ok := resource.(interface{ GetRawConfig() cty.Value })
+	if !ok {
+		return nil
+	}
+	config := raw.GetRawConfig()
+	if config.IsNull() || !config.IsKnown() || !config.Type().IsObjectType() || !config.Type().HasAttribute(KeySecret) {
+		return nil
+	}
+	secrets := config.GetAttr(KeySecret)
+	if secrets.IsNull() || !secrets.IsKnown() || !secrets.CanIterateElements() {
+		return nil
+	}
+
+	defined := map[string]bool{}
+	for it := secrets.ElementIterator(); it.Next(); {
+		_, secret := it.Element()
+		if secret.IsNull() || !secret.IsKnown() {
+			continue
+		}
+		destination, content := secret.GetAttr(KeySecretDestination), secret.GetAttr(KeySecretContent)
+		if destination.IsNull() || !destination.IsKnown() || content.IsNull() {
+			continue
+		}
+		defined[destination.AsString()] = true
+	}
+	return defined
+}
+
+func (p *Provider) NewSecrets(resource ResourceBox) (*Secrets, error) {
+	provider, err := p.NewSecretsProvider(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	schemaSecretsSet := p.SecretsSet(resource)
+	definedSecrets := make([]*SecretDescription, len(schemaSecretsSet))
+	definedContent := secretsContentDefined(resource)
+
+	n := 0
+	for _, schemaSecret := range schemaSecretsSet {
+		if schemaSecret[KeySecretSource] == nil && schemaSecret[KeySecretDestination] == nil {
+			// FIXME: in case no secrets providen set will contain
+			// single item with defaults values
+			// probably this is because of my wrapper around schema sets
+			continue
+		}
+
+		var (
+			source, _        = schemaSecret[KeySecretSource].(string)
+			content, _       = schemaSecret[KeySecretContent].(string)
+			contentBase64, _ = schemaSecret[KeySecretContentBase64].(string)
+			template, _      = schemaSecret[KeySecretTemplate].(string)
+			valuesRaw, _     = schemaSecret[KeySecretValues].(map[string]interface{})
+			destination, _   = schemaSecret[KeySecretDestination].(string)
+			contentBytes     []byte
+			defined          = 0
+		)
+		for _, value := range []string{source, content, contentBase64, template} {
+			if value != "" {
+				defined++
+			}
+		}
+		if content == "" && definedContent[destination] {
+			defined++
+		}
+		if defined != 1 {
+			return nil, errors.Errorf(
+				"secret with destination %q should have exactly one of %q, %q, %q or %q defined",
+				destination, KeySecretSource, KeySecretContent, KeySecretContentBase64, KeySecretTemplate,
+			)
+		}
+		if len(valuesRaw) > 0 && template == "" {
+			return nil, errors.Errorf(
+				"secret with destination %q has %q defined without %q",
+				destination, KeySecretValues, KeySecretTemplate,
+			)
+		}
+		values := make(map[string]string, len(valuesRaw))
+		for name, value := range valuesRaw {
+			values[name] = value.(string)
+		}
+		filesRaw, _ := schemaSecret[KeySecretFile].([]interface{})
+		files := make([]*SecretFileRule, 0, len(filesRaw))
+		for _, fileRaw := range filesRaw {
+			file, _ := fileRaw.(map[string]interface{})
+			if file == nil {
+				continue
+			}
+			rule := &SecretFileRule{}
+			rule.Pattern, _ = file[KeySecretFilePattern].(string)
+			rule.Owner, _ = file[KeySecretOwner].(string)
+			rule.Group, _ = file[KeySecretGroup].(string)
+			rule.Permissions, _ = file[KeySecretPermissions].(int)
+			if _, err := path.Match(rule.Pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid file pattern %q of secret with destination %q", rule.Pattern, destination)
+			}
+			files = append(files, rule)
+		}
+		var onChange *SecretHook
+		onChangeRaw, _ := schemaSecret[KeySecretOnChange].([]interface{})
+		if len(onChangeRaw) > 0 {
+			hook, _ := onChangeRaw[0].(map[string]interface{})
+			onChange = &SecretHook{}
+			restartUnitsRaw, _ := hook[KeySecretOnChangeRestartUnits].([]interface{})
+			for _, unit := range restartUnitsRaw {
+				onChange.RestartUnits = append(onChange.RestartUnits, unit.(string))
+			}
+			reloadUnitsRaw, _ := hook[KeySecretOnChangeReloadUnits].([]interface{})
+			for _, unit := range reloadUnitsRaw {
+				onChange.ReloadUnits = append(onChange.ReloadUnits, unit.(string))
+			}
+			onChange.Command, _ = hook[KeySecretOnChangeCommand].(string)
+		}
+		switch {
+		case content != "" || definedContent[destination]:
+			contentBytes = []byte(content)
+		case contentBase64 != "":
+			var err error
+			contentBytes, err = base64.StdEncoding.DecodeString(contentBase64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to decode %q of secret with destination %q", KeySecretContentBase64, destination)
+			}
+		}
+
+		definedSecrets[n] = &SecretDescription{
+			Source:      source,
+			Content:     contentBytes,
+			Template:    template,
+			Values:      values,
+			Files:       files,
+			Destination: destination,
+			Owner:       schemaSecret[KeySecretOwner].(string),
+			Group:       schemaSecret[KeySecretGroup].(string),
+			Permissions: schemaSecret[KeySecretPermissions].(int),
+
+			DirectoryOwner:       schemaSecret[KeySecretDirectoryOwner].(string),
+			DirectoryGroup:       schemaSecret[KeySecretDirectoryGroup].(string),
+			DirectoryPermissions: schemaSecret[KeySecretDirectoryPermissions].(int),
+
+			OnChange: onChange,
+		}
+		n++
+	}
+
+	tmpfsRaw, _ := p.SecretsSettings(resource)[KeySecretsTmpfs].([]interface{})
+	tmpfs := make([]string, 0, len(tmpfsRaw))
+	for _, rootRaw := range tmpfsRaw {
+		root, _ := rootRaw.(string)
+		if !path.IsAbs(root) || path.Clean(root) == "/" {
+			return nil, errors.Errorf("secrets %q root %q should be an absolute path to the directory", KeySecretsTmpfs, root)
+		}
+		tmpfs = append(tmpfs, path.Clean(root))
+	}
+
+	secrets := NewSecrets(provider, definedSecrets[:n])
+	secrets.Tmpfs = tmpfs
+	secrets.ProviderByName = func(name string) (SecretsProvider, error) {
+		return p.newSecretsProvider(resource, name)
+	}
+	return secrets, nil
+}
+
+//
+
+func (p *Provider) configurationArguments(resource ResourceBox) (map[string]string, error) {
+	configuration := resource.Get(KeyConfiguration).(string)
+	configurationAbs, err := filepath.Abs(configuration)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "failed to determine absolute path for configuration %q",
+			configuration,
+		)
+	}
+
+	return map[string]string{
+		"system":        resource.Get(KeySystem).(string),
+		"settings":      resource.Get(KeySettings).(string),
+		"configuration": configurationAbs,
+	}, nil
+}
+
+func (p *Provider) buildBatchKey(resource ResourceBox) string {
+	// NOTE: only requests with the same Nix settings could be built together
+	buf, err := json.Marshal(p.NixSettings(resource))
+	if err != nil {
+		panic(err)
+	}
+	return string(buf)
+}
+
+// build evaluates the wrapper with arguments and builds the attributes (if any)
+// or the whole wrapper (which should contain single derivation).
+// Concurrent builds may be coalesced into the single Nix invocation (see NixBuildBatcher).
+func (p *Provider) build(ctx context.Context, resource ResourceBox, wrapperPath string, wrapper []byte, arguments map[string]string, attributes ...string) (Derivations, error) {
+	request := NewNixBuildRequest(wrapperPath, wrapper, arguments, attributes...)
+	request.Context = ctx
+	derivations, err := p.builds.Submit(
+		p.buildBatchKey(resource), request,
+		func(requests []*NixBuildRequest) { p.buildBatch(resource, requests) },
+	)
+	if err != nil {
+		return nil, err
+	}
+	if derivations == nil { // NOTE: context is done
+		return nil, nil
+	}
+
+	configuration := arguments["configuration"]
+	if len(derivations) == 0 {
+		return nil, errors.Errorf(
+			"no derivations was build for %q configuration",
+			configuration,
+		)
+	}
+	if len(attributes) > 0 {
+		if len(derivations) != len(attributes) {
+			return nil, errors.Errorf(
+				"%d derivations was build for %q configuration (expecting %d derivations for %v)",
+				len(derivations), configuration, len(attributes), attributes,
+			)
+		}
+	} else if len(derivations) > 1 {
+		return nil, errors.Errorf(
+			"multiple derivations was build for %q configuration (expecting single derivation)",
+			configuration,
+		)
+	}
+
+	return derivations, nil
+}
+
+func (p *Provider) buildBatch(resource ResourceBox, requests []*NixBuildRequest) {
+	ctx, cancel := NixBuildBatchContext(requests)
+	defer cancel()
+
+	var (
+		keys   []string
+		unique = map[string][]*NixBuildRequest{}
+	)
+	for _, request := range requests {
+		key := request.Key()
+		if buf, ok := nixBuildCommandMemo.Get(key); ok {
+			derivations := Derivations{}
+			err := NewUnmarshalerJSON().Unmarshal(buf, &derivations)
+			request.Done(derivations, err)
+			continue
+		}
+		if _, ok := unique[key]; !ok {
+			keys = append(keys, key)
+		}
+		unique[key] = append(unique[key], request)
+	}
+
+	done := func(key string, derivations Derivations, err error) {
+		for _, request := range unique[key] {
+			request.Done(derivations, err)
+		}
+	}
+
+	if len(keys) > 1 {
+		results, err := p.buildMany(ctx, resource, keys, unique)
+		if err == nil {
+			for n, key := range keys {
+				done(key, results[n], nil)
+			}
+			return
+		}
+		// NOTE: building separately to attribute errors to the resources
+		tflog.Warn(ctx, "batched build failed, falling back to separate builds: "+err.Error())
+	}
+
+	// NOTE: builds are limited with build slots (see buildSingle)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			derivations, err := p.buildSingle(ctx, resource, unique[key][0])
+			done(key, derivations, err)
+		}(key)
+	}
+	wg.Wait()
+}
+
+func (p *Provider) buildSingle(ctx context.Context, resource ResourceBox, request *NixBuildRequest) (Derivations, error) {
+	nix, err := p.NewNix(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	defer nix.Close()
+
+	buildWrapper, err := NewNixWrapperFile(request.WrapperPath, request.Wrapper)
+	if err != nil {
+		return nil, err
+	}
+	defer buildWrapper.Close()
+
+	options := []NixBuildCommandOption{NixBuildCommandOptionFile(buildWrapper)}
+	for _, name := range request.ArgumentsNames() {
+		options = append(options, NixBuildCommandOptionArgStr(name, request.Arguments[name]))
+	}
+	options = append(
+		options,
+		NixBuildCommandOptionAttributes(request.Attributes...),
+		NixBuildCommandOptionJSON(),
+		NixBuildCommandOptionNoLink(),
+		NixBuildCommandOptionMemoize(request.Key()),
+	)
+
+	command := nix.Build(options...)
+	defer command.Close()
+
+	select {
+	case <-ctx.Done():
+		return nil, nil
+	default:
+	}
+
+	release, err := p.buildSlots.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	derivations := Derivations{}
+	err = command.Execute(&derivations)
+	if err != nil {
+		return nil, err
+	}
+
+	return derivations, nil
+}
+
+// buildMany builds multiple unique requests with single Nix invocation
+// and splits resulting derivations back per request.
+func (p *Provider) buildMany(ctx context.Context, resource ResourceBox, keys []string, requests map[string][]*NixBuildRequest) ([]Derivations, error) {
+	nix, err := p.NewNix(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	defer nix.Close()
+
+	var (
+		entries      = make(map[string]NixBuildBatchEntry, len(keys))
+		installables []string
+		counts       = make([]int, len(keys))
+		wrappers     = map[string]File{}
+	)
+	defer func() {
+		for _, wrapper := range wrappers {
+			wrapper.Close()
+		}
+	}()
+
+	for n, key := range keys {
+		var (
+			err         error
+			request     = requests[key][0]
+			name        = NixBuildBatchName(n)
+			wrapperPath = request.WrapperPath
+		)
+		if wrapperPath == "" {
+			wrapperSum := sha1.Sum(request.Wrapper)
+			wrapperKey := hex.EncodeToString(wrapperSum[:])
+			wrapper, ok := wrappers[wrapperKey]
+			if !ok {
+				wrapper, err = NewNixWrapperFile("", request.Wrapper)
+				if err != nil {
+					return nil, err
+				}
+				wrappers[wrapperKey] = wrapper
+			}
+			wrapperPath = wrapper.Name()
+		} else {
+			wrapperPath, err = filepath.Abs(wrapperPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		entries[name] = NixBuildBatchEntry{
+			Wrapper:   wrapperPath,
+			Arguments: request.Arguments,
+		}
+		requestInstallables := request.Installables(name)
+		installables = append(installables, requestInstallables...)
+		counts[n] = len(requestInstallables)
+	}
+
+	entriesFile, err := CreateTemp("nix_batch.json.*")
+	if err != nil {
+		return nil, err
+	}
+	defer entriesFile.Close()
+	err = json.NewEncoder(entriesFile).Encode(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	batchWrapper, err := NewNixWrapperFile("", NixBatchWrapper)
+	if err != nil {
+		return nil, err
+	}
+	defer batchWrapper.Close()
+
+	command := nix.Build(
+		NixBuildCommandOptionFile(batchWrapper),
+		NixBuildCommandOptionArgStr("requests", entriesFile.Name()),
+		NixBuildCommandOptionAttributes(installables...),
+		NixBuildCommandOptionJSON(),
+		NixBuildCommandOptionNoLink(),
+	)
+	defer command.Close()
+
+	release, err := p.buildSlots.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	tflog.Info(ctx, fmt.Sprintf("building %d configurations in batch", len(keys)))
+
+	derivations := Derivations{}
+	err = command.Execute(&derivations)
+	if err != nil {
+		return nil, err
+	}
+	if len(derivations) != len(installables) {
+		return nil, errors.Errorf(
+			"%d derivations was build for batch of %d installables",
+			len(derivations), len(installables),
+		)
+	}
+
+	results := make([]Derivations, len(keys))
+	offset := 0
+	for n, key := range keys {
+		results[n] = derivations[offset : offset+counts[n]]
+		offset += counts[n]
+
+		buf, err := json.Marshal(results[n])
+		if err != nil {
+			return nil, err
+		}
+		nixBuildCommandMemo.Set(key, buf)
+	}
+
+	return results, nil
+}
+
+func (p *Provider) Build(ctx context.Context, resource ResourceBox) (Derivations, error) {
+	arguments, err := p.configurationArguments(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	nixSettings := p.NixSettings(resource)
+	buildWrapperPath, _ := nixSettings[KeyNixBuildWrapper].(string)
+
+	return p.build(ctx, resource, buildWrapperPath, NixWrapper, arguments)
+}
+
+func (p *Provider) BuildImage(ctx context.Context, resource ResourceBox) (Derivations, error) {
+	arguments, err := p.configurationArguments(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	format := resource.Get(KeyImageFormat).(string)
+	if _, ok := ImageFormats[format]; !ok {
+		return nil, errors.Errorf(
+			"unsupported image format %q, supported formats are: %v",
+			format, ImageFormatsList(),
+		)
+	}
+	arguments["format"] = format
+	arguments["disk_size"] = resource.Get(KeyImageDiskSize).(string)
+
+	nixSettings := p.NixSettings(resource)
+	imageWrapperPath, _ := nixSettings[KeyNixImageWrapper].(string)
+
+	return p.build(ctx, resource, imageWrapperPath, NixImageWrapper, arguments)
+}
+
+func (p *Provider) CopySecrets(ctx context.Context, resource ResourceBox, secrets *Secrets) error {
+	address, err := p.ResourceAddress(ctx, resource)
+	if err != nil {
+		return err
+	}
+	ssh, err := p.NewSshHost(ctx, resource, address.String())
+	if err != nil {
+		return err
+	}
+	defer ssh.Close()
+
+	secretsCopy, err := secrets.Copy(ssh)
+	if err != nil {
+		return err
+	}
+	defer secretsCopy.Close()
+
+	release, err := p.copySlots.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = secretsCopy.Execute(nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *Provider) Push(ctx context.Context, resource ResourceBox, drvs Derivations) error {
+	nix, err := p.NewNix(ctx, resource)
+	if err != nil {
+		return err
+	}
+	defer nix.Close()
+
+	address, err := p.ResourceAddress(ctx, resource)
+	if err != nil {
+		return err
+	}
+	ssh, err := p.NewSshHost(ctx, resource, address.String())
+	if err != nil {
+		return err
+	}
+	defer ssh.Close()
+	target, err := p.nixCopyTarget(nix, ssh, address.String())
+	if err != nil {
+		return err
 	}
 
 	for _, drv := range drvs {
@@ -501,13 +1963,15 @@ func (p *Provider) Push(ctx context.Context, resource ResourceBox, drvs Derivati
 			default:
 			}
 
-			command := nix.Copy(
-				NixCopyCommandOptionTo(NixCopyProtocolSSH, address.String()),
-				NixCopyCommandOptionPath(path),
-			)
+			command := target.Copy(path, nil)
 			defer command.Close()
 
+			release, err := p.copySlots.Acquire(ctx)
+			if err != nil {
+				return err
+			}
 			err = command.Execute(nil)
+			release()
 			if err != nil {
 				return err
 			}
@@ -518,18 +1982,26 @@ func (p *Provider) Push(ctx context.Context, resource ResourceBox, drvs Derivati
 }
 
 func (p *Provider) Switch(ctx context.Context, resource ResourceBox, drvs Derivations) error {
-	address, err := p.Address(resource.Get(KeyAddress))
+	address, err := p.ResourceAddress(ctx, resource)
+	if err != nil {
+		return err
+	}
+	ssh, err := p.NewSshHost(ctx, resource, address.String())
+	if err != nil {
+		return err
+	}
+	defer ssh.Close()
+	nix, err := p.NewNix(ctx, resource)
 	if err != nil {
 		return err
 	}
+	defer nix.Close()
 
 	var (
-		nix         = p.NewNix(ctx, resource)
 		nixSettings = p.NixSettings(resource)
 		profilePath = nixSettings[KeyNixProfile].(string)
 		outName     = nixSettings[KeyNixOutputName].(string)
 		drvPath     = drvs[len(drvs)-1].Outputs[outName]
-		ssh         = nix.Ssh.With(SshOptionHost(address.String()))
 
 		nixProfile        = nix.Profile()
 		nixProfileInstall = NewRemoteCommand(
@@ -563,6 +2035,12 @@ func (p *Provider) Switch(ctx context.Context, resource ResourceBox, drvs Deriva
 		return errors.Errorf("unsupported activation action: %q", activationAction)
 	}
 
+	release, err := p.activationSlots.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	err = nixProfileInstall.Execute(nil)
 	if err != nil {
 		return err
@@ -575,7 +2053,73 @@ func (p *Provider) Switch(ctx context.Context, resource ResourceBox, drvs Deriva
 	return err
 }
 
-func (p *Provider) Close() error { return nil }
+func (p *Provider) Facts(ctx context.Context, resource ResourceBox) (*Facts, error) {
+	address, err := p.ResourceAddress(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	ssh, err := p.NewSshHost(ctx, resource, address.String())
+	if err != nil {
+		return nil, err
+	}
+	defer ssh.Close()
+
+	return GatherFacts(ssh, CommandOptionTflogTee(ctx))
+}
+
+var (
+	providersLock sync.Mutex
+	providers     []*Provider
+)
+
+func registerProvider(p *Provider) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	providers = append(providers, p)
+}
+
+// CloseProviders releases resources (ssh connections, temporary files, secrets, etc)
+// allocated by the configured providers, it should be called on plugin exit.
+func CloseProviders() error {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+
+	var errs error
+	for _, p := range providers {
+		err := p.Close()
+		if err != nil && errs == nil {
+			errs = err
+		}
+	}
+	providers = nil
+	return errs
+}
+
+func (p *Provider) Close() error {
+	p.sshClientsLock.Lock()
+	defer p.sshClientsLock.Unlock()
+
+	for key, client := range p.sshClients {
+		client.Close()
+		delete(p.sshClients, key)
+	}
+
+	p.secretBuffersLock.Lock()
+	for id, buffer := range p.secretBuffers {
+		buffer.Destroy()
+		delete(p.secretBuffers, id)
+	}
+	p.secretBuffersLock.Unlock()
+
+	p.vaultClientsLock.Lock()
+	for key, client := range p.vaultClients {
+		client.Close()
+		delete(p.vaultClients, key)
+	}
+	p.vaultClientsLock.Unlock()
+
+	return p.closeSsh()
+}
 
 //
 
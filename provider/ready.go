@@ -0,0 +1,166 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Ready waits for the probe to succeed with exponential backoff and jitter.
+	Ready struct {
+		Name       string
+		Timeout    time.Duration
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+		// Retryable reports whether probe error is transient (nil means any error is),
+		// waiting stops on the first error which is not.
+		Retryable func(error) bool
+	}
+	ReadyProbe func(ctx context.Context) error
+)
+
+const (
+	ReadyMinBackoff   = 1 * time.Second
+	ReadyMaxBackoff   = 30 * time.Second
+	ReadyProbeTimeout = 10 * time.Second
+	// ReadyCandidateTimeout limits waiting for the address candidate which is not the last one,
+	// so unreachable address does not delay failover to the next candidate for the whole ready_timeout.
+	ReadyCandidateTimeout = 30 * time.Second
+)
+
+// Backoff returns wait time before the attempt (counting from 1),
+// it grows exponentially and is randomized in [backoff/2, backoff).
+func (r *Ready) Backoff(attempt int) time.Duration {
+	backoff := r.MaxBackoff
+	if attempt < 32 {
+		exp := r.MinBackoff << (attempt - 1)
+		if exp > 0 && exp < backoff {
+			backoff = exp
+		}
+	}
+	half := backoff / 2
+	if half <= 0 {
+		return backoff
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// Wait runs probes until one succeeds, timeout expires or context is done.
+// Failure reason of each attempt is logged.
+func (r *Ready) Wait(ctx context.Context, probes ...ReadyProbe) error {
+	var (
+		deadline = time.Now().Add(r.Timeout)
+		err      error
+	)
+	for attempt := 1; ; attempt++ {
+		err = r.probe(ctx, probes)
+		if err == nil {
+			return nil
+		}
+		if r.Retryable != nil && !r.Retryable(err) {
+			return errors.Wrapf(err, "%s is not ready", r.Name)
+		}
+		tflog.Info(ctx, fmt.Sprintf("waiting for %s to become ready (attempt %d): %s", r.Name, attempt, err))
+
+		wait := r.Backoff(attempt)
+		if time.Now().Add(wait).After(deadline) {
+			return errors.Wrapf(err, "%s did not become ready in %s after %d attempts", r.Name, r.Timeout, attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (r *Ready) probe(ctx context.Context, probes []ReadyProbe) error {
+	for _, probe := range probes {
+		err := probe(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewReady(name string, timeout time.Duration) *Ready {
+	return &Ready{
+		Name:       name,
+		Timeout:    timeout,
+		MinBackoff: ReadyMinBackoff,
+		MaxBackoff: ReadyMaxBackoff,
+	}
+}
+
+//
+
+// ReadyProbeTCP checks the port accepts connections.
+func ReadyProbeTCP(address string, port string) ReadyProbe {
+	return func(ctx context.Context) error {
+		dialer := &net.Dialer{Timeout: ReadyProbeTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// ReadyProbeSsh checks ssh handshake succeeds and trivial command could be executed.
+func (p *Provider) ReadyProbeSsh(resource ResourceBox, address string) ReadyProbe {
+	return func(ctx context.Context) error {
+		ssh, err := p.NewSshHost(ctx, resource, address)
+		if err != nil {
+			return err
+		}
+		defer ssh.Close()
+
+		probe := NewRemoteCommand(ssh.With(SshOptionBecome(nil)), CommandFromString("true"))
+		defer probe.Close()
+
+		return probe.Execute(nil)
+	}
+}
+
+// WaitReady waits until the host accepts ssh connections and is able to run commands,
+// additional probes run before the ssh probe (after the port is open).
+// TCP port is probed only for direct connections (bastion hops are verified by ssh).
+// Only connection and authentication errors are retried (keys could be installed
+// by cloud-init after sshd is started), others (host key mismatch) are not fixed by waiting.
+func (p *Provider) WaitReady(ctx context.Context, resource ResourceBox, address string, probes ...ReadyProbe) error {
+	timeout := time.Duration(p.Get(KeyReadyTimeout).(int)) * time.Second
+	return p.WaitReadyTimeout(ctx, resource, address, timeout, probes...)
+}
+
+// WaitReadyTimeout is WaitReady with timeout which overrides ready_timeout.
+func (p *Provider) WaitReadyTimeout(ctx context.Context, resource ResourceBox, address string, timeout time.Duration, probes ...ReadyProbe) error {
+	configs, err := p.sshConfigs(ctx, resource)
+	if err != nil {
+		return err
+	}
+
+	var (
+		ready  = NewReady(fmt.Sprintf("host %q", address), timeout)
+		checks = []ReadyProbe{}
+	)
+	ready.Retryable = IsSshNotReadyError
+	if len(configs.Bastions) == 0 {
+		port, ok := configs.Target.Get(SshConfigKeyPort)
+		if !ok || port == "" {
+			port = strconv.Itoa(SshDefaultPort)
+		}
+		checks = append(checks, ReadyProbeTCP(address, port))
+	}
+	checks = append(checks, probes...)
+	checks = append(checks, p.ReadyProbeSsh(resource, address))
+
+	return ready.Wait(ctx, checks...)
+}
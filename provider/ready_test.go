@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyBackoff(t *testing.T) {
+	r := &Ready{MinBackoff: time.Second, MaxBackoff: 8 * time.Second}
+	for attempt, max := range []time.Duration{1, 2, 4, 8, 8, 8} {
+		backoff := r.Backoff(attempt + 1)
+		assert.GreaterOrEqual(t, backoff, max*time.Second/2)
+		assert.Less(t, backoff, max*time.Second)
+	}
+	assert.Less(t, r.Backoff(100), 8*time.Second)
+}
+
+func TestReadyWait(t *testing.T) {
+	r := &Ready{
+		Name:       "test",
+		Timeout:    time.Second,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}
+
+	attempts := 0
+	err := r.Wait(context.Background(), func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("not ready")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	r.Timeout = 50 * time.Millisecond
+	err = r.Wait(context.Background(), func(ctx context.Context) error {
+		return errors.New("not ready")
+	})
+	assert.ErrorContains(t, err, "test did not become ready")
+	assert.ErrorContains(t, err, "not ready")
+}
+
+func TestReadyProbeTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, err)
+
+	assert.NoError(t, ReadyProbeTCP(host, port)(context.Background()))
+	listener.Close()
+	assert.Error(t, ReadyProbeTCP(host, port)(context.Background()))
+}
+
+func TestReadyWaitRetryable(t *testing.T) {
+	r := &Ready{
+		Name:       "test",
+		Timeout:    time.Second,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+		Retryable:  IsSshConnectionError,
+	}
+
+	attempts := 0
+	err := r.Wait(context.Background(), func(ctx context.Context) error {
+		attempts++
+		switch attempts {
+		case 1:
+			return &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+		case 2:
+			return errors.New("Connection closed by 192.0.2.1 port 22")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = r.Wait(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return errors.New("Host key verification failed.")
+	})
+	assert.ErrorContains(t, err, "test is not ready")
+	assert.ErrorContains(t, err, "Host key verification failed")
+	assert.Equal(t, 1, attempts)
+}
+
+func TestIsSshNotReadyError(t *testing.T) {
+	assert.True(t, IsSshNotReadyError(errors.New("ssh: connect to host 10.0.0.1 port 22: Connection refused")))
+	assert.True(t, IsSshNotReadyError(errors.New("root@10.0.0.1: Permission denied (publickey).")))
+	assert.True(t, IsSshNotReadyError(errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain")))
+	assert.False(t, IsSshNotReadyError(errors.New("Host key verification failed.")))
+}
@@ -25,19 +25,35 @@ func init() {
 const (
 	KeyAddressFilter   = "address_filter"
 	KeyAddressPriority = "address_priority"
+	KeyAddressProbe    = "address_probe"
+	KeyConnectByName   = "connect_by_name"
+	KeyAddressUsed     = "address_used"
 	KeyNixosInstance   = "nixos_instance"
+	KeyNixosHostFacts  = "nixos_host_facts"
+	KeyNixosImage      = "nixos_image"
+	KeyNixosInstall    = "nixos_install"
+	KeyNixosSecrets    = "nixos_secrets"
 	KeyAddress         = "address"
 	KeySystem          = "system"
 	KeySettings        = "settings"
 	KeyConfiguration   = "configuration"
 	KeyRetry           = "retry"
 	KeyRetryWait       = "retry_wait"
+	KeyReadyTimeout    = "ready_timeout"
+
+	KeyBuildBatchWindow = "build_batch_window"
+
+	KeyMaxParallelBuilds      = "max_parallel_builds"
+	KeyMaxParallelCopies      = "max_parallel_copies"
+	KeyMaxParallelActivations = "max_parallel_activations"
 
 	//
 
-	KeyNix             = "nix"
-	KeyNixMode         = "mode"
-	KeyNixBuildWrapper = "build_wrapper"
+	KeyNix               = "nix"
+	KeyNixMode           = "mode"
+	KeyNixBuildWrapper   = "build_wrapper"
+	KeyNixImageWrapper   = "image_wrapper"
+	KeyNixInstallWrapper = "install_wrapper"
 
 	KeyNixProfile          = "profile"
 	KeyNixOutputName       = "output"
@@ -50,14 +66,40 @@ const (
 
 	//
 
-	KeySsh       = "ssh"
-	KeySshHost   = "host"
-	KeySshUser   = "user"
-	KeySshPort   = "port"
-	KeySshConfig = "config"
+	KeySsh           = "ssh"
+	KeySshHost       = "host"
+	KeySshUser       = "user"
+	KeySshPort       = "port"
+	KeySshConfig     = "config"
+	KeySshTransport  = "transport"
+	KeySshMultiplex  = "multiplex"
+	KeySshTunnelPort = "tunnel_port"
+
+	KeySshPrivateKeySource = "private_key_source"
+	KeySshPasswordSource   = "password_source"
+
+	KeySshConfigDirective      = "config_directive"
+	KeySshConfigDirectiveName  = "name"
+	KeySshConfigDirectiveValue = "value"
+	KeySshConfigBlock          = "config_block"
+	KeySshConfigBlockCondition = "condition"
+	KeySshConfigInclude        = "config_include"
+
+	KeySshCertificateAuthority           = "certificate_authority"
+	KeySshCertificateAuthorityKeySource  = "key_source"
+	KeySshCertificateAuthorityPrincipals = "principals"
+	KeySshCertificateAuthorityValidity   = "validity"
 
 	KeyBastion = "bastion"
 
+	KeyBecome               = "become"
+	KeyBecomeMethod         = "method"
+	KeyBecomePasswordSource = "password_source"
+
+	KeyHostKey         = "host_key"
+	KeyHostKeyTofu     = "host_key_tofu"
+	KeyHostKeyObserved = "host_key_observed"
+
 	//
 
 	KeySecrets = "secrets"
@@ -66,33 +108,122 @@ const (
 	KeySecretFingerprintSum           = "sum"
 	KeySecretFingerprintSalt          = "salt"
 	KeySecretFingerprintKdfIterations = "kdf_iterations"
+	KeySecretFingerprintSecrets       = "secrets"
+	KeySecretFingerprintDirectories   = "directories"
 
-	KeySecretsProvider                   = "provider"
-	KeySecretsProviderFilesystem         = "filesystem"
-	KeySecretsProviderCommand            = "command"
-	KeySecretsProviderCommandName        = "name"
-	KeySecretsProviderCommandArguments   = "arguments"
-	KeySecretsProviderCommandEnvironment = "environment"
-	KeySecretsProviderGopass             = "gopass"
-	KeySecretsProviderGopassStore        = "store"
+	KeySecretsTmpfs                            = "tmpfs"
+	KeySecretsProvider                         = "provider"
+	KeySecretsProviderFilesystem               = "filesystem"
+	KeySecretsProviderCommand                  = "command"
+	KeySecretsProviderCommandName              = "name"
+	KeySecretsProviderCommandArguments         = "arguments"
+	KeySecretsProviderCommandEnvironment       = "environment"
+	KeySecretsProviderGopass                   = "gopass"
+	KeySecretsProviderGopassStore              = "store"
+	KeySecretsProviderAge                      = "age"
+	KeySecretsProviderAgeIdentityFile          = "identity_file"
+	KeySecretsProviderAgeIdentityProvider      = "identity_provider"
+	KeySecretsProviderAgeIdentitySource        = "identity_source"
+	KeySecretsProviderSops                     = "sops"
+	KeySecretsProviderSopsPgpKeyring           = "pgp_keyring"
+	KeySecretsProviderVault                    = "vault"
+	KeySecretsProviderVaultAddress             = "address"
+	KeySecretsProviderVaultNamespace           = "namespace"
+	KeySecretsProviderVaultToken               = "token"
+	KeySecretsProviderVaultTokenFile           = "token_file"
+	KeySecretsProviderVaultAppRole             = "approle"
+	KeySecretsProviderVaultAppRoleMount        = "mount"
+	KeySecretsProviderVaultAppRoleRoleId       = "role_id"
+	KeySecretsProviderVaultAppRoleSecretId     = "secret_id"
+	KeySecretsProviderVaultAppRoleSecretIdFile = "secret_id_file"
+	KeySecretsProviderVaultKvVersion           = "kv_version"
+	KeySecretsProviderVaultCACert              = "ca_cert"
+	KeySecretsProviderVaultClientCert          = "client_cert"
+	KeySecretsProviderVaultClientKey           = "client_key"
+	KeySecretsProviderVaultTLSServerName       = "tls_server_name"
+	KeySecretsProviderVaultSkipVerify          = "skip_verify"
 
 	//
 
-	KeySecret            = "secret"
-	KeySecretSource      = "source"
-	KeySecretDestination = "destination"
-	KeySecretOwner       = "owner"
-	KeySecretGroup       = "group"
-	KeySecretPermissions = "permissions"
+	KeySecret              = "secret"
+	KeySecretSource        = "source"
+	KeySecretDestination   = "destination"
+	KeySecretOwner         = "owner"
+	KeySecretGroup         = "group"
+	KeySecretPermissions   = "permissions"
+	KeySecretContent       = "content"
+	KeySecretContentBase64 = "content_base64"
+	KeySecretTemplate      = "template"
+	KeySecretValues        = "values"
+	KeySecretFile          = "file"
+	KeySecretFilePattern   = "pattern"
+
+	KeySecretDirectoryOwner       = "directory_owner"
+	KeySecretDirectoryGroup       = "directory_group"
+	KeySecretDirectoryPermissions = "directory_permissions"
+
+	KeySecretOnChange             = "on_change"
+	KeySecretOnChangeRestartUnits = "restart_units"
+	KeySecretOnChangeReloadUnits  = "reload_units"
+	KeySecretOnChangeCommand      = "command"
 
 	//
 
 	KeyDerivations       = "derivations"
 	KeyDerivationPath    = "path"
 	KeyDerivationOutputs = "outputs"
+
+	//
+
+	KeyImageFormat   = "format"
+	KeyImageDiskSize = "disk_size"
+	KeyImagePath     = "path"
+	KeyImageSize     = "size"
+	KeyImageSha256   = "sha256"
+
+	//
+
+	KeyInstallDiskLayout        = "disk_layout"
+	KeyInstallInstallerSettings = "installer_settings"
+	KeyInstallDisko             = "disko"
+	KeyInstallPhases            = "phases"
+	KeyInstallKexecTimeout      = "kexec_timeout"
+
+	//
+
+	KeyHostFactsNixosVersion          = "nixos_version"
+	KeyHostFactsCurrentSystem         = "current_system"
+	KeyHostFactsBootedSystem          = "booted_system"
+	KeyHostFactsHostKeys              = "host_keys"
+	KeyHostFactsInterfaces            = "interfaces"
+	KeyHostFactsInterfaceName         = "name"
+	KeyHostFactsInterfaceAddresses    = "addresses"
+	KeyHostFactsAddresses             = "addresses"
+	KeyHostFactsHardwareConfiguration = "hardware_configuration"
 )
 
 var (
+	ProviderSchemaSshConfigDirective = &schema.Schema{
+		Description: "Ordered list of SSH configuration directives, multi-valued directives (IdentityFile, LocalForward, SendEnv, CertificateFile, etc) could be repeated",
+		Type:        schema.TypeList,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				KeySshConfigDirectiveName: {
+					Description:      "Directive name (like IdentityFile)",
+					Type:             schema.TypeString,
+					Required:         true,
+					ValidateDiagFunc: sshConfigValidateDiag(SshConfigValidateDirective),
+				},
+				KeySshConfigDirectiveValue: {
+					Description: "Directive value",
+					Type:        schema.TypeString,
+					Required:    true,
+				},
+			},
+		},
+		Optional: true,
+	}
+
 	ProviderSchemaSshMap = map[string]*schema.Schema{
 		KeySshUser: {
 			Description: "SSH remote user name",
@@ -106,11 +237,72 @@ var (
 			Optional:    true,
 		},
 		KeySshConfig: {
-			Description: "SSH configuration map",
-			Type:        schema.TypeMap,
+			Description:      "SSH configuration map (single value per directive)",
+			Type:             schema.TypeMap,
+			Elem:             &schema.Schema{Type: schema.TypeString},
+			Optional:         true,
+			DefaultFunc:      DefaultSshConfig,
+			ValidateDiagFunc: SshConfigValidateMapDiag,
+		},
+		KeySshConfigDirective: ProviderSchemaSshConfigDirective,
+		KeySshConfigBlock: {
+			Description: "List of SSH configuration blocks scoped with Host or Match condition (not supported by native transport)",
+			Type:        schema.TypeList,
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					KeySshConfigBlockCondition: {
+						Description:      "Block condition, like: Host *.internal or Match user deploy",
+						Type:             schema.TypeString,
+						Required:         true,
+						ValidateDiagFunc: sshConfigValidateDiag(SshConfigValidateCondition),
+					},
+					KeySshConfigDirective: ProviderSchemaSshConfigDirective,
+				},
+			},
+			Optional: true,
+		},
+		KeySshConfigInclude: {
+			Description: "List of SSH configuration files to include (like ~/.ssh/config), directives set by the provider take precedence (not supported by native transport)",
+			Type:        schema.TypeList,
 			Elem:        &schema.Schema{Type: schema.TypeString},
 			Optional:    true,
-			DefaultFunc: DefaultSshConfig,
+		},
+		KeySshPrivateKeySource: {
+			Description: "SSH private key source in secrets provider, key is served to ssh through in-process agent and never written to disk",
+			Type:        schema.TypeString,
+			Optional:    true,
+		},
+		KeySshPasswordSource: {
+			Description: "SSH password source in secrets provider, password is served to ssh through askpass helper and never written to disk",
+			Type:        schema.TypeString,
+			Optional:    true,
+		},
+		KeySshCertificateAuthority: {
+			Description: "SSH certificate authority which signs short-lived user certificate for ephemeral key before each operation, key & certificate are served to ssh through in-process agent",
+			Type:        schema.TypeList,
+			MaxItems:    1,
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					KeySshCertificateAuthorityKeySource: {
+						Description: "Certificate authority private key source in secrets provider",
+						Type:        schema.TypeString,
+						Required:    true,
+					},
+					KeySshCertificateAuthorityPrincipals: {
+						Description: "List of certificate principals (defaults to ssh user)",
+						Type:        schema.TypeList,
+						Elem:        &schema.Schema{Type: schema.TypeString},
+						Optional:    true,
+					},
+					KeySshCertificateAuthorityValidity: {
+						Description: "Amount of seconds certificate is valid for",
+						Type:        schema.TypeInt,
+						Optional:    true,
+						Default:     300,
+					},
+				},
+			},
+			Optional: true,
 		},
 	}
 	ProviderSchemaSsh = SchemaWithDefaultFuncCtr(DefaultMapFromSchema, &schema.Schema{
@@ -118,7 +310,29 @@ var (
 		Type:        schema.TypeSet,
 		MaxItems:    1,
 		Elem: &schema.Resource{
-			Schema: ProviderSchemaSshMap,
+			Schema: SchemaMapExtend(
+				ProviderSchemaSshMap,
+				map[string]*schema.Schema{
+					KeySshTransport: {
+						Description: "SSH transport implementation, one of: openssh (ssh binary), native (built-in client which reuses connections)",
+						Type:        schema.TypeString,
+						Optional:    true,
+						Default:     SshTransportOpenSSH,
+					},
+					KeySshMultiplex: {
+						Description: "Share single SSH connection (ControlMaster) per target and bastion between deployment phases (openssh transport only)",
+						Type:        schema.TypeBool,
+						Optional:    true,
+						Default:     true,
+					},
+					KeySshTunnelPort: {
+						Description: "Port sshd listens on the target itself, nix copy is tunneled to it through the connection (native transport only, differs from port when it is forwarded)",
+						Type:        schema.TypeInt,
+						Optional:    true,
+						Default:     SshDefaultPort,
+					},
+				},
+			),
 		},
 		Optional: true,
 	})
@@ -129,16 +343,42 @@ var (
 			KeySshHost: {
 				Description: "SSH bastion remote hostname",
 				Type:        schema.TypeString,
+				Required:    true,
+			},
+			KeyHostKey: {
+				Description: "SSH bastion host public key (like ssh-ed25519 AAAA...) to pin, connection fails if bastion presents a different key",
+				Type:        schema.TypeString,
 				Optional:    true,
 			},
 		},
 	)
-	ProviderSchemaBastion = SchemaWithDefaultFuncCtr(DefaultMapFromSchema, &schema.Schema{
-		Description: "SSH configuration for bastion server",
+	ProviderSchemaBastion = &schema.Schema{
+		Description: "Ordered list of SSH bastion servers (hops) to connect through, first hop is connected directly",
+		Type:        schema.TypeList,
+		Elem: &schema.Resource{
+			Schema: ProviderSchemaBastionMap,
+		},
+		Optional: true,
+	}
+
+	ProviderSchemaBecome = SchemaWithDefaultFuncCtr(DefaultMapFromSchema, &schema.Schema{
+		Description: "Privileges escalation settings for remote commands (when ssh user is not root)",
 		Type:        schema.TypeSet,
 		MaxItems:    1,
 		Elem: &schema.Resource{
-			Schema: ProviderSchemaBastionMap,
+			Schema: map[string]*schema.Schema{
+				KeyBecomeMethod: {
+					Description: "Privileges escalation method, one of: sudo, doas, run0 (empty to disable)",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     BecomeMethodNone,
+				},
+				KeyBecomePasswordSource: {
+					Description: "Privileges escalation password source in secrets provider (supported only by sudo)",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+			},
 		},
 		Optional: true,
 	})
@@ -197,7 +437,166 @@ var (
 		},
 		Optional: true,
 	})
+	ProviderSchemaSecretsProviderAgeIdentity = map[string]*schema.Schema{
+		KeySecretsProviderAgeIdentityFile: {
+			Description: "Age identity files or unencrypted ssh private keys (ed25519, rsa) to decrypt secrets with",
+			Type:        schema.TypeList,
+			Elem:        &schema.Schema{Type: schema.TypeString},
+			Optional:    true,
+		},
+		KeySecretsProviderAgeIdentityProvider: {
+			Description: fmt.Sprintf(
+				"Secrets provider to retrieve identity from (settings of this provider are used), available: %v",
+				[]string{
+					string(SecretsProviderNameFilesystem),
+					string(SecretsProviderNameCommand),
+					string(SecretsProviderNameGopass),
+				},
+			),
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		KeySecretsProviderAgeIdentitySource: {
+			Description: "Identity source in the identity secrets provider",
+			Type:        schema.TypeString,
+			Optional:    true,
+		},
+	}
+	ProviderSchemaSecretsProviderAge = SchemaWithDefaultFuncCtr(DefaultMapFromSchema, &schema.Schema{
+		Description: "Age secrets provider settings, secret sources are age encrypted files (binary or armored)",
+		Type:        schema.TypeSet,
+		MinItems:    0,
+		MaxItems:    1,
+		Elem: &schema.Resource{
+			Schema: ProviderSchemaSecretsProviderAgeIdentity,
+		},
+		Optional: true,
+	})
+	ProviderSchemaSecretsProviderSops = SchemaWithDefaultFuncCtr(DefaultMapFromSchema, &schema.Schema{
+		Description: "SOPS secrets provider settings, secret sources are SOPS encrypted files (yaml, json, dotenv or binary), " +
+			"single value could be selected with JSON pointer: secrets.yaml#/database/password " +
+			"(age identities default to $SOPS_AGE_KEY_FILE or sops/age/keys.txt in user config directory)",
+		Type:     schema.TypeSet,
+		MinItems: 0,
+		MaxItems: 1,
+		Elem: &schema.Resource{
+			Schema: SchemaMapExtend(ProviderSchemaSecretsProviderAgeIdentity, map[string]*schema.Schema{
+				KeySecretsProviderSopsPgpKeyring: {
+					Description: "Files with pgp private keys (armored or binary, passphrase protected keys are not supported), default is $GNUPGHOME/secring.gpg",
+					Type:        schema.TypeList,
+					Elem:        &schema.Schema{Type: schema.TypeString},
+					Optional:    true,
+				},
+			}),
+		},
+		Optional: true,
+	})
+	ProviderSchemaSecretsProviderVault = SchemaWithDefaultFuncCtr(DefaultMapFromSchema, &schema.Schema{
+		Description: "Vault secrets provider settings, secret sources are KV secret paths with optional field: secret/myapp/db#password " +
+			"(all fields are returned as JSON if field is not specified), empty settings default to VAULT_* environment variables",
+		Type:     schema.TypeSet,
+		MinItems: 0,
+		MaxItems: 1,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				KeySecretsProviderVaultAddress: {
+					Description: "Vault server address",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeySecretsProviderVaultNamespace: {
+					Description: "Vault namespace",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeySecretsProviderVaultToken: {
+					Description: "Vault token",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Sensitive:   true,
+				},
+				KeySecretsProviderVaultTokenFile: {
+					Description: "File to read vault token from (default is ~/.vault-token)",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeySecretsProviderVaultAppRole: {
+					Description: "AppRole authentication settings",
+					Type:        schema.TypeList,
+					MaxItems:    1,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							KeySecretsProviderVaultAppRoleMount: {
+								Description: "AppRole auth method mount path",
+								Type:        schema.TypeString,
+								Optional:    true,
+								Default:     VaultDefaultAppRoleMount,
+							},
+							KeySecretsProviderVaultAppRoleRoleId: {
+								Description: "AppRole role id",
+								Type:        schema.TypeString,
+								Required:    true,
+							},
+							KeySecretsProviderVaultAppRoleSecretId: {
+								Description: "AppRole secret id",
+								Type:        schema.TypeString,
+								Optional:    true,
+								Sensitive:   true,
+							},
+							KeySecretsProviderVaultAppRoleSecretIdFile: {
+								Description: "File to read AppRole secret id from",
+								Type:        schema.TypeString,
+								Optional:    true,
+							},
+						},
+					},
+					Optional: true,
+				},
+				KeySecretsProviderVaultKvVersion: {
+					Description: "KV secrets engine version (1 or 2), detected for each mount if not set (mount is the first path segment if set)",
+					Type:        schema.TypeInt,
+					Optional:    true,
+					Default:     0,
+				},
+				KeySecretsProviderVaultCACert: {
+					Description: "CA certificate file to verify vault server certificate with",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeySecretsProviderVaultClientCert: {
+					Description: "Client certificate file for TLS authentication",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeySecretsProviderVaultClientKey: {
+					Description: "Client key file for TLS authentication",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeySecretsProviderVaultTLSServerName: {
+					Description: "Server name to verify vault server certificate with",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeySecretsProviderVaultSkipVerify: {
+					Description: "Skip vault server certificate verification (insecure)",
+					Type:        schema.TypeBool,
+					Optional:    true,
+					Default:     false,
+				},
+			},
+		},
+		Optional: true,
+	})
 	ProviderSchemaSecretsMap = map[string]*schema.Schema{
+		KeySecretsTmpfs: {
+			Description: "Directories (like /run/secrets) which are symlinks to in-memory generations of secrets, " +
+				"each installation writes a new generation and switches symlink atomically (previous generation is kept), " +
+				"secrets installed by other resources under the same directory are carried over",
+			Type:     schema.TypeList,
+			Elem:     &schema.Schema{Type: schema.TypeString},
+			Optional: true,
+		},
 		KeySecretsProvider: {
 			Description: fmt.Sprintf("Secrets provider to use, available: %v", SecretsProviders),
 			Type:        schema.TypeString,
@@ -207,6 +606,9 @@ var (
 		KeySecretsProviderFilesystem: ProviderSchemaSecretsProviderFilesystem,
 		KeySecretsProviderCommand:    ProviderSchemaSecretsProviderCommand,
 		KeySecretsProviderGopass:     ProviderSchemaSecretsProviderGopass,
+		KeySecretsProviderAge:        ProviderSchemaSecretsProviderAge,
+		KeySecretsProviderSops:       ProviderSchemaSecretsProviderSops,
+		KeySecretsProviderVault:      ProviderSchemaSecretsProviderVault,
 	}
 	ProviderSchemaSecrets = SchemaWithDefaultFuncCtr(DefaultMapFromSchema, &schema.Schema{
 		Description: "Describes secrets settings",
@@ -231,9 +633,43 @@ var (
 		Elem: &schema.Resource{
 			Schema: map[string]*schema.Schema{
 				KeySecretSource: {
-					Description: "Secret file on the host which should be transfered to destination",
+					Description: fmt.Sprintf(
+						"Secret file on the host which should be transfered to destination (one of %q, %q, %q or %q is required)",
+						KeySecretSource, KeySecretContent, KeySecretContentBase64, KeySecretTemplate,
+					),
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				KeySecretContent: {
+					Description: "Secret content to transfer to destination instead of source (secrets provider is not used)",
 					Type:        schema.TypeString,
-					Required:    true,
+					Optional:    true,
+					Sensitive:   true,
+				},
+				KeySecretContentBase64: {
+					Description: "Base64 encoded secret content to transfer to destination instead of source (for binary content)",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Sensitive:   true,
+				},
+				KeySecretTemplate: {
+					Description: fmt.Sprintf(
+						"Go template to render secret content from %q instead of source (rendered in memory), "+
+							"values are available as {{ .name }}, functions: %v",
+						KeySecretValues, SecretTemplateFuncNames(),
+					),
+					Type:     schema.TypeString,
+					Optional: true,
+				},
+				KeySecretValues: {
+					Description: fmt.Sprintf(
+						"Template values, each value is a secret source in the secrets provider, "+
+							"other configured provider could be referenced with a prefix: gopass:db/pass (available: %v)",
+						SecretsProviders,
+					),
+					Type:     schema.TypeMap,
+					Elem:     &schema.Schema{Type: schema.TypeString},
+					Optional: true,
 				},
 				KeySecretDestination: {
 					Description: "Secret file destination on the target host",
@@ -258,6 +694,82 @@ var (
 					Optional:    true,
 					Default:     600,
 				},
+				KeySecretDirectoryOwner: {
+					Description: "Owner username of the missing parent directories created for the secret",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     SecretDefaultDirectoryOwner,
+				},
+				KeySecretDirectoryGroup: {
+					Description: "Owner groupname of the missing parent directories created for the secret",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     SecretDefaultDirectoryGroup,
+				},
+				KeySecretDirectoryPermissions: {
+					Description: "Permissions (in octal) of the missing parent directories created for the secret",
+					Type:        schema.TypeInt,
+					Optional:    true,
+					Default:     SecretDefaultDirectoryPermissions,
+				},
+				KeySecretOnChange: {
+					Description: "Actions to take on the target after installation if secret content changed " +
+						"(restart, reload, then command)",
+					Type:     schema.TypeList,
+					MaxItems: 1,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							KeySecretOnChangeRestartUnits: {
+								Description: "Systemd units to restart",
+								Type:        schema.TypeList,
+								Elem:        &schema.Schema{Type: schema.TypeString},
+								Optional:    true,
+							},
+							KeySecretOnChangeReloadUnits: {
+								Description: "Systemd units to reload",
+								Type:        schema.TypeList,
+								Elem:        &schema.Schema{Type: schema.TypeString},
+								Optional:    true,
+							},
+							KeySecretOnChangeCommand: {
+								Description: "Shell command to run",
+								Type:        schema.TypeString,
+								Optional:    true,
+							},
+						},
+					},
+					Optional: true,
+				},
+				KeySecretFile: {
+					Description: "Owner, group & permissions overrides for files of the directory source (applied in order), " +
+						"files which disappeared from the source directory are removed from destination",
+					Type: schema.TypeList,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							KeySecretFilePattern: {
+								Description: "Glob pattern to match file path relative to the source directory (base name is matched if pattern has no slashes)",
+								Type:        schema.TypeString,
+								Required:    true,
+							},
+							KeySecretOwner: {
+								Description: "File owner username",
+								Type:        schema.TypeString,
+								Optional:    true,
+							},
+							KeySecretGroup: {
+								Description: "File owner groupname",
+								Type:        schema.TypeString,
+								Optional:    true,
+							},
+							KeySecretPermissions: {
+								Description: "File permissions (in octal)",
+								Type:        schema.TypeInt,
+								Optional:    true,
+							},
+						},
+					},
+					Optional: true,
+				},
 			},
 		},
 		Optional: true,
@@ -302,6 +814,16 @@ var (
 					Type:        schema.TypeString,
 					Optional:    true,
 				},
+				KeyNixImageWrapper: {
+					Description: "Path to the image wrapper in Nix language (function which receives format & disk_size and returns drv_path & out_path)",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeyNixInstallWrapper: {
+					Description: "Path to the install wrapper in Nix language (function which returns out_path, disko_script & kexec_tree)",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
 				KeyNixProfile: {
 					Description: "Path to the current system profile",
 					Type:        schema.TypeString,
@@ -361,6 +883,36 @@ var (
 			Optional:    true,
 			Default:     5,
 		},
+		KeyReadyTimeout: {
+			Description: "Amount of seconds to wait for the host to accept ssh connections before deploying",
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     300,
+		},
+		KeyBuildBatchWindow: {
+			Description: "Amount of milliseconds to wait for concurrent builds to evaluate them with single Nix invocation (0 disables batching)",
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     200,
+		},
+		KeyMaxParallelBuilds: {
+			Description: "Maximum amount of concurrent Nix builds across all resources (0 means unlimited)",
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+		},
+		KeyMaxParallelCopies: {
+			Description: "Maximum amount of concurrent copy operations (nix copy, secrets upload) across all resources (0 means unlimited)",
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+		},
+		KeyMaxParallelActivations: {
+			Description: "Maximum amount of concurrent system activations across all resources (0 means unlimited)",
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     0,
+		},
 
 		KeyAddressFilter: {
 			Description: "List of network cidr's to filter addresses used to connect to nixos_instance resources",
@@ -376,10 +928,23 @@ var (
 			Optional:    true,
 			DefaultFunc: DefaultAddressPriority,
 		},
+		KeyAddressProbe: {
+			Description: "Probe ssh port of nixos_instance addresses concurrently (happy eyeballs) and connect to the first reachable address",
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     false,
+		},
+		KeyConnectByName: {
+			Description: "Connect to hostnames from address list by name instead of resolved ip addresses (so ssh_config Host matching and certificates keep working), filters are still applied to resolved addresses",
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     false,
+		},
 
 		KeyNix:     ProviderSchemaNix,
 		KeySsh:     ProviderSchemaSsh,
 		KeyBastion: ProviderSchemaBastion,
+		KeyBecome:  ProviderSchemaBecome,
 		KeySecrets: ProviderSchemaSecrets,
 		KeySecret:  ProviderSchemaSecret,
 	}
@@ -398,11 +963,16 @@ var (
 
 			Schema: map[string]*schema.Schema{
 				KeyAddress: {
-					Description: "List of server addresses",
+					Description: "List of server addresses (ip addresses, optionally with ipv6 zone like fe80::1%eth0, or hostnames resolved during apply)",
 					Type:        schema.TypeList,
 					Elem:        &schema.Schema{Type: schema.TypeString},
 					Required:    true,
 				},
+				KeyAddressUsed: {
+					Description: "Server address which was used to connect during last apply",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
 				KeySystem: {
 					Description: "Nix arch & target to build for (defaults to x86_64-linux)",
 					Type:        schema.TypeString,
@@ -420,10 +990,27 @@ var (
 					Type:        schema.TypeString,
 					Required:    true,
 				},
+				KeyHostKey: {
+					Description: "Server SSH host public key (like ssh-ed25519 AAAA...) to pin, connection fails if server presents a different key",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeyHostKeyTofu: {
+					Description: "Trust server ed25519 host key on first use when host_key is not set, observed key is pinned afterwards so connection fails if it changes",
+					Type:        schema.TypeBool,
+					Optional:    true,
+					Default:     false,
+				},
+				KeyHostKeyObserved: {
+					Description: "Server SSH host public key which was used during last apply",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
 
 				KeyNix:     ProviderSchemaNix,
 				KeySsh:     ProviderSchemaSsh,
 				KeyBastion: ProviderSchemaBastion,
+				KeyBecome:  ProviderSchemaBecome,
 				KeySecrets: ProviderSchemaSecrets,
 				KeySecret:  ProviderSchemaSecret,
 
@@ -437,11 +1024,258 @@ var (
 				},
 			},
 		},
+		KeyNixosImage: {
+			Description: "NixOS disk image",
+
+			CustomizeDiff: image.Diff,
+			CreateContext: image.Create,
+			ReadContext:   image.Read,
+			UpdateContext: image.Update,
+			DeleteContext: image.Delete,
+
+			Schema: map[string]*schema.Schema{
+				KeySystem: {
+					Description: "Nix arch & target to build for (defaults to x86_64-linux)",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     "x86_64-linux",
+				},
+				KeySettings: {
+					Description: "Optional settings (encoded with HCL function jsonencode()) to pass into Nix configuration derivation as attribute set (any configuration key could be specified)",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     "{}",
+				},
+				KeyConfiguration: {
+					Description: "Path to Nix derivation",
+					Type:        schema.TypeString,
+					Required:    true,
+				},
+				KeyImageFormat: {
+					Description: fmt.Sprintf("Image format, available: %v", ImageFormatsList()),
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     ImageFormatQcow2,
+				},
+				KeyImageDiskSize: {
+					Description: "Disk image size in megabytes or \"auto\" (ignored for iso format)",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     "auto",
+				},
+
+				KeyNix: ProviderSchemaNix,
+
+				KeyDerivations: {
+					Description: "List of derivations which is built during apply",
+					Type:        schema.TypeList,
+					Elem:        &schema.Resource{Schema: ProviderSchemaDerivationsComputedMap},
+					Optional:    true,
+					Computed:    true,
+				},
+				KeyImagePath: {
+					Description: "Path to the image file in Nix store",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
+				KeyImageSize: {
+					Description: "Image file size in bytes",
+					Type:        schema.TypeInt,
+					Computed:    true,
+				},
+				KeyImageSha256: {
+					Description: "Image file SHA256 checksum (hex encoded)",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
+			},
+		},
+		KeyNixosInstall: {
+			Description: "NixOS installation on the host running any Linux distribution (with kexec, disko & nixos-install), installs once and never touches the host on update",
+
+			CreateContext: install.Create,
+			ReadContext:   install.Read,
+			UpdateContext: install.Update,
+			DeleteContext: install.Delete,
+
+			Schema: map[string]*schema.Schema{
+				KeyAddress: {
+					Description: "List of server addresses (ip addresses, optionally with ipv6 zone like fe80::1%eth0, or hostnames resolved during apply)",
+					Type:        schema.TypeList,
+					Elem:        &schema.Schema{Type: schema.TypeString},
+					Required:    true,
+				},
+				KeySystem: {
+					Description: "Nix arch & target to build for (defaults to x86_64-linux)",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     "x86_64-linux",
+				},
+				KeySettings: {
+					Description: "Optional settings (encoded with HCL function jsonencode()) to pass into Nix configuration derivation as attribute set (any configuration key could be specified)",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     "{}",
+				},
+				KeyConfiguration: {
+					Description: "Path to Nix derivation",
+					Type:        schema.TypeString,
+					Required:    true,
+				},
+				KeyInstallDiskLayout: {
+					Description: "Path to the disko module describing disk layout of the host",
+					Type:        schema.TypeString,
+					Required:    true,
+				},
+				KeyInstallInstallerSettings: {
+					Description: "Optional settings (encoded with HCL function jsonencode()) for the kexec installer configuration (should contain root authorized keys)",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     "{}",
+				},
+				KeyInstallDisko: {
+					Description: "Path or tarball URL of the disko source (defaults to disko master branch tarball)",
+					Type:        schema.TypeString,
+					Optional:    true,
+				},
+				KeyInstallPhases: {
+					Description: fmt.Sprintf("List of install phases to run, available (all phases are run by default): %v", InstallPhases),
+					Type:        schema.TypeList,
+					Elem:        &schema.Schema{Type: schema.TypeString},
+					Optional:    true,
+				},
+				KeyInstallKexecTimeout: {
+					Description: "Amount of seconds to wait for the installer to boot after kexec",
+					Type:        schema.TypeInt,
+					Optional:    true,
+					Default:     300,
+				},
+
+				KeyNix:     ProviderSchemaNix,
+				KeySsh:     ProviderSchemaSsh,
+				KeyBastion: ProviderSchemaBastion,
+				KeyBecome:  ProviderSchemaBecome,
+
+				KeyDerivations: {
+					Description: "List of derivations which is built during apply",
+					Type:        schema.TypeList,
+					Elem:        &schema.Resource{Schema: ProviderSchemaDerivationsComputedMap},
+					Optional:    true,
+					Computed:    true,
+				},
+			},
+		},
+		KeyNixosSecrets: {
+			Description: "NixOS instance secrets (deployed independently of the system configuration)",
+
+			CustomizeDiff: secretsResource.Diff,
+			CreateContext: secretsResource.Create,
+			ReadContext:   secretsResource.Read,
+			UpdateContext: secretsResource.Update,
+			DeleteContext: secretsResource.Delete,
+
+			Schema: map[string]*schema.Schema{
+				KeyAddress: {
+					Description: "List of server addresses (ip addresses, optionally with ipv6 zone like fe80::1%eth0, or hostnames resolved during apply)",
+					Type:        schema.TypeList,
+					Elem:        &schema.Schema{Type: schema.TypeString},
+					Required:    true,
+				},
+
+				KeySsh:     ProviderSchemaSsh,
+				KeyBastion: ProviderSchemaBastion,
+				KeyBecome:  ProviderSchemaBecome,
+				KeySecrets: ProviderSchemaSecrets,
+				KeySecret:  ProviderSchemaSecret,
+
+				KeySecretFingerprint: ProviderSchemaSecretFingerprint,
+			},
+		},
+	}
+
+	ProviderDataSourceMap = map[string]*schema.Resource{
+		KeyNixosHostFacts: {
+			Description: "Facts about the NixOS host gathered over SSH",
+
+			ReadContext: hostFacts.Read,
+
+			Schema: map[string]*schema.Schema{
+				KeyAddress: {
+					Description: "List of server addresses (ip addresses, optionally with ipv6 zone like fe80::1%eth0, or hostnames resolved during apply)",
+					Type:        schema.TypeList,
+					Elem:        &schema.Schema{Type: schema.TypeString},
+					Required:    true,
+				},
+
+				KeySsh:     ProviderSchemaSsh,
+				KeyBastion: ProviderSchemaBastion,
+				KeyBecome:  ProviderSchemaBecome,
+
+				KeyHostFactsNixosVersion: {
+					Description: "NixOS version reported by nixos-version",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
+				KeySystem: {
+					Description: "Nix system of the host (mapped from uname -m)",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
+				KeyHostFactsCurrentSystem: {
+					Description: "Store path of the currently activated system",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
+				KeyHostFactsBootedSystem: {
+					Description: "Store path of the booted system",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
+				KeyHostFactsHostKeys: {
+					Description: "Map of SSH host public keys by key type",
+					Type:        schema.TypeMap,
+					Elem:        &schema.Schema{Type: schema.TypeString},
+					Computed:    true,
+				},
+				KeyHostFactsInterfaces: {
+					Description: "List of network interfaces with assigned addresses (in CIDR notation)",
+					Type:        schema.TypeList,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							KeyHostFactsInterfaceName: {
+								Description: "Network interface name",
+								Type:        schema.TypeString,
+								Computed:    true,
+							},
+							KeyHostFactsInterfaceAddresses: {
+								Description: "List of network interface addresses (in CIDR notation)",
+								Type:        schema.TypeList,
+								Elem:        &schema.Schema{Type: schema.TypeString},
+								Computed:    true,
+							},
+						},
+					},
+					Computed: true,
+				},
+				KeyHostFactsAddresses: {
+					Description: "List of global scope addresses of the host",
+					Type:        schema.TypeList,
+					Elem:        &schema.Schema{Type: schema.TypeString},
+					Computed:    true,
+				},
+				KeyHostFactsHardwareConfiguration: {
+					Description: "Output of nixos-generate-config --show-hardware-config",
+					Type:        schema.TypeString,
+					Computed:    true,
+				},
+			},
+		},
 	}
 
 	ProviderSchema = schema.Provider{
-		Schema:       ProviderSchemaMap,
-		ResourcesMap: ProviderResourceMap,
+		Schema:         ProviderSchemaMap,
+		ResourcesMap:   ProviderResourceMap,
+		DataSourcesMap: ProviderDataSourceMap,
 	}
 )
 
@@ -478,16 +1312,9 @@ func New() *schema.Provider {
 				Summary:  err.Error(),
 			}}
 		}
-		go func() {
-			// FIXME: dear hashicorp dumbtards
-			// how the fuck should people deallocate resources (tmp files, etc)
-			// which was allocated by the provider?
-			// (how I should call close()???)
-			//
-			// looks like this is working (for everything but not for panics!)
-			<-ctx.Done()
-			p.Close()
-		}()
+		// NOTE: configure context is cancelled right after configuration,
+		// resources are released on plugin exit (see CloseProviders)
+		registerProvider(p)
 
 		return p, nil
 	}
@@ -75,7 +75,7 @@ func DefaultAddressPriority() (interface{}, error) {
 	return map[string]interface{}{
 		"0.0.0.0/0": 1,
 		"::/0":      0,
-		// TODO: we could rearrange if we implement some way to check ipv6 connectivity
-		// because sometimes we have ipv6 address, but it is broken for some reason (misconfigured, etc)
+		// NOTE: sometimes we have ipv6 address, but it is broken for some reason (misconfigured, etc)
+		// address_probe could be enabled to pick reachable address instead of relying on priority
 	}, nil
 }
@@ -108,6 +108,36 @@ resource "nixos_instance" "test3" {
 }
 `
 
+const nixosConfig4 = `
+provider "nixos" {
+  retry = 0
+  ssh {
+    port = 2222
+    config = {
+      userKnownHostsFile = "/dev/null"
+      strictHostKeyChecking = "no"
+      pubKeyAuthentication = "no"
+      passwordAuthentication = "yes"
+    }
+  }
+  secrets {
+    provider = "command"
+    command {
+      name = "echo"
+      arguments = ["here is your node key"]
+    }
+  }
+}
+
+resource "nixos_secrets" "test4" {
+  address = ["127.0.0.1", "::1"]
+  secret {
+    source = "node-key"
+    destination = "/root/secrets/node-key"
+  }
+}
+`
+
 //
 
 func CheckEqual(t *testing.T, name, key string, value interface{}) resource.TestCheckFunc {
@@ -165,6 +195,13 @@ func TestResourceNixosInstance(t *testing.T) {
 						CheckEqual(t, "nixos_instance.test3", "configuration", "../test/test.nix"),
 					),
 				},
+				{
+					Config: nixosConfig4,
+					Check: resource.ComposeTestCheckFunc(
+						CheckEqual(t, "nixos_secrets.test4", "address.0", "127.0.0.1"),
+						CheckEqual(t, "nixos_secrets.test4", "secret.#", "1"),
+					),
+				},
 			},
 		},
 	)
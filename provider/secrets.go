@@ -1,14 +1,16 @@
 package provider
 
 import (
-	"archive/tar"
 	"bytes"
 	"crypto/sha256"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
-	"time"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"encoding/hex"
 
@@ -18,11 +20,36 @@ import (
 
 type (
 	SecretDescription struct {
-		Source      string
+		Source string
+		// Content is used instead of Source if it is not nil (secrets provider is not used).
+		Content []byte
+		// Template is rendered instead of Source if it is not empty,
+		// Values are references to secrets which are available in the template.
+		Template    string
+		Values      map[string]string
 		Destination string
 		Owner       string
 		Group       string
 		Permissions int
+		// DirectoryOwner, DirectoryGroup & DirectoryPermissions are used to create missing parent directories.
+		DirectoryOwner       string
+		DirectoryGroup       string
+		DirectoryPermissions int
+		// Files are owner, group & permissions overrides for files of the directory source.
+		Files []*SecretFileRule
+		// Directory is a destination of the directory secret this file belongs to
+		// (empty for secrets which are not from directory).
+		Directory string
+		// OnChange is executed after installation if secret fingerprint changed.
+		OnChange *SecretHook
+	}
+	// SecretFileRule overrides owner, group & permissions (if they are not empty)
+	// of files matching the pattern (base name is matched if pattern has no slashes).
+	SecretFileRule struct {
+		Pattern     string
+		Owner       string
+		Group       string
+		Permissions int
 	}
 	SecretData struct {
 		*LockedBuffer
@@ -33,8 +60,20 @@ type (
 
 	Secrets struct {
 		Provider SecretsProvider
-		Secrets  SecretsDescriptions
-		data     SecretsData
+		// ProviderByName returns other configured secrets provider (used by templates).
+		ProviderByName func(name string) (SecretsProvider, error)
+		Secrets        SecretsDescriptions
+		// Tmpfs are roots of secrets which are installed into in-memory generations (/run/secrets).
+		Tmpfs []string
+		// Deployed are files of directory secrets which were installed previously (by directory),
+		// files which disappeared from the source directory are removed from the target.
+		Deployed map[string][]string
+		// DeployedOrigins are origins of the secrets which were installed previously,
+		// they are replaced in tmpfs generations, other entries (of other resources) are carried over.
+		DeployedOrigins []string
+		data            SecretsData
+		// directories are files of directory secrets (by directory), filled when secrets are expanded.
+		directories map[string][]string
 	}
 
 	SecretsProviderName string
@@ -42,6 +81,12 @@ type (
 		Name() string
 		Get(source string) ([]byte, error)
 	}
+	// SecretsDirectoryProvider is implemented by providers which support directory sources.
+	SecretsDirectoryProvider interface {
+		// List returns relative paths of files under the source directory in lexical order,
+		// nil if source is not a directory.
+		List(source string) ([]string, error)
+	}
 	SecretsProviderFilesystem struct{}
 	SecretsProviderCommand    struct {
 		Command     string
@@ -55,6 +100,7 @@ type (
 	SecretsCopy struct {
 		*RemoteCommand
 		Secrets *Secrets
+		Install *SecretsInstall
 	}
 	SecretsCopyOption func(*SecretsCopy)
 )
@@ -65,6 +111,9 @@ const (
 	SecretsProviderNameFilesystem SecretsProviderName = "filesystem"
 	SecretsProviderNameCommand    SecretsProviderName = "command"
 	SecretsProviderNameGopass     SecretsProviderName = "gopass"
+	SecretsProviderNameAge        SecretsProviderName = "age"
+	SecretsProviderNameSops       SecretsProviderName = "sops"
+	SecretsProviderNameVault      SecretsProviderName = "vault"
 )
 
 var (
@@ -72,11 +121,78 @@ var (
 		string(SecretsProviderNameFilesystem),
 		string(SecretsProviderNameCommand),
 		string(SecretsProviderNameGopass),
+		string(SecretsProviderNameAge),
+		string(SecretsProviderNameSops),
+		string(SecretsProviderNameVault),
 	}
 )
 
 //
 
+// Name returns human readable secret name for messages (inline content is never exposed).
+func (s *SecretDescription) Name() string {
+	if s.Content != nil {
+		return "inline content of " + s.Destination
+	}
+	if s.Template != "" {
+		return "template of " + s.Destination
+	}
+	return s.Source
+}
+
+// Origin returns destination of the secret as it was described
+// (destination of the directory for files from directory sources).
+func (s *SecretDescription) Origin() string {
+	if s.Directory != "" {
+		return s.Directory
+	}
+	return s.Destination
+}
+
+// Match reports whether relative path of the file matches rule pattern.
+func (r *SecretFileRule) Match(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if !strings.Contains(r.Pattern, "/") {
+		rel = path.Base(rel)
+	}
+	ok, _ := path.Match(r.Pattern, rel)
+	return ok
+}
+
+// File returns description of the file from directory source, file rules are applied in order.
+func (s *SecretDescription) File(rel string) *SecretDescription {
+	file := &SecretDescription{
+		Source:      filepath.Join(s.Source, rel),
+		Destination: path.Join(s.Destination, filepath.ToSlash(rel)),
+		Owner:       s.Owner,
+		Group:       s.Group,
+		Permissions: s.Permissions,
+
+		DirectoryOwner:       s.DirectoryOwner,
+		DirectoryGroup:       s.DirectoryGroup,
+		DirectoryPermissions: s.DirectoryPermissions,
+
+		Directory: s.Destination,
+	}
+	for _, rule := range s.Files {
+		if !rule.Match(rel) {
+			continue
+		}
+		if rule.Owner != "" {
+			file.Owner = rule.Owner
+		}
+		if rule.Group != "" {
+			file.Group = rule.Group
+		}
+		if rule.Permissions != 0 {
+			file.Permissions = rule.Permissions
+		}
+	}
+	return file
+}
+
+//
+
 func (s *SecretData) Hash(salt []byte, iter int) []byte {
 	return pbkdf2.Key(
 		s.Bytes(), salt, iter, SecretDataKeyLen,
@@ -93,6 +209,10 @@ func (s *SecretData) HashString(salt []byte, iter int) string {
 func (s SecretsData) Hash(salt []byte, iter int) []byte {
 	h := sha256.New()
 	for _, secret := range s {
+		if secret.Directory != "" {
+			// NOTE: files from directories are renamed & removed, so their names are fingerprinted too
+			_, _ = h.Write([]byte(secret.Destination))
+		}
 		_, _ = h.Write(secret.Hash(salt, iter))
 	}
 	return h.Sum(nil)
@@ -102,6 +222,19 @@ func (s SecretsData) HashString(salt []byte, iter int) string {
 	return hex.EncodeToString(s.Hash(salt, iter))
 }
 
+// Fingerprints returns hash of each described secret by its origin.
+func (s SecretsData) Fingerprints(salt []byte, iter int) map[string][]byte {
+	origins := map[string]SecretsData{}
+	for _, secret := range s {
+		origins[secret.Origin()] = append(origins[secret.Origin()], secret)
+	}
+	fingerprints := make(map[string][]byte, len(origins))
+	for origin, data := range origins {
+		fingerprints[origin] = data.Hash(salt, iter)
+	}
+	return fingerprints
+}
+
 func (s SecretsData) Destroy() {
 	for _, secret := range s {
 		secret.Destroy()
@@ -143,6 +276,46 @@ func (p *SecretsProviderFilesystem) Get(source string) ([]byte, error) {
 	return buf, nil
 }
 
+func (p *SecretsProviderFilesystem) List(source string) ([]string, error) {
+	stat, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, nil
+	}
+
+	files := []string{}
+	err = filepath.Walk(source, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// NOTE: symlinks to files are followed, symlinks to directories are not
+			info, err = os.Stat(name)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(source, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list files of directory %q", source)
+	}
+	return files, nil
+}
+
 func NewSecretsProviderFilesystem() *SecretsProviderFilesystem {
 	return &SecretsProviderFilesystem{}
 }
@@ -211,83 +384,171 @@ func (s *Secrets) fromOctal(n int) int {
 	return res
 }
 
-func (s *Secrets) Tar() (io.Reader, error) {
-	buf := bytes.NewBuffer(nil)
-	w := tar.NewWriter(buf)
-	defer w.Close()
+func (s *Secrets) Data() (SecretsData, error) {
+	if s.data != nil {
+		return s.data, nil
+	}
 
-	data, err := s.Data()
+	secrets, err := s.expand()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, secret := range data {
-		err := w.WriteHeader(&tar.Header{
-			Name:    secret.Destination,
-			Size:    int64(secret.Size()),
-			Uname:   secret.Owner,
-			Gname:   secret.Group,
-			Mode:    int64(s.fromOctal(secret.Permissions)),
-			ModTime: time.Now(),
-		})
+	data := make(SecretsData, len(secrets))
+	for n, secret := range secrets {
+		var (
+			buf []byte
+			err error
+		)
+		switch {
+		case secret.Content != nil:
+			// NOTE: locked buffer wipes memory it was created from, description should stay intact
+			buf = make([]byte, len(secret.Content))
+			copy(buf, secret.Content)
+		case secret.Template != "":
+			buf, err = s.render(secret)
+		default:
+			buf, err = s.Provider.Get(secret.Source)
+			if err != nil {
+				err = errors.Wrapf(
+					err, "failed to get secret %q from provider %q",
+					secret.Source, s.Provider.Name(),
+				)
+			}
+		}
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to write tar header of %q", secret.Source)
+			// NOTE: destroy memory in case of error
+			for _, secret := range data[:n] {
+				secret.Destroy()
+			}
+			return nil, err
 		}
 
-		_, err = w.Write(secret.Bytes())
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to write contents of %q into tar writer", secret.Source)
+		data[n] = &SecretData{
+			LockedBuffer:      NewLockedBuffer(buf),
+			SecretDescription: secret,
 		}
 	}
 
-	return buf, nil
+	s.data = data
+	return data, nil
 }
 
-func (s *Secrets) Data() (SecretsData, error) {
-	if s.data != nil {
-		return s.data, nil
+// expand replaces directory sources with descriptions of files they contain.
+func (s *Secrets) expand() (SecretsDescriptions, error) {
+	s.directories = map[string][]string{}
+	directories, ok := s.Provider.(SecretsDirectoryProvider)
+	if !ok {
+		return s.Secrets, nil
 	}
 
-	data := make(SecretsData, len(s.Secrets))
-	for n, secret := range s.Secrets {
-		buf, err := s.Provider.Get(secret.Source)
+	secrets := make(SecretsDescriptions, 0, len(s.Secrets))
+	for _, secret := range s.Secrets {
+		if secret.Source == "" || secret.Content != nil || secret.Template != "" {
+			secrets = append(secrets, secret)
+			continue
+		}
+		files, err := directories.List(secret.Source)
 		if err != nil {
-			// NOTE: destroy memory in case of error
-			for _, secret := range data[:n] {
-				secret.Destroy()
-			}
 			return nil, errors.Wrapf(
 				err, "failed to get secret %q from provider %q",
 				secret.Source, s.Provider.Name(),
 			)
 		}
+		if files == nil {
+			secrets = append(secrets, secret)
+			continue
+		}
+		// NOTE: empty directory is recorded too, so files deployed from it before are removed
+		s.directories[secret.Destination] = []string{}
+		for _, file := range files {
+			file := secret.File(file)
+			secrets = append(secrets, file)
+			s.directories[secret.Destination] = append(s.directories[secret.Destination], file.Destination)
+		}
+	}
+	return secrets, nil
+}
 
-		data[n] = &SecretData{
-			LockedBuffer:      NewLockedBuffer(buf),
-			SecretDescription: secret,
+// Directories returns destinations of the directory secrets files (by directory destination).
+func (s *Secrets) Directories() (map[string][]string, error) {
+	_, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+	return s.directories, nil
+}
+
+// SecretsRemoved returns files which were deployed previously
+// but are not in the current files of the same directory (by directory),
+// all files are returned for directories which are not deployed anymore.
+func SecretsRemoved(previous map[string][]string, current map[string][]string) map[string][]string {
+	removed := map[string][]string{}
+	for directory, files := range previous {
+		keep := make(map[string]bool, len(current[directory]))
+		for _, file := range current[directory] {
+			keep[file] = true
+		}
+		for _, file := range files {
+			if !keep[file] && strings.HasPrefix(file, directory+"/") {
+				removed[directory] = append(removed[directory], file)
+			}
 		}
 	}
+	return removed
+}
 
-	s.data = data
-	return data, nil
+// SecretsCleanupScript returns shell script which removes files from destination directories
+// and parent directories of these files which become empty (destination directories are kept).
+func SecretsCleanupScript(directories map[string][]string) string {
+	names := make([]string, 0, len(directories))
+	for directory := range directories {
+		names = append(names, directory)
+	}
+	sort.Strings(names)
+
+	script := bytes.NewBuffer(nil)
+	script.WriteString("set -e\n")
+	for _, directory := range names {
+		parents := map[string]bool{}
+		for _, file := range directories[directory] {
+			fmt.Fprintf(script, "rm -f -- %s\n", ShellQuote(file))
+			for dir := path.Dir(file); strings.HasPrefix(dir, directory+"/"); dir = path.Dir(dir) {
+				parents[dir] = true
+			}
+		}
+		empty := make([]string, 0, len(parents))
+		for dir := range parents {
+			empty = append(empty, dir)
+		}
+		// NOTE: nested directories go first
+		sort.Sort(sort.Reverse(sort.StringSlice(empty)))
+		for _, dir := range empty {
+			fmt.Fprintf(script, "rmdir -- %s 2>/dev/null || true\n", ShellQuote(dir))
+		}
+	}
+	return script.String()
 }
 
 func (s *Secrets) Copy(ssh *Ssh) (*SecretsCopy, error) {
-	stream, err := s.Tar()
+	install, err := NewSecretsInstall(s)
 	if err != nil {
 		return nil, err
 	}
-
-	c := &SecretsCopy{
-		RemoteCommand: NewRemoteCommand(ssh, NewTar(
-			TarOptionExtract(),
-			TarOptionChDir("/"),
-			TarOptionCommandOptions(CommandOptionStdin(stream)),
-		)),
-		Secrets: s,
+	stream, err := install.Tar()
+	if err != nil {
+		return nil, err
 	}
 
-	return c, nil
+	return &SecretsCopy{
+		RemoteCommand: NewRemoteCommand(ssh, &StringCommand{
+			Cmd:       "sh",
+			Arguments: []string{"-c", ShellQuote(install.Script())},
+			Options:   []CommandOption{CommandOptionStdin(stream)},
+		}),
+		Secrets: s,
+		Install: install,
+	}, nil
 }
 
 func (s *Secrets) Close() error {
@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"github.com/awnumar/memguard"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+type (
+	// SecretsProviderAge decrypts age encrypted files (binary or armored) in-process.
+	SecretsProviderAge struct {
+		// IdentityFiles are age identity files or ssh private keys (ed25519, rsa).
+		IdentityFiles []string
+		// IdentityProvider retrieves identity from IdentitySource (optional).
+		IdentityProvider SecretsProvider
+		IdentitySource   string
+
+		identitiesOnce sync.Once
+		identities     []age.Identity
+		identitiesErr  error
+	}
+)
+
+// AgeParseIdentities parses age identities (one per line) or a PEM encoded ssh private key.
+// NOTE: passphrase protected ssh keys are not supported, because there is no way to ask for a passphrase.
+func AgeParseIdentities(buf []byte) ([]age.Identity, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(buf), []byte("-----BEGIN")) {
+		return age.ParseIdentities(bytes.NewReader(buf))
+	}
+
+	identity, err := agessh.ParseIdentity(buf)
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, errors.New("passphrase protected ssh keys are not supported")
+		}
+		return nil, err
+	}
+	return []age.Identity{identity}, nil
+}
+
+func (p *SecretsProviderAge) Name() string {
+	return string(SecretsProviderNameAge)
+}
+
+func (p *SecretsProviderAge) loadIdentities() ([]age.Identity, error) {
+	identities := []age.Identity{}
+	for _, path := range p.IdentityFiles {
+		buf, err := ioutil.ReadFile(os.ExpandEnv(path))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read age identity file %q", path)
+		}
+		parsed, err := AgeParseIdentities(buf)
+		memguard.WipeBytes(buf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse age identity file %q", path)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if p.IdentityProvider != nil && p.IdentitySource != "" {
+		buf, err := p.IdentityProvider.Get(p.IdentitySource)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err, "failed to get age identity %q from provider %q",
+				p.IdentitySource, p.IdentityProvider.Name(),
+			)
+		}
+		parsed, err := AgeParseIdentities(buf)
+		memguard.WipeBytes(buf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse age identity %q", p.IdentitySource)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("no age identities configured")
+	}
+	return identities, nil
+}
+
+// Identities returns identities used to decrypt secrets,
+// they are loaded once for the lifetime of the provider.
+func (p *SecretsProviderAge) Identities() ([]age.Identity, error) {
+	p.identitiesOnce.Do(func() {
+		p.identities, p.identitiesErr = p.loadIdentities()
+	})
+	return p.identities, p.identitiesErr
+}
+
+func (p *SecretsProviderAge) Get(source string) ([]byte, error) {
+	identities, err := p.Identities()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		in     = bufio.NewReader(file)
+		reader io.Reader
+	)
+	header, _ := in.Peek(len(armor.Header))
+	if string(header) == armor.Header {
+		reader = armor.NewReader(in)
+	} else {
+		reader = in
+	}
+
+	decrypted, err := age.Decrypt(reader, identities...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt %q", source)
+	}
+	buf, err := ioutil.ReadAll(decrypted)
+	if err != nil {
+		memguard.WipeBytes(buf)
+		return nil, errors.Wrapf(err, "failed to decrypt %q", source)
+	}
+
+	return buf, nil
+}
+
+func NewSecretsProviderAge(identityFiles []string, identityProvider SecretsProvider, identitySource string) *SecretsProviderAge {
+	return &SecretsProviderAge{
+		IdentityFiles:    identityFiles,
+		IdentityProvider: identityProvider,
+		IdentitySource:   identitySource,
+	}
+}
+
+var (
+	_ SecretsProvider = &SecretsProviderAge{}
+)
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func ageEncrypt(t *testing.T, path string, armored bool, plaintext string, recipients ...age.Recipient) {
+	var (
+		buf           = bytes.NewBuffer(nil)
+		out io.Writer = buf
+		a   io.WriteCloser
+	)
+	if armored {
+		a = armor.NewWriter(buf)
+		out = a
+	}
+	w, err := age.Encrypt(out, recipients...)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(plaintext))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	if a != nil {
+		assert.NoError(t, a.Close())
+	}
+	assert.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0600))
+}
+
+func TestSecretsProviderAge(t *testing.T) {
+	dir := t.TempDir()
+
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	identityFile := filepath.Join(dir, "identity.txt")
+	assert.NoError(t, ioutil.WriteFile(identityFile, []byte("# test\n"+identity.String()+"\n"), 0600))
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	sshKeyFile := filepath.Join(dir, "id_rsa")
+	assert.NoError(t, ioutil.WriteFile(sshKeyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+	sshPublicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	sshRecipient, err := agessh.NewRSARecipient(sshPublicKey)
+	assert.NoError(t, err)
+
+	binary := filepath.Join(dir, "binary.age")
+	ageEncrypt(t, binary, false, "binary secret", identity.Recipient())
+	armored := filepath.Join(dir, "armored.age")
+	ageEncrypt(t, armored, true, "armored secret", sshRecipient)
+
+	provider := NewSecretsProviderAge([]string{identityFile, sshKeyFile}, nil, "")
+	buf, err := provider.Get(binary)
+	assert.NoError(t, err)
+	assert.Equal(t, "binary secret", string(buf))
+	buf, err = provider.Get(armored)
+	assert.NoError(t, err)
+	assert.Equal(t, "armored secret", string(buf))
+
+	provider = NewSecretsProviderAge(nil, NewSecretsProviderFilesystem(), sshKeyFile)
+	_, err = provider.Get(binary)
+	assert.ErrorContains(t, err, "failed to decrypt")
+	buf, err = provider.Get(armored)
+	assert.NoError(t, err)
+	assert.Equal(t, "armored secret", string(buf))
+
+	_, err = NewSecretsProviderAge(nil, nil, "").Get(binary)
+	assert.ErrorContains(t, err, "no age identities configured")
+}
@@ -0,0 +1,152 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+)
+
+type (
+	// SecretHook describes actions which should be taken on the target when secret changes.
+	SecretHook struct {
+		RestartUnits []string
+		ReloadUnits  []string
+		Command      string
+	}
+	// SecretHookError is a failure of the hook of the secret with Origin.
+	SecretHookError struct {
+		Origin string
+		Err    error
+	}
+	// SecretsHookErrors are failures of the secrets hooks, each error belongs to a single secret.
+	SecretsHookErrors []*SecretHookError
+)
+
+// Script returns shell script which runs hook actions in order: restart, reload, command.
+func (h *SecretHook) Script() string {
+	script := bytes.NewBuffer(nil)
+	script.WriteString("set -e\n")
+	for _, action := range []struct {
+		name  string
+		units []string
+	}{
+		{"restart", h.RestartUnits},
+		{"reload", h.ReloadUnits},
+	} {
+		if len(action.units) == 0 {
+			continue
+		}
+		units := make([]string, len(action.units))
+		for n, unit := range action.units {
+			units[n] = ShellQuote(unit)
+		}
+		fmt.Fprintf(script, "systemctl %s %s\n", action.name, strings.Join(units, " "))
+	}
+	if h.Command != "" {
+		script.WriteString(h.Command)
+		script.WriteString("\n")
+	}
+	return script.String()
+}
+
+// Empty reports whether hook has nothing to do.
+func (h *SecretHook) Empty() bool {
+	return h == nil || (len(h.RestartUnits) == 0 && len(h.ReloadUnits) == 0 && h.Command == "")
+}
+
+//
+
+func (e *SecretHookError) Error() string {
+	return fmt.Sprintf("failed to run %q hook of secret %q: %s", KeySecretOnChange, e.Origin, e.Err)
+}
+
+func (e *SecretHookError) Unwrap() error { return e.Err }
+
+//
+
+func (e SecretsHookErrors) Error() string {
+	messages := make([]string, len(e))
+	for n, err := range e {
+		messages[n] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e SecretsHookErrors) Diagnostics() diag.Diagnostics {
+	diagnostics := make(diag.Diagnostics, len(e))
+	for n, err := range e {
+		diagnostics[n] = diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  err.Error(),
+		}
+	}
+	return diagnostics
+}
+
+// Origins returns origins of the secrets which hooks failed.
+func (e SecretsHookErrors) Origins() map[string]bool {
+	origins := make(map[string]bool, len(e))
+	for _, err := range e {
+		origins[err.Origin] = true
+	}
+	return origins
+}
+
+//
+
+// SecretsChanged returns origins of the secrets which fingerprints differ from previous fingerprints,
+// previous is a map of hex encoded fingerprints by origin (secrets which are not in previous are changed).
+func SecretsChanged(data SecretsData, previous map[string]string, salt []byte, iter int) map[string]bool {
+	changed := map[string]bool{}
+	for origin, fingerprint := range data.Fingerprints(salt, iter) {
+		if previous[origin] != fmt.Sprintf("%x", fingerprint) {
+			changed[origin] = true
+		}
+	}
+	return changed
+}
+
+// RunSecretsHooks executes on_change hooks of the changed secrets (by origin) on the target,
+// each hook is executed even if others fail.
+func (p *Provider) RunSecretsHooks(ctx context.Context, resource ResourceBox, secrets *Secrets, changed map[string]bool) error {
+	hooks := SecretsDescriptions{}
+	for _, secret := range secrets.Secrets {
+		if changed[secret.Destination] && !secret.OnChange.Empty() {
+			hooks = append(hooks, secret)
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+	sort.SliceStable(hooks, func(n, m int) bool {
+		return hooks[n].Destination < hooks[m].Destination
+	})
+
+	address, err := p.ResourceAddress(ctx, resource)
+	if err != nil {
+		return err
+	}
+	ssh, err := p.NewSshHost(ctx, resource, address.String())
+	if err != nil {
+		return err
+	}
+	defer ssh.Close()
+
+	errs := SecretsHookErrors{}
+	for _, secret := range hooks {
+		command := NewRemoteCommand(ssh, CommandFromString("sh", "-c", ShellQuote(secret.OnChange.Script())))
+		err = command.Execute(nil)
+		command.Close()
+		if err != nil {
+			errs = append(errs, &SecretHookError{Origin: secret.Destination, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
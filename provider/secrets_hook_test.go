@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretHookScript(t *testing.T) {
+	hook := &SecretHook{
+		RestartUnits: []string{"app.service", "it's.service"},
+		ReloadUnits:  []string{"nginx.service"},
+		Command:      "touch /run/app/reload",
+	}
+	assert.Equal(
+		t,
+		"set -e\nsystemctl restart app.service 'it'\"'\"'s.service'\nsystemctl reload nginx.service\ntouch /run/app/reload\n",
+		hook.Script(),
+	)
+	assert.False(t, hook.Empty())
+	assert.True(t, (&SecretHook{}).Empty())
+	assert.True(t, (*SecretHook)(nil).Empty())
+}
+
+func TestSecretsChanged(t *testing.T) {
+	newData := func(values [][2]string) SecretsData {
+		data := SecretsData{}
+		for _, value := range values {
+			destination := value[0]
+			description := &SecretDescription{Destination: destination}
+			if destination != "/run/keys/db" {
+				description.Directory = "/run/keys/tls"
+			}
+			data = append(data, &SecretData{
+				LockedBuffer:      NewLockedBuffer([]byte(value[1])),
+				SecretDescription: description,
+			})
+		}
+		return data
+	}
+
+	data := newData([][2]string{
+		{"/run/keys/db", "hunter2"},
+		{"/run/keys/tls/cert.pem", "certificate"},
+		{"/run/keys/tls/key.pem", "key"},
+	})
+	defer data.Destroy()
+	directories := map[string][]string{"/run/keys/tls": {"/run/keys/tls/cert.pem", "/run/keys/tls/key.pem"}}
+	fingerprint, err := instance.secretsFingerprintToSchema(data, directories, nil, 0, nil)
+	assert.NoError(t, err)
+
+	deployed, err := instance.secretsDeployed(fingerprint)
+	assert.NoError(t, err)
+	assert.Equal(t, directories, deployed)
+	deployed, err = instance.secretsDeployed(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, deployed)
+
+	changed, err := instance.secretsChanged(nil, data)
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+	changed, err = instance.secretsChanged(fingerprint, data)
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+
+	rotated := newData([][2]string{
+		{"/run/keys/db", "hunter2"},
+		{"/run/keys/tls/cert.pem", "certificate"},
+		{"/run/keys/tls/key.pem", "rotated key"},
+	})
+	defer rotated.Destroy()
+	changed, err = instance.secretsChanged(fingerprint, rotated)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"/run/keys/tls": true}, changed)
+
+	// NOTE: failed hooks keep previous fingerprints, so they are executed again on the next apply
+	bothRotated := newData([][2]string{
+		{"/run/keys/db", "rotated password"},
+		{"/run/keys/tls/cert.pem", "certificate"},
+		{"/run/keys/tls/key.pem", "rotated key"},
+	})
+	defer bothRotated.Destroy()
+	errs := SecretsHookErrors{{Origin: "/run/keys/tls", Err: errors.New("unit failed")}}
+	assert.Equal(t, map[string]bool{"/run/keys/tls": true}, errs.Origins())
+	assert.EqualError(t, errs, `failed to run "on_change" hook of secret "/run/keys/tls": unit failed`)
+	retry, err := instance.secretsFingerprintRetry(fingerprint, bothRotated, directories, errs.Origins())
+	assert.NoError(t, err)
+	assert.Equal(t, fingerprint[KeySecretFingerprintSum], retry[KeySecretFingerprintSum])
+	changed, err = instance.secretsChanged(retry, bothRotated)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"/run/keys/tls": true}, changed)
+	retry, err = instance.secretsFingerprintRetry(nil, bothRotated, directories, errs.Origins())
+	assert.NoError(t, err)
+	assert.Nil(t, retry)
+
+	// NOTE: fingerprints saved without per secret fingerprints mark all secrets changed
+	delete(fingerprint, KeySecretFingerprintSecrets)
+	changed, err = instance.secretsChanged(fingerprint, data)
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+	changed, err = instance.secretsChanged(fingerprint, rotated)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"/run/keys/db": true, "/run/keys/tls": true}, changed)
+}
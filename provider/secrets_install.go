@@ -0,0 +1,322 @@
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	cryptoRand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// SecretsInstall is a plan of secrets installation on the target,
+	// secrets are staged next to their destinations and renamed atomically,
+	// secrets under tmpfs roots are written into a new generation which is switched with a symlink,
+	// entries of the previous generation which were not installed by this resource are carried over.
+	SecretsInstall struct {
+		Secrets *Secrets
+		Data    SecretsData
+		// Id is unique for each installation, it is used to name staged files & generations.
+		Id string
+	}
+)
+
+const (
+	SecretDefaultDirectoryOwner       = "root"
+	SecretDefaultDirectoryGroup       = "root"
+	SecretDefaultDirectoryPermissions = 755
+	// SecretsTmpfsPermissions are permissions of the tmpfs generations directory (same as sops-nix).
+	SecretsTmpfsPermissions = 751
+	// SecretsTmpfsLock serializes installations into tmpfs generations (roots may be shared by resources).
+	SecretsTmpfsLock = "/run/nixos-secrets.lock"
+
+	secretsGenerationsSuffix = ".d"
+)
+
+// TmpfsRoot returns tmpfs root which destination belongs to (empty if it does not belong to any).
+func (i *SecretsInstall) TmpfsRoot(destination string) string {
+	root := ""
+	for _, tmpfs := range i.Secrets.Tmpfs {
+		tmpfs = path.Clean(tmpfs)
+		if strings.HasPrefix(destination, tmpfs+"/") && len(tmpfs) > len(root) {
+			root = tmpfs
+		}
+	}
+	return root
+}
+
+// Generations returns directory tmpfs is mounted at.
+func (i *SecretsInstall) Generations(root string) string {
+	return root + secretsGenerationsSuffix
+}
+
+// Generation returns directory of the generation which is installed.
+func (i *SecretsInstall) Generation(root string) string {
+	return path.Join(i.Generations(root), i.Id)
+}
+
+// Path returns path secret is written to before it is installed.
+func (i *SecretsInstall) Path(secret *SecretData) string {
+	if root := i.TmpfsRoot(secret.Destination); root != "" {
+		return i.Generation(root) + strings.TrimPrefix(secret.Destination, root)
+	}
+	return path.Join(
+		path.Dir(secret.Destination),
+		"."+path.Base(secret.Destination)+"."+i.Id+".tmp",
+	)
+}
+
+func (i *SecretsInstall) Tar() (io.Reader, error) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	defer w.Close()
+
+	for _, secret := range i.Data {
+		err := w.WriteHeader(&tar.Header{
+			Name:    i.Path(secret),
+			Size:    int64(secret.Size()),
+			Uname:   secret.Owner,
+			Gname:   secret.Group,
+			Mode:    int64(i.Secrets.fromOctal(secret.Permissions)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to write tar header of %q", secret.Name())
+		}
+
+		_, err = w.Write(secret.Bytes())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to write contents of %q into tar writer", secret.Name())
+		}
+	}
+
+	return buf, nil
+}
+
+// ancestors returns parent directories of the path from the top (root is not included).
+func (i *SecretsInstall) ancestors(p string) []string {
+	ancestors := []string{}
+	for dir := path.Dir(p); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		ancestors = append([]string{dir}, ancestors...)
+	}
+	return ancestors
+}
+
+// Script returns shell script which installs secrets archive from stdin.
+func (i *SecretsInstall) Script() string {
+	var (
+		script      = bytes.NewBuffer(nil)
+		directories = map[string]bool{}
+		roots       = []string{}
+		mounted     = map[string]bool{}
+		owned       = map[string][]string{}
+		staged      = [][2]string{}
+		cleanup     = map[string][]string{}
+	)
+	// NOTE: removed secrets of tmpfs generation are not carried over, so there is nothing to remove in it,
+	// files of removed directories which are installed by other secrets now are kept
+	installed := make(map[string]bool, len(i.Data))
+	for _, secret := range i.Data {
+		installed[secret.Destination] = true
+	}
+	for directory, files := range SecretsRemoved(i.Secrets.Deployed, i.Secrets.directories) {
+		if i.TmpfsRoot(directory+"/") != "" {
+			continue
+		}
+		for _, file := range files {
+			if !installed[file] {
+				cleanup[directory] = append(cleanup[directory], file)
+			}
+		}
+	}
+	mkdir := func(dir, owner, group string, permissions int) {
+		if directories[dir] {
+			return
+		}
+		directories[dir] = true
+		fmt.Fprintf(
+			script, "[ -d %[1]s ] || install -d -o %[2]s -g %[3]s -m %[4]d %[1]s\n",
+			ShellQuote(dir), ShellQuote(owner), ShellQuote(group), permissions,
+		)
+	}
+
+	// NOTE: roots which have no secrets anymore are switched to the generation without them
+	for _, secret := range i.Data {
+		if root := i.TmpfsRoot(secret.Destination); root != "" && !mounted[root] {
+			mounted[root] = true
+			roots = append(roots, root)
+		}
+	}
+	for _, origin := range i.Secrets.DeployedOrigins {
+		root := i.TmpfsRoot(origin + "/")
+		if root == "" {
+			continue
+		}
+		if !mounted[root] {
+			mounted[root] = true
+			roots = append(roots, root)
+		}
+		owned[root] = append(owned[root], origin)
+	}
+	for _, secret := range i.Data {
+		if i.TmpfsRoot(secret.Destination) == "" {
+			staged = append(staged, [2]string{i.Path(secret), secret.Destination})
+		}
+	}
+
+	script.WriteString("set -e\numask 077\n")
+
+	// NOTE: staged files are removed if installation fails, so they are not left behind
+	remove := []string{}
+	for _, root := range roots {
+		remove = append(remove, "rm -rf -- "+ShellQuote(i.Generation(root)))
+	}
+	for _, file := range staged {
+		remove = append(remove, "rm -f -- "+ShellQuote(file[0]))
+	}
+	if len(remove) > 0 {
+		fmt.Fprintf(script, "trap %s EXIT\n", ShellQuote(strings.Join(remove, "; ")))
+	}
+
+	if len(roots) > 0 {
+		// NOTE: generations are switched one at a time, so entries of concurrent installations are carried over
+		fmt.Fprintf(script, "exec 9>%s\nflock 9\n", ShellQuote(SecretsTmpfsLock))
+	}
+	for n, root := range roots {
+		var (
+			generations = i.Generations(root)
+			generation  = i.Generation(root)
+		)
+		for _, dir := range i.ancestors(generations) {
+			mkdir(dir, SecretDefaultDirectoryOwner, SecretDefaultDirectoryGroup, SecretDefaultDirectoryPermissions)
+		}
+		mkdir(generations, SecretDefaultDirectoryOwner, SecretDefaultDirectoryGroup, SecretsTmpfsPermissions)
+		// NOTE: ramfs is never swapped to disk (tmpfs could be)
+		fmt.Fprintf(
+			script, "mountpoint -q %[1]s || mount -t ramfs -o mode=%[2]d ramfs %[1]s\n",
+			ShellQuote(generations), SecretsTmpfsPermissions,
+		)
+		fmt.Fprintf(
+			script, "if [ -e %[1]s ] && [ ! -L %[1]s ]; then echo %[2]s >&2; exit 1; fi\n",
+			ShellQuote(root), ShellQuote(root+" should be a symlink to the tmpfs generation, remove it to install secrets"),
+		)
+		fmt.Fprintf(script, "previous%d=$(readlink %s || true)\n", n, ShellQuote(root))
+		mkdir(generation, SecretDefaultDirectoryOwner, SecretDefaultDirectoryGroup, SecretDefaultDirectoryPermissions)
+
+		// NOTE: root may be shared with other resources, their entries are carried over from the previous generation,
+		// entries installed previously by this one are removed (they are written again unless they were removed)
+		var (
+			replaced = []string{}
+			carried  = true
+		)
+		for _, origin := range owned[root] {
+			relative := strings.TrimPrefix(origin, root)
+			if relative == "" {
+				carried = false
+				break
+			}
+			replaced = append(replaced, ShellQuote(generation+relative))
+		}
+		if !carried {
+			continue
+		}
+		fmt.Fprintf(
+			script, "if [ -d \"$previous%[1]d\" ]; then cp -a -- \"$previous%[1]d\"/. %[2]s/; fi\n",
+			n, ShellQuote(generation),
+		)
+		if len(replaced) > 0 {
+			fmt.Fprintf(script, "rm -rf -- %s\n", strings.Join(replaced, " "))
+		}
+	}
+
+	for _, secret := range i.Data {
+		var (
+			owner       = secret.DirectoryOwner
+			group       = secret.DirectoryGroup
+			permissions = secret.DirectoryPermissions
+			root        = i.TmpfsRoot(secret.Destination)
+		)
+		if owner == "" {
+			owner = SecretDefaultDirectoryOwner
+		}
+		if group == "" {
+			group = SecretDefaultDirectoryGroup
+		}
+		if permissions == 0 {
+			permissions = SecretDefaultDirectoryPermissions
+		}
+		for _, dir := range i.ancestors(i.Path(secret)) {
+			if root != "" && !strings.HasPrefix(dir, i.Generation(root)) {
+				continue
+			}
+			mkdir(dir, owner, group, permissions)
+		}
+	}
+
+	script.WriteString("tar -x -C /\n")
+	for _, file := range staged {
+		fmt.Fprintf(script, "mv -f -- %s %s\n", ShellQuote(file[0]), ShellQuote(file[1]))
+	}
+	for _, root := range roots {
+		var (
+			link       = ShellQuote(root + "." + i.Id + ".tmp")
+			generation = ShellQuote(i.Generation(root))
+		)
+		fmt.Fprintf(script, "ln -sfn %s %s\n", generation, link)
+		fmt.Fprintf(script, "mv -Tf %s %s\n", link, ShellQuote(root))
+	}
+	// NOTE: installed files & generations should not be removed by the trap after this point
+	if len(remove) > 0 {
+		script.WriteString("trap - EXIT\n")
+	}
+	for n, root := range roots {
+		var (
+			generation  = ShellQuote(i.Generation(root))
+			generations = ShellQuote(i.Generations(root))
+		)
+		// NOTE: current & previous generations are kept, so services which are reading secrets are not affected
+		fmt.Fprintf(
+			script, "for g in %s/*; do [ \"$g\" = %s ] || [ \"$g\" = \"$previous%d\" ] || rm -rf -- \"$g\"; done\n",
+			generations, generation, n,
+		)
+	}
+
+	if len(cleanup) > 0 {
+		fmt.Fprintf(script, "(\n%s)\n", SecretsCleanupScript(cleanup))
+	}
+
+	return script.String()
+}
+
+func NewSecretsInstall(secrets *Secrets) (*SecretsInstall, error) {
+	data, err := secrets.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	_, err = cryptoRand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: destinations are sorted, so directories are created in the same order
+	sorted := make(SecretsData, len(data))
+	copy(sorted, data)
+	sort.SliceStable(sorted, func(n, m int) bool {
+		return sorted[n].Destination < sorted[m].Destination
+	})
+
+	return &SecretsInstall{
+		Secrets: secrets,
+		Data:    sorted,
+		Id:      hex.EncodeToString(id),
+	}, nil
+}
@@ -0,0 +1,215 @@
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretsInstallPath(t *testing.T) {
+	secrets := NewSecrets(NewSecretsProviderFilesystem(), nil)
+	secrets.Tmpfs = []string{"/run/secrets", "/run/secrets/app"}
+	install := &SecretsInstall{Secrets: secrets, Id: "0123"}
+
+	for destination, expected := range map[string]string{
+		"/var/lib/app/key":          "/var/lib/app/.key.0123.tmp",
+		"/run/secrets/db":           "/run/secrets.d/0123/db",
+		"/run/secrets/app/tls/cert": "/run/secrets/app.d/0123/tls/cert",
+		"/run/secrets.key":          "/run/.secrets.key.0123.tmp",
+	} {
+		secret := &SecretData{SecretDescription: &SecretDescription{Destination: destination}}
+		assert.Equal(t, expected, install.Path(secret), destination)
+	}
+}
+
+func TestSecretsInstallScript(t *testing.T) {
+	secrets := NewSecrets(NewSecretsProviderFilesystem(), nil)
+	secrets.Tmpfs = []string{"/run/secrets", "/run/keys"}
+	secrets.DeployedOrigins = []string{"/run/keys/gone", "/run/secrets/db/password", "/run/secrets/old"}
+	install := &SecretsInstall{
+		Secrets: secrets,
+		Id:      "0123",
+		Data: SecretsData{
+			{SecretDescription: &SecretDescription{Destination: "/run/secrets/db/password"}},
+			{SecretDescription: &SecretDescription{
+				Destination:          "/var/lib/app/config/key",
+				DirectoryOwner:       "app",
+				DirectoryGroup:       "app",
+				DirectoryPermissions: 750,
+			}},
+		},
+	}
+
+	script := install.Script()
+	for _, expected := range []string{
+		"[ -d /run ] || install -d -o root -g root -m 755 /run\n",
+		"[ -d /run/secrets.d ] || install -d -o root -g root -m 751 /run/secrets.d\n",
+		"mountpoint -q /run/secrets.d || mount -t ramfs -o mode=751 ramfs /run/secrets.d\n",
+		"exec 9>/run/nixos-secrets.lock\nflock 9\n",
+		"if [ -d \"$previous0\" ]; then cp -a -- \"$previous0\"/. /run/secrets.d/0123/; fi\n",
+		"rm -rf -- /run/secrets.d/0123/db/password /run/secrets.d/0123/old\n",
+		"[ -d /run/secrets.d/0123/db ] || install -d -o root -g root -m 755 /run/secrets.d/0123/db\n",
+		"[ -d /var/lib/app/config ] || install -d -o app -g app -m 750 /var/lib/app/config\n",
+		"tar -x -C /\n",
+		"mv -f -- /var/lib/app/config/.key.0123.tmp /var/lib/app/config/key\n",
+		"mv -Tf /run/secrets.0123.tmp /run/secrets\n",
+		// NOTE: root which has no secrets anymore is switched to the generation without them
+		"[ -d /run/keys.d/0123 ] || install -d -o root -g root -m 755 /run/keys.d/0123\n",
+		"rm -rf -- /run/keys.d/0123/gone\n",
+		"mv -Tf /run/keys.0123.tmp /run/keys\n",
+	} {
+		assert.Contains(t, script, expected)
+	}
+	// NOTE: directories which are not in tmpfs generation are not created inside tmpfs root
+	assert.NotContains(t, script, "install -d -o root -g root -m 755 /run/secrets\n")
+	assert.Less(t, strings.Index(script, "tar -x"), strings.Index(script, "mv -f"))
+	// NOTE: entries of other resources are carried over before secrets of this one are written
+	assert.Less(t, strings.Index(script, "flock 9"), strings.Index(script, "cp -a"))
+	assert.Less(t, strings.Index(script, "rm -rf -- /run/secrets.d/0123/db/password"), strings.Index(script, "tar -x"))
+	// NOTE: trap is reset after the switch, so failed pruning of old generations does not remove installed one
+	assert.Less(t, strings.Index(script, "mv -Tf"), strings.Index(script, "trap - EXIT"))
+	assert.Less(t, strings.Index(script, "trap - EXIT"), strings.Index(script, "for g in /run/secrets.d/*"))
+}
+
+func TestSecretsInstallExecute(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("installation requires root to change ownership")
+	}
+
+	dir := t.TempDir()
+	destination := filepath.Join(dir, "app", "keys")
+	assert.NoError(t, os.MkdirAll(destination, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(destination, "stale"), []byte("stale"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(destination, "server.key"), []byte("old"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(destination, "foreign"), []byte("foreign"), 0600))
+	emptyDestination := filepath.Join(dir, "app", "empty")
+	assert.NoError(t, os.MkdirAll(filepath.Join(emptyDestination, "nested"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(emptyDestination, "nested", "gone"), []byte("gone"), 0600))
+	// NOTE: directory secret which is removed from configuration
+	removedDestination := filepath.Join(dir, "app", "removed")
+	assert.NoError(t, os.MkdirAll(removedDestination, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(removedDestination, "old.key"), []byte("old"), 0600))
+
+	source := filepath.Join(dir, "source")
+	assert.NoError(t, os.MkdirAll(source, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "server.key"), []byte("new"), 0600))
+	emptySource := filepath.Join(dir, "empty")
+	assert.NoError(t, os.MkdirAll(emptySource, 0700))
+
+	secrets := NewSecrets(NewSecretsProviderFilesystem(), SecretsDescriptions{
+		{Source: source, Destination: destination, Owner: "root", Group: "root", Permissions: 400},
+		{Source: emptySource, Destination: emptyDestination, Owner: "root", Group: "root", Permissions: 400},
+		{
+			Content:              []byte("token"),
+			Destination:          filepath.Join(dir, "other", "nested", "token"),
+			Owner:                "root",
+			Group:                "root",
+			Permissions:          600,
+			DirectoryPermissions: 710,
+		},
+	})
+	defer secrets.Close()
+	// NOTE: only files deployed previously are removed, foreign files are kept
+	secrets.Deployed = map[string][]string{
+		destination:        {filepath.Join(destination, "server.key"), filepath.Join(destination, "stale")},
+		emptyDestination:   {filepath.Join(emptyDestination, "nested", "gone")},
+		removedDestination: {filepath.Join(removedDestination, "old.key")},
+	}
+
+	install, err := NewSecretsInstall(secrets)
+	assert.NoError(t, err)
+	stream, err := install.Tar()
+	assert.NoError(t, err)
+	_, err = CommandExecute("sh", []string{"-c", install.Script()}, CommandOptionStdin(stream))
+	assert.NoError(t, err)
+
+	buf, err := ioutil.ReadFile(filepath.Join(destination, "server.key"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(buf))
+	buf, err = ioutil.ReadFile(filepath.Join(dir, "other", "nested", "token"))
+	assert.NoError(t, err)
+	assert.Equal(t, "token", string(buf))
+
+	info, err := os.Stat(filepath.Join(dir, "other", "nested"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0710), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(destination, "server.key"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0400), info.Mode().Perm())
+
+	files, err := ioutil.ReadDir(destination)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.Equal(t, []string{"foreign", "server.key"}, names)
+
+	files, err = ioutil.ReadDir(emptyDestination)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	files, err = ioutil.ReadDir(removedDestination)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSecretsInstallTmpfsExecute(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("installation requires root to mount ramfs")
+	}
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "secrets")
+	defer CommandExecute("umount", []string{root + secretsGenerationsSuffix})
+
+	install := func(origins []string, descriptions SecretsDescriptions) {
+		secrets := NewSecrets(NewSecretsProviderFilesystem(), descriptions)
+		defer secrets.Close()
+		secrets.Tmpfs = []string{root}
+		secrets.DeployedOrigins = origins
+
+		install, err := NewSecretsInstall(secrets)
+		assert.NoError(t, err)
+		stream, err := install.Tar()
+		assert.NoError(t, err)
+		_, err = CommandExecute("sh", []string{"-c", install.Script()}, CommandOptionStdin(stream))
+		if err != nil && strings.Contains(err.Error(), "mount") {
+			t.Skip("ramfs could not be mounted")
+		}
+		assert.NoError(t, err)
+	}
+	secret := func(name string) *SecretDescription {
+		return &SecretDescription{
+			Content:     []byte(name),
+			Destination: filepath.Join(root, name),
+			Owner:       "root",
+			Group:       "root",
+			Permissions: 400,
+		}
+	}
+	names := func() []string {
+		files, err := ioutil.ReadDir(root + "/")
+		assert.NoError(t, err)
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		return names
+	}
+
+	// NOTE: root is shared by two resources, each of them installs its own secret
+	install(nil, SecretsDescriptions{secret("first")})
+	install(nil, SecretsDescriptions{secret("second")})
+	assert.Equal(t, []string{"first", "second"}, names())
+
+	install([]string{filepath.Join(root, "first")}, SecretsDescriptions{secret("first"), secret("third")})
+	assert.Equal(t, []string{"first", "second", "third"}, names())
+
+	// NOTE: secrets removed from configuration are not carried over, even if no secrets are left under the root
+	install([]string{filepath.Join(root, "first"), filepath.Join(root, "third")}, nil)
+	assert.Equal(t, []string{"second"}, names())
+}
@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// SecretsResource deploys secrets independently of the system configuration,
+// so they could be rotated without building the system.
+type SecretsResource struct{}
+
+func (s SecretsResource) fail(err error) diag.Diagnostics {
+	return diag.Diagnostics{{
+		Severity: diag.Error,
+		Summary:  err.Error(),
+	}}
+}
+
+//
+
+func (s SecretsResource) Diff(ctx context.Context, resource *schema.ResourceDiff, meta interface{}) error {
+	return instance.diffSecrets(resource, meta.(*Provider))
+}
+
+func (s SecretsResource) Create(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	ctx = WithAddressCache(ctx)
+	provider := meta.(*Provider)
+
+	secrets, err := provider.NewSecrets(resource)
+	if err != nil {
+		return s.fail(err)
+	}
+	defer secrets.Close()
+	secretsData, err := secrets.Data()
+	if err != nil {
+		return s.fail(err)
+	}
+	previousFingerprint, _ := resource.GetChange(KeySecretFingerprint)
+	secretsChanged, err := instance.secretsChanged(previousFingerprint, secretsData)
+	if err != nil {
+		return s.fail(err)
+	}
+	secrets.Deployed, err = instance.secretsDeployed(previousFingerprint)
+	if err != nil {
+		return s.fail(err)
+	}
+	secrets.DeployedOrigins, err = instance.secretsDeployedOrigins(previousFingerprint)
+	if err != nil {
+		return s.fail(err)
+	}
+	secretsDirectories, err := secrets.Directories()
+	if err != nil {
+		return s.fail(err)
+	}
+
+	//
+
+	retry := provider.Get(KeyRetry).(int)
+	retryWait := time.Duration(provider.Get(KeyRetryWait).(int)) * time.Second
+	for {
+		err = provider.CopySecrets(ctx, resource, secrets)
+		if err == nil {
+			break
+		}
+		if retry > 0 {
+			retry--
+			time.Sleep(retryWait)
+			continue
+		}
+		return s.fail(err)
+	}
+
+	//
+
+	if resource.Id() == "" {
+		resource.SetId(instance.generateId())
+	}
+
+	secretsFingerprintSchema, err := instance.secretsFingerprintToSchema(secretsData, secretsDirectories, nil, 0, nil)
+	if err != nil {
+		return s.fail(err)
+	}
+	err = resource.Set(KeySecretFingerprint, secretsFingerprintSchema)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	//
+
+	err = instance.runSecretsHooks(ctx, resource, provider, secrets, previousFingerprint, secretsData, secretsDirectories, secretsChanged)
+	if err != nil {
+		if errs, ok := err.(SecretsHookErrors); ok {
+			return errs.Diagnostics()
+		}
+		return s.fail(err)
+	}
+
+	return nil
+}
+
+func (s SecretsResource) Read(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return nil
+}
+
+func (s SecretsResource) Update(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	return s.Create(ctx, resource, meta)
+}
+
+func (s SecretsResource) Delete(ctx context.Context, resource *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	resource.SetId("")
+	return nil
+}
+
+var secretsResource SecretsResource
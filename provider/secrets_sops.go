@@ -0,0 +1,881 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	ageArmor "filippo.io/age/armor"
+	"github.com/awnumar/memguard"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// SecretsProviderSops decrypts values of SOPS encrypted files in-process,
+	// source may select a single value with JSON pointer: secrets.yaml#/database/password.
+	// File MAC is verified before values are returned, so removal or reordering of the values is detected.
+	SecretsProviderSops struct {
+		// Age provides identities to decrypt data key with.
+		Age *SecretsProviderAge
+		// PgpKeyrings are files with pgp private keys (armored or binary),
+		// passphrase protected keys are not supported.
+		PgpKeyrings []string
+
+		pgpKeyringOnce sync.Once
+		pgpKeyring     openpgp.EntityList
+		pgpKeyringErr  error
+	}
+
+	SopsFormat string
+
+	SopsAgeKey struct {
+		Recipient string `mapstructure:"recipient"`
+		Enc       string `mapstructure:"enc"`
+	}
+	SopsPgpKey struct {
+		Fingerprint string `mapstructure:"fp"`
+		Enc         string `mapstructure:"enc"`
+	}
+	SopsKeyGroup struct {
+		Age []SopsAgeKey `mapstructure:"age"`
+		Pgp []SopsPgpKey `mapstructure:"pgp"`
+	}
+	SopsMetadata struct {
+		Age       []SopsAgeKey   `mapstructure:"age"`
+		Pgp       []SopsPgpKey   `mapstructure:"pgp"`
+		KeyGroups []SopsKeyGroup `mapstructure:"key_groups"`
+		// Mac is encrypted sha512 of the values, LastModified is used as additional data to encrypt it.
+		Mac              string `mapstructure:"mac"`
+		LastModified     string `mapstructure:"lastmodified"`
+		MacOnlyEncrypted bool   `mapstructure:"mac_only_encrypted"`
+	}
+
+	// SopsLeaf is a value of the tree with path of map keys leading to it.
+	SopsLeaf struct {
+		Path  []string
+		Value interface{}
+	}
+
+	// SopsFile is a parsed SOPS file, values of the Tree are still encrypted.
+	SopsFile struct {
+		Format SopsFormat
+		Tree   map[string]interface{}
+		// Leaves are values of the Tree in document order (MAC depends on it).
+		Leaves   []SopsLeaf
+		Metadata SopsMetadata
+	}
+)
+
+const (
+	SopsFormatYaml   SopsFormat = "yaml"
+	SopsFormatJson   SopsFormat = "json"
+	SopsFormatDotenv SopsFormat = "dotenv"
+	SopsFormatBinary SopsFormat = "binary"
+
+	SopsMetadataKey = "sops"
+	// SopsBinaryDataKey holds content of binary files.
+	SopsBinaryDataKey = "data"
+
+	sopsDataKeySize    = 32
+	sopsDotenvPrefix   = SopsMetadataKey + "_"
+	sopsDotenvListSep  = "__list_"
+	sopsDotenvMapSep   = "__map_"
+	sopsPointerSep     = "#"
+	sopsPathSep        = ":"
+	sopsValueTypeStr   = "str"
+	sopsValueTypeInt   = "int"
+	sopsValueTypeFloat = "float"
+	sopsValueTypeBool  = "bool"
+	sopsValueTypeBytes = "bytes"
+)
+
+var sopsValueRegexp = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.+),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// SopsFormatFromPath guesses file format by extension the same way sops does,
+// files with unknown extension are binary.
+func SopsFormatFromPath(path string) SopsFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return SopsFormatYaml
+	case ".json":
+		return SopsFormatJson
+	case ".env":
+		return SopsFormatDotenv
+	default:
+		return SopsFormatBinary
+	}
+}
+
+// SopsSplitSource splits source into file path and JSON pointer (RFC 6901) reference tokens.
+func SopsSplitSource(source string) (string, []string, error) {
+	n := strings.Index(source, sopsPointerSep)
+	if n < 0 {
+		return source, nil, nil
+	}
+	path, pointer := source[:n], source[n+1:]
+	if pointer == "" {
+		return path, nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return "", nil, errors.Errorf("json pointer %q should start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for n, token := range tokens {
+		tokens[n] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return path, tokens, nil
+}
+
+//
+
+func sopsNormalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = sopsNormalize(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = sopsNormalize(item)
+		}
+		return m
+	case []interface{}:
+		for n, item := range v {
+			v[n] = sopsNormalize(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// sopsUnflattenDotenv restores metadata tree from dotenv keys (sops_age__list_0__map_enc).
+func sopsUnflattenDotenv(flat map[string]string) (map[string]interface{}, error) {
+	var (
+		root = map[string]interface{}{}
+		keys = make([]string, 0, len(flat))
+	)
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var (
+			value    = flat[key]
+			segments = []interface{}{}
+			rest     = key
+		)
+		for rest != "" {
+			var segment string
+			switch {
+			case strings.HasPrefix(rest, sopsDotenvListSep):
+				rest = strings.TrimPrefix(rest, sopsDotenvListSep)
+				segment, rest = sopsDotenvSegment(rest)
+				index, err := strconv.Atoi(segment)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid list index in sops metadata key %q", key)
+				}
+				segments = append(segments, index)
+				continue
+			case strings.HasPrefix(rest, sopsDotenvMapSep):
+				rest = strings.TrimPrefix(rest, sopsDotenvMapSep)
+			}
+			segment, rest = sopsDotenvSegment(rest)
+			segments = append(segments, segment)
+		}
+
+		var err error
+		root, err = sopsSetPath(root, segments, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid sops metadata key %q", key)
+		}
+	}
+	return root, nil
+}
+
+// sopsDotenvSegment splits key at the first list or map separator.
+func sopsDotenvSegment(s string) (string, string) {
+	n := len(s)
+	for _, sep := range []string{sopsDotenvListSep, sopsDotenvMapSep} {
+		if i := strings.Index(s, sep); i >= 0 && i < n {
+			n = i
+		}
+	}
+	return s[:n], s[n:]
+}
+
+func sopsSetPath(root map[string]interface{}, segments []interface{}, value string) (map[string]interface{}, error) {
+	var set func(node interface{}, segments []interface{}) (interface{}, error)
+	set = func(node interface{}, segments []interface{}) (interface{}, error) {
+		if len(segments) == 0 {
+			return value, nil
+		}
+		switch segment := segments[0].(type) {
+		case string:
+			m, ok := node.(map[string]interface{})
+			if node == nil {
+				m, ok = map[string]interface{}{}, true
+			}
+			if !ok {
+				return nil, errors.Errorf("expected map at %q", segment)
+			}
+			item, err := set(m[segment], segments[1:])
+			if err != nil {
+				return nil, err
+			}
+			m[segment] = item
+			return m, nil
+		case int:
+			l, ok := node.([]interface{})
+			if node == nil {
+				ok = true
+			}
+			if !ok {
+				return nil, errors.Errorf("expected list at %d", segment)
+			}
+			for len(l) <= segment {
+				l = append(l, nil)
+			}
+			item, err := set(l[segment], segments[1:])
+			if err != nil {
+				return nil, err
+			}
+			l[segment] = item
+			return l, nil
+		default:
+			return nil, errors.Errorf("unexpected path segment %v", segment)
+		}
+	}
+	node, err := set(root, segments)
+	if err != nil {
+		return nil, err
+	}
+	return node.(map[string]interface{}), nil
+}
+
+func sopsParseDotenv(buf []byte) (map[string]interface{}, []SopsLeaf, map[string]interface{}, error) {
+	var (
+		tree     = map[string]interface{}{}
+		leaves   = []SopsLeaf{}
+		metadata = map[string]string{}
+		scanner  = bufio.NewScanner(bytes.NewReader(buf))
+		line     = 0
+	)
+	scanner.Buffer(nil, len(buf)+1)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		n := strings.Index(text, "=")
+		if n < 0 {
+			return nil, nil, nil, errors.Errorf("invalid dotenv line %d, expected KEY=VALUE", line)
+		}
+		key, value := text[:n], strings.Replace(text[n+1:], `\n`, "\n", -1)
+		if strings.HasPrefix(key, sopsDotenvPrefix) {
+			metadata[strings.TrimPrefix(key, sopsDotenvPrefix)] = value
+			continue
+		}
+		tree[key] = value
+		leaves = append(leaves, SopsLeaf{Path: []string{key}, Value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	unflattened, err := sopsUnflattenDotenv(metadata)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return tree, leaves, unflattened, nil
+}
+
+// sopsYamlLeaves appends values of the node in document order (metadata is skipped).
+func sopsYamlLeaves(node *yaml.Node, path []string, leaves []SopsLeaf) ([]SopsLeaf, error) {
+	var err error
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, item := range node.Content {
+			leaves, err = sopsYamlLeaves(item, path, leaves)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case yaml.AliasNode:
+		return sopsYamlLeaves(node.Alias, path, leaves)
+	case yaml.MappingNode:
+		for n := 0; n+1 < len(node.Content); n += 2 {
+			key := node.Content[n].Value
+			if len(path) == 0 && key == SopsMetadataKey {
+				continue
+			}
+			leaves, err = sopsYamlLeaves(node.Content[n+1], append(path[:len(path):len(path)], key), leaves)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case yaml.ScalarNode:
+		var value interface{}
+		err = node.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, SopsLeaf{Path: path, Value: value})
+	}
+	return leaves, nil
+}
+
+// sopsJsonLeaves appends values of the next JSON value in document order (metadata is skipped).
+func sopsJsonLeaves(decoder *json.Decoder, path []string, leaves []SopsLeaf) ([]SopsLeaf, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			if len(path) == 0 && key == SopsMetadataKey {
+				var metadata json.RawMessage
+				err = decoder.Decode(&metadata)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			leaves, err = sopsJsonLeaves(decoder, append(path[:len(path):len(path)], key.(string)), leaves)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = decoder.Token()
+	case json.Delim('['):
+		for decoder.More() {
+			leaves, err = sopsJsonLeaves(decoder, path, leaves)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = decoder.Token()
+	default:
+		leaves = append(leaves, SopsLeaf{Path: path, Value: token})
+	}
+	return leaves, err
+}
+
+// SopsParse parses SOPS file without decrypting it.
+func SopsParse(buf []byte, format SopsFormat) (*SopsFile, error) {
+	var (
+		tree     map[string]interface{}
+		leaves   []SopsLeaf
+		metadata interface{}
+	)
+	switch format {
+	case SopsFormatDotenv:
+		var (
+			dotenvMetadata map[string]interface{}
+			err            error
+		)
+		tree, leaves, dotenvMetadata, err = sopsParseDotenv(buf)
+		if err != nil {
+			return nil, err
+		}
+		if len(dotenvMetadata) > 0 {
+			metadata = dotenvMetadata
+		}
+	case SopsFormatYaml:
+		var (
+			node     yaml.Node
+			document interface{}
+		)
+		err := yaml.Unmarshal(buf, &node)
+		if err != nil {
+			return nil, err
+		}
+		if node.Kind != 0 {
+			err = node.Decode(&document)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tree, _ = sopsNormalize(document).(map[string]interface{})
+		leaves, err = sopsYamlLeaves(&node, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(buf))
+		decoder.UseNumber()
+		err := decoder.Decode(&tree)
+		if err != nil {
+			return nil, err
+		}
+		decoder = json.NewDecoder(bytes.NewReader(buf))
+		decoder.UseNumber()
+		leaves, err = sopsJsonLeaves(decoder, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tree == nil {
+		return nil, errors.New("expected document to be a map")
+	}
+
+	if metadata == nil {
+		metadata = tree[SopsMetadataKey]
+		delete(tree, SopsMetadataKey)
+	}
+	if metadata == nil {
+		return nil, errors.New("sops metadata not found, file is not encrypted with sops")
+	}
+
+	file := &SopsFile{Format: format, Tree: tree, Leaves: leaves}
+	err := mapstructure.WeakDecode(metadata, &file.Metadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode sops metadata")
+	}
+	if len(file.Metadata.KeyGroups) > 1 {
+		return nil, errors.New("sops files with multiple key groups (shamir secret sharing) are not supported")
+	}
+	for _, group := range file.Metadata.KeyGroups {
+		file.Metadata.Age = append(file.Metadata.Age, group.Age...)
+		file.Metadata.Pgp = append(file.Metadata.Pgp, group.Pgp...)
+	}
+
+	return file, nil
+}
+
+// SopsDecryptValue decrypts value encrypted with data key,
+// path is a list of map keys leading to the value (list indexes are not included).
+func SopsDecryptValue(key []byte, value string, path []string) (interface{}, error) {
+	return sopsDecrypt(key, value, strings.Join(path, sopsPathSep)+sopsPathSep)
+}
+
+func sopsDecrypt(key []byte, value string, additionalData string) (interface{}, error) {
+	if value == "" {
+		return value, nil
+	}
+	match := sopsValueRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return nil, errors.New("value is not encrypted with AES256_GCM")
+	}
+	parts := make([][]byte, 3)
+	for n := range parts {
+		var err error
+		parts[n], err = base64.StdEncoding.DecodeString(match[n+1])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode encrypted value")
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt value (wrong data key or value was tampered with)")
+	}
+
+	switch match[4] {
+	case sopsValueTypeStr, sopsValueTypeBytes:
+		return string(plaintext), nil
+	case sopsValueTypeInt, sopsValueTypeFloat:
+		return json.Number(plaintext), nil
+	case sopsValueTypeBool:
+		return strconv.ParseBool(string(plaintext))
+	default:
+		return nil, errors.Errorf("unsupported value type %q", match[4])
+	}
+}
+
+// sopsMacBytes converts value into bytes it is hashed with, the same way sops does.
+func sopsMacBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case int:
+		return []byte(strconv.Itoa(v)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case json.Number:
+		if n, err := strconv.Atoi(string(v)); err == nil {
+			return []byte(strconv.Itoa(n)), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatFloat(f, 'f', -1, 64)), nil
+	case bool:
+		if v {
+			return []byte("True"), nil
+		}
+		return []byte("False"), nil
+	default:
+		return nil, errors.Errorf("could not convert value of type %T to bytes", value)
+	}
+}
+
+// VerifyMac checks sha512 of the values (decrypted, in document order) matches the file MAC,
+// so removal, reordering or replacement of the values could be detected.
+// NOTE: null values are not hashed, with mac_only_encrypted only encrypted values are.
+func (f *SopsFile) VerifyMac(key []byte) error {
+	if f.Metadata.Mac == "" {
+		return errors.New("sops metadata has no mac")
+	}
+	lastModified, err := time.Parse(time.RFC3339, f.Metadata.LastModified)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse sops lastmodified")
+	}
+	mac, err := sopsDecrypt(key, f.Metadata.Mac, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt sops mac")
+	}
+
+	hash := sha512.New()
+	for _, leaf := range f.Leaves {
+		value, encrypted := leaf.Value, false
+		if v, ok := value.(string); ok && strings.HasPrefix(v, "ENC[") {
+			value, err = SopsDecryptValue(key, v, leaf.Path)
+			if err != nil {
+				return errors.Wrapf(err, "failed to decrypt %q", strings.Join(leaf.Path, sopsPathSep))
+			}
+			encrypted = true
+		}
+		if value == nil || (f.Metadata.MacOnlyEncrypted && !encrypted) {
+			continue
+		}
+		buf, err := sopsMacBytes(value)
+		if err != nil {
+			return errors.Wrapf(err, "failed to hash %q", strings.Join(leaf.Path, sopsPathSep))
+		}
+		hash.Write(buf)
+	}
+
+	expected, _ := mac.(string)
+	computed := fmt.Sprintf("%X", hash.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(strings.ToUpper(expected)), []byte(computed)) != 1 {
+		return errors.New("sops mac mismatch, file was tampered with")
+	}
+	return nil
+}
+
+// Select returns subtree which JSON pointer tokens are pointing at with path of map keys used to encrypt it.
+func (f *SopsFile) Select(tokens []string) (interface{}, []string, error) {
+	var (
+		node interface{} = f.Tree
+		path             = []string{}
+	)
+	for _, token := range tokens {
+		switch v := node.(type) {
+		case map[string]interface{}:
+			item, ok := v[token]
+			if !ok {
+				return nil, nil, errors.Errorf("key %q not found", token)
+			}
+			node = item
+			path = append(path, token)
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, nil, errors.Errorf("index %q out of range", token)
+			}
+			node = v[index]
+		default:
+			return nil, nil, errors.Errorf("could not select %q from a value", token)
+		}
+	}
+	return node, path, nil
+}
+
+// Decrypt decrypts all encrypted values of the subtree,
+// values which are not encrypted (unencrypted_suffix, etc) are returned as is.
+func (f *SopsFile) Decrypt(key []byte, node interface{}, path []string) (interface{}, error) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			value, err := f.Decrypt(key, item, append(path[:len(path):len(path)], k))
+			if err != nil {
+				return nil, err
+			}
+			m[k] = value
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for n, item := range v {
+			value, err := f.Decrypt(key, item, path)
+			if err != nil {
+				return nil, err
+			}
+			l[n] = value
+		}
+		return l, nil
+	case string:
+		if !strings.HasPrefix(v, "ENC[") {
+			return v, nil
+		}
+		value, err := SopsDecryptValue(key, v, path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decrypt %q", strings.Join(path, sopsPathSep))
+		}
+		return value, nil
+	default:
+		return v, nil
+	}
+}
+
+// Marshal renders decrypted value, scalars are rendered as is,
+// maps & lists are rendered as JSON (dotenv as KEY=VALUE lines).
+func (f *SopsFile) Marshal(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return []byte{}, nil
+	case string:
+		return []byte(v), nil
+	case json.Number:
+		return []byte(v), nil
+	case map[string]interface{}:
+		if f.Format != SopsFormatDotenv {
+			return json.Marshal(v)
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf := bytes.NewBuffer(nil)
+		for _, key := range keys {
+			buf.WriteString(key + "=" + strings.Replace(fmt.Sprint(v[key]), "\n", `\n`, -1) + "\n")
+		}
+		return buf.Bytes(), nil
+	case []interface{}:
+		return json.Marshal(v)
+	default:
+		return []byte(fmt.Sprint(v)), nil
+	}
+}
+
+//
+
+// SopsAgeKeyFiles returns default age identity files used by sops.
+func SopsAgeKeyFiles() []string {
+	if path := os.Getenv("SOPS_AGE_KEY_FILE"); path != "" {
+		return []string{path}
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil
+	}
+	path := filepath.Join(dir, "sops", "age", "keys.txt")
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	return []string{path}
+}
+
+// SopsPgpKeyrings returns default gnupg secret keyring used by sops (if it exists).
+func SopsPgpKeyrings() []string {
+	dir := os.Getenv("GNUPGHOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(home, ".gnupg")
+	}
+	path := filepath.Join(dir, "secring.gpg")
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	return []string{path}
+}
+
+func (p *SecretsProviderSops) Name() string {
+	return string(SecretsProviderNameSops)
+}
+
+// PgpKeyring returns pgp private keys, they are loaded once for the lifetime of the provider.
+func (p *SecretsProviderSops) PgpKeyring() (openpgp.EntityList, error) {
+	p.pgpKeyringOnce.Do(func() {
+		for _, path := range p.PgpKeyrings {
+			buf, err := ioutil.ReadFile(os.ExpandEnv(path))
+			if err != nil {
+				p.pgpKeyringErr = errors.Wrapf(err, "failed to read pgp keyring %q", path)
+				return
+			}
+			var keyring openpgp.EntityList
+			if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("-----BEGIN")) {
+				keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+			} else {
+				keyring, err = openpgp.ReadKeyRing(bytes.NewReader(buf))
+			}
+			memguard.WipeBytes(buf)
+			if err != nil {
+				p.pgpKeyringErr = errors.Wrapf(err, "failed to parse pgp keyring %q", path)
+				return
+			}
+			p.pgpKeyring = append(p.pgpKeyring, keyring...)
+		}
+	})
+	return p.pgpKeyring, p.pgpKeyringErr
+}
+
+func (p *SecretsProviderSops) decryptAge(enc string) ([]byte, error) {
+	identities, err := p.Age.Identities()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := age.Decrypt(ageArmor.NewReader(strings.NewReader(enc)), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func (p *SecretsProviderSops) decryptPgp(enc string) ([]byte, error) {
+	keyring, err := p.PgpKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("no pgp keys configured")
+	}
+	block, err := armor.Decode(strings.NewReader(enc))
+	if err != nil {
+		return nil, err
+	}
+	message, err := openpgp.ReadMessage(
+		block.Body, keyring,
+		func([]openpgp.Key, bool) ([]byte, error) {
+			return nil, errors.New("passphrase protected pgp keys are not supported")
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(message.UnverifiedBody)
+}
+
+// DataKey decrypts key which is used to encrypt values of the file with first key available.
+func (p *SecretsProviderSops) DataKey(file *SopsFile) ([]byte, error) {
+	errs := []string{}
+	try := func(kind, id, enc string, decrypt func(string) ([]byte, error)) []byte {
+		key, err := decrypt(enc)
+		if err == nil && len(key) != sopsDataKeySize {
+			memguard.WipeBytes(key)
+			err = errors.Errorf("expected data key of %d bytes, got %d", sopsDataKeySize, len(key))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s: %s", kind, id, err))
+			return nil
+		}
+		return key
+	}
+
+	for _, key := range file.Metadata.Age {
+		if dataKey := try("age", key.Recipient, key.Enc, p.decryptAge); dataKey != nil {
+			return dataKey, nil
+		}
+	}
+	for _, key := range file.Metadata.Pgp {
+		if dataKey := try("pgp", key.Fingerprint, key.Enc, p.decryptPgp); dataKey != nil {
+			return dataKey, nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.New("no age or pgp keys found in sops metadata")
+	}
+	return nil, errors.Errorf("failed to decrypt sops data key:\n%s", strings.Join(errs, "\n"))
+}
+
+func (p *SecretsProviderSops) Get(source string) ([]byte, error) {
+	path, tokens, err := SopsSplitSource(source)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := SopsParse(buf, SopsFormatFromPath(path))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse sops file %q", path)
+	}
+	if file.Format == SopsFormatBinary && len(tokens) == 0 {
+		tokens = []string{SopsBinaryDataKey}
+	}
+
+	node, nodePath, err := file.Select(tokens)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to select %q", source)
+	}
+	key, err := p.DataKey(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt %q", path)
+	}
+	defer memguard.WipeBytes(key)
+
+	err = file.VerifyMac(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to verify %q", path)
+	}
+	value, err := file.Decrypt(key, node, nodePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt %q", source)
+	}
+	return file.Marshal(value)
+}
+
+func NewSecretsProviderSops(ageProvider *SecretsProviderAge, pgpKeyrings []string) *SecretsProviderSops {
+	if len(ageProvider.IdentityFiles) == 0 && ageProvider.IdentityProvider == nil {
+		ageProvider.IdentityFiles = SopsAgeKeyFiles()
+	}
+	if len(pgpKeyrings) == 0 {
+		pgpKeyrings = SopsPgpKeyrings()
+	}
+	return &SecretsProviderSops{
+		Age:         ageProvider,
+		PgpKeyrings: pgpKeyrings,
+	}
+}
+
+var (
+	_ SecretsProvider = &SecretsProviderSops{}
+)
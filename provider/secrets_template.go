@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/awnumar/memguard"
+	"github.com/pkg/errors"
+)
+
+type (
+	// SecretTemplateValue is a secret value available in the template,
+	// it is kept in locked memory until template is rendered.
+	SecretTemplateValue struct {
+		buffer *LockedBuffer
+	}
+)
+
+const secretReferenceSep = ":"
+
+var (
+	SecretTemplateFuncs = template.FuncMap{
+		"base64": func(v interface{}) string { return base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(v))) },
+		"quote":  func(v interface{}) string { return strconv.Quote(fmt.Sprint(v)) },
+		"trim":   func(v interface{}) string { return strings.TrimSpace(fmt.Sprint(v)) },
+	}
+)
+
+func SecretTemplateFuncNames() []string {
+	names := make([]string, 0, len(SecretTemplateFuncs))
+	for name := range SecretTemplateFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (v SecretTemplateValue) String() string {
+	return string(v.buffer.Bytes())
+}
+
+// SecretReference splits template value reference into secrets provider name & source,
+// provider name is empty if reference has no known provider prefix (gopass:db/pass).
+func SecretReference(reference string) (string, string) {
+	n := strings.Index(reference, secretReferenceSep)
+	if n > 0 {
+		name := strings.ToLower(reference[:n])
+		for _, provider := range SecretsProviders {
+			if name == provider {
+				return name, reference[n+1:]
+			}
+		}
+	}
+	return "", reference
+}
+
+// render renders secret template with values retrieved from secrets providers.
+func (s *Secrets) render(secret *SecretDescription) ([]byte, error) {
+	tmpl, err := template.New(secret.Destination).
+		Option("missingkey=error").
+		Funcs(SecretTemplateFuncs).
+		Parse(secret.Template)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse template of %q", secret.Destination)
+	}
+
+	values := make(map[string]SecretTemplateValue, len(secret.Values))
+	defer func() {
+		for _, value := range values {
+			value.buffer.Destroy()
+		}
+	}()
+	for name, reference := range secret.Values {
+		providerName, source := SecretReference(reference)
+		provider := s.Provider
+		if providerName != "" && providerName != s.Provider.Name() {
+			if s.ProviderByName == nil {
+				return nil, errors.Errorf("secrets provider %q is not available for template value %q", providerName, name)
+			}
+			provider, err = s.ProviderByName(providerName)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buf, err := provider.Get(source)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err, "failed to get template value %q from provider %q",
+				name, provider.Name(),
+			)
+		}
+		values[name] = SecretTemplateValue{buffer: NewLockedBuffer(buf)}
+	}
+
+	out := bytes.NewBuffer(nil)
+	err = tmpl.Execute(out, values)
+	defer memguard.WipeBytes(out.Bytes())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to render template of %q", secret.Destination)
+	}
+
+	buf := make([]byte, out.Len())
+	copy(buf, out.Bytes())
+	return buf, nil
+}
@@ -0,0 +1,308 @@
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretsInlineContent(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	assert.NoError(t, ioutil.WriteFile(source, []byte("from file"), 0600))
+
+	content := []byte("inline")
+	secrets := NewSecrets(NewSecretsProviderFilesystem(), SecretsDescriptions{
+		{Source: source, Destination: "/run/keys/file", Owner: "root", Group: "root", Permissions: 600},
+		{Content: content, Destination: "/run/keys/inline", Owner: "root", Group: "root", Permissions: 400},
+	})
+	defer secrets.Close()
+
+	data, err := secrets.Data()
+	assert.NoError(t, err)
+	assert.Equal(t, "from file", string(data[0].Bytes()))
+	assert.Equal(t, "inline", string(data[1].Bytes()))
+	assert.Equal(t, "inline", string(content))
+	assert.Equal(t, "inline content of /run/keys/inline", data[1].Name())
+
+	install, err := NewSecretsInstall(secrets)
+	assert.NoError(t, err)
+	stream, err := install.Tar()
+	assert.NoError(t, err)
+	r := tar.NewReader(stream)
+	for _, expected := range []string{"from file", "inline"} {
+		_, err := r.Next()
+		assert.NoError(t, err)
+		buf, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(buf))
+	}
+
+	// NOTE: fingerprint covers inline content
+	changed := NewSecrets(NewSecretsProviderFilesystem(), SecretsDescriptions{
+		{Source: source, Destination: "/run/keys/file", Owner: "root", Group: "root", Permissions: 600},
+		{Content: []byte("changed"), Destination: "/run/keys/inline", Owner: "root", Group: "root", Permissions: 400},
+	})
+	defer changed.Close()
+	changedData, err := changed.Data()
+	assert.NoError(t, err)
+	salt := []byte("salt")
+	assert.NotEqual(t, data.Hash(salt, 1), changedData.Hash(salt, 1))
+}
+
+func TestSecretsTemplate(t *testing.T) {
+	dir := t.TempDir()
+	for name, value := range map[string]string{"db": "hunter2\n", "api": "key with \"quotes\""} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0600))
+	}
+
+	secrets := NewSecrets(NewSecretsProviderFilesystem(), SecretsDescriptions{{
+		Template: "DB_PASSWORD={{ trim .db }}\nAPI_KEY={{ quote .api }}\nTOKEN={{ .token | base64 }}\n",
+		Values: map[string]string{
+			"db":    filepath.Join(dir, "db"),
+			"api":   "filesystem:" + filepath.Join(dir, "api"),
+			"token": "command:token",
+		},
+		Destination: "/run/keys/app.env",
+	}})
+	secrets.ProviderByName = func(name string) (SecretsProvider, error) {
+		assert.Equal(t, string(SecretsProviderNameCommand), name)
+		return NewSecretsProviderCommand("echo", []string{"-n"}, nil), nil
+	}
+	defer secrets.Close()
+
+	data, err := secrets.Data()
+	assert.NoError(t, err)
+	assert.Equal(t, "DB_PASSWORD=hunter2\nAPI_KEY=\"key with \\\"quotes\\\"\"\nTOKEN=dG9rZW4=\n", string(data[0].Bytes()))
+	assert.Equal(t, "template of /run/keys/app.env", data[0].Name())
+
+	secrets = NewSecrets(NewSecretsProviderFilesystem(), SecretsDescriptions{{
+		Template:    "{{ .missing }}",
+		Destination: "/run/keys/missing",
+	}})
+	_, err = secrets.Data()
+	assert.ErrorContains(t, err, "failed to render template")
+}
+
+func TestSecretReference(t *testing.T) {
+	for reference, expected := range map[string][2]string{
+		"gopass:db/pass":        {"gopass", "db/pass"},
+		"VAULT:secret/db#pass":  {"vault", "secret/db#pass"},
+		"secrets/db":            {"", "secrets/db"},
+		"unknown:secrets/db":    {"", "unknown:secrets/db"},
+		"sops:prod.yaml#/db/pw": {"sops", "prod.yaml#/db/pw"},
+	} {
+		name, source := SecretReference(reference)
+		assert.Equal(t, expected, [2]string{name, source}, reference)
+	}
+}
+
+func TestSecretsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "tls")
+	assert.NoError(t, os.MkdirAll(filepath.Join(source, "ca"), 0700))
+	for name, value := range map[string]string{
+		"server.crt":  "certificate",
+		"server.key":  "key",
+		"ca/root.crt": "root certificate",
+	} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(source, name), []byte(value), 0600))
+	}
+
+	description := &SecretDescription{
+		Source:      source,
+		Destination: "/var/lib/tls",
+		Owner:       "root",
+		Group:       "root",
+		Permissions: 600,
+		Files: []*SecretFileRule{
+			{Pattern: "*.crt", Permissions: 644},
+			{Pattern: "ca/*", Group: "ssl-cert"},
+		},
+	}
+	secrets := NewSecrets(NewSecretsProviderFilesystem(), SecretsDescriptions{description})
+	defer secrets.Close()
+
+	data, err := secrets.Data()
+	assert.NoError(t, err)
+	result := []string{}
+	for _, secret := range data {
+		result = append(result, fmt.Sprintf(
+			"%s %s:%s %d %s",
+			secret.Destination, secret.Owner, secret.Group, secret.Permissions, secret.Bytes(),
+		))
+	}
+	assert.Equal(t, []string{
+		"/var/lib/tls/ca/root.crt root:ssl-cert 644 root certificate",
+		"/var/lib/tls/server.crt root:root 644 certificate",
+		"/var/lib/tls/server.key root:root 600 key",
+	}, result)
+
+	// NOTE: fingerprint is deterministic & covers file names
+	salt := []byte("salt")
+	hash := data.Hash(salt, 1)
+	assert.NoError(t, os.Rename(filepath.Join(source, "server.key"), filepath.Join(source, "server.pem")))
+	renamed := NewSecrets(NewSecretsProviderFilesystem(), SecretsDescriptions{description})
+	defer renamed.Close()
+	renamedData, err := renamed.Data()
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, renamedData.Hash(salt, 1))
+	assert.NoError(t, os.Rename(filepath.Join(source, "server.pem"), filepath.Join(source, "server.key")))
+	same := NewSecrets(NewSecretsProviderFilesystem(), SecretsDescriptions{description})
+	defer same.Close()
+	sameData, err := same.Data()
+	assert.NoError(t, err)
+	assert.Equal(t, hash, sameData.Hash(salt, 1))
+}
+
+func TestSecretsCleanupScript(t *testing.T) {
+	dir := t.TempDir()
+	destination := filepath.Join(dir, "it's tls")
+	for _, name := range []string{"server.crt", "stale.key", "old/ca.crt", "ca/root.crt", "ca/[x]*", "foreign.key"} {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(destination, name)), 0700))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(destination, name), nil, 0600))
+	}
+
+	script := SecretsCleanupScript(map[string][]string{
+		destination: {
+			destination + "/stale.key",
+			destination + "/old/ca.crt",
+			destination + "/ca/[x]*",
+		},
+	})
+	_, err := CommandExecute("sh", []string{"-c", script})
+	assert.NoError(t, err)
+
+	files := []string{}
+	assert.NoError(t, filepath.Walk(destination, func(name string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(destination, name)
+		files = append(files, rel)
+		return err
+	}))
+	assert.Equal(t, []string{".", "ca", "ca/root.crt", "foreign.key", "server.crt"}, files)
+}
+
+func TestSecretsRemoved(t *testing.T) {
+	assert.Equal(
+		t,
+		map[string][]string{
+			"/etc/tls":     {"/etc/tls/old.key"},
+			"/etc/empty":   {"/etc/empty/gone"},
+			"/etc/removed": {"/etc/removed/key"},
+		},
+		SecretsRemoved(
+			map[string][]string{
+				"/etc/tls":     {"/etc/tls/server.key", "/etc/tls/old.key"},
+				"/etc/empty":   {"/etc/empty/gone"},
+				"/etc/removed": {"/etc/removed/key"},
+			},
+			map[string][]string{
+				"/etc/tls":   {"/etc/tls/server.key"},
+				"/etc/empty": {},
+			},
+		),
+	)
+	assert.Empty(t, SecretsRemoved(nil, map[string][]string{"/etc/tls": {"/etc/tls/server.key"}}))
+}
+
+func TestSecretsDiffUnknownContent(t *testing.T) {
+	p, err := NewProvider(&ResourceData{
+		ResourceBox: schema.TestResourceDataRaw(t, ProviderSchema.Schema, map[string]interface{}{}),
+		Schema:      ProviderSchema.Schema,
+	})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	var (
+		resource   = ProviderResourceMap[KeyNixosSecrets]
+		configType = resource.CoreConfigSchema().ImpliedType()
+		nulls      = func(t cty.Type) map[string]cty.Value {
+			attributes := map[string]cty.Value{}
+			for name, attributeType := range t.AttributeTypes() {
+				attributes[name] = cty.NullVal(attributeType)
+			}
+			return attributes
+		}
+	)
+	// NOTE: content of random_password, tls_private_key, etc is unknown until apply
+	for _, key := range []string{KeySecretContent, KeySecretContentBase64} {
+		secret := nulls(configType.AttributeType(KeySecret).ElementType())
+		secret[key] = cty.UnknownVal(cty.String)
+		secret[KeySecretDestination] = cty.StringVal("/run/secrets/password")
+		raw := nulls(configType)
+		raw[KeyAddress] = cty.ListVal([]cty.Value{cty.StringVal("192.0.2.1")})
+		raw[KeySecret] = cty.SetVal([]cty.Value{cty.ObjectVal(secret)})
+
+		state := &terraform.InstanceState{
+			ID: "secrets",
+			Attributes: map[string]string{
+				"address.#":            "1",
+				"address.0":            "192.0.2.1",
+				"secret_fingerprint.%": "3",
+				"secret_fingerprint." + KeySecretFingerprintSum:           "00",
+				"secret_fingerprint." + KeySecretFingerprintSalt:          "00",
+				"secret_fingerprint." + KeySecretFingerprintKdfIterations: "1",
+			},
+			RawConfig: cty.ObjectVal(raw),
+		}
+		config := terraform.NewResourceConfigShimmed(state.RawConfig, resource.CoreConfigSchema())
+
+		diff, err := resource.Diff(context.Background(), state, config, p)
+		assert.NoError(t, err, key)
+		assert.True(t, diff.Attributes[KeySecretFingerprint+".%"].NewComputed, key)
+	}
+}
+
+// rawConfigResource is a resource with configuration as it was sent by terraform.
+type rawConfigResource struct {
+	*schema.ResourceData
+	raw cty.Value
+}
+
+func (r rawConfigResource) GetRawConfig() cty.Value { return r.raw }
+
+func TestProviderNewSecretsEmptyContent(t *testing.T) {
+	p, err := NewProvider(&ResourceData{
+		ResourceBox: schema.TestResourceDataRaw(t, ProviderSchema.Schema, map[string]interface{}{}),
+		Schema:      ProviderSchema.Schema,
+	})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	resource := schema.TestResourceDataRaw(
+		t, ProviderResourceMap[KeyNixosSecrets].Schema,
+		map[string]interface{}{
+			KeyAddress: []interface{}{"192.0.2.1"},
+			KeySecret: []interface{}{map[string]interface{}{
+				KeySecretContent:     "",
+				KeySecretDestination: "/run/secrets/empty",
+			}},
+		},
+	)
+	_, err = p.NewSecrets(resource)
+	assert.ErrorContains(t, err, "should have exactly one of")
+
+	secrets, err := p.NewSecrets(rawConfigResource{
+		ResourceData: resource,
+		raw: cty.ObjectVal(map[string]cty.Value{
+			KeySecret: cty.SetVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+				KeySecretContent:     cty.StringVal(""),
+				KeySecretDestination: cty.StringVal("/run/secrets/empty"),
+			})}),
+		}),
+	})
+	assert.NoError(t, err)
+	defer secrets.Close()
+	secretsData, err := secrets.Data()
+	assert.NoError(t, err)
+	assert.Len(t, secretsData, 1)
+}
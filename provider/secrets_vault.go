@@ -0,0 +1,549 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	VaultAppRole struct {
+		Mount        string
+		RoleId       string
+		SecretId     string
+		SecretIdFile string
+	}
+	VaultTLS struct {
+		CACert     string
+		ClientCert string
+		ClientKey  string
+		ServerName string
+		SkipVerify bool
+	}
+	VaultConfig struct {
+		Address   string
+		Namespace string
+		Token     string
+		TokenFile string
+		AppRole   *VaultAppRole
+		// KvVersion is a version of KV secrets engine, 0 means it is detected for each mount.
+		KvVersion int
+		TLS       VaultTLS
+	}
+
+	// VaultClient is a minimal Vault HTTP API client to read KV secrets,
+	// token is renewed (or AppRole login is repeated) when less than a half of its TTL remains,
+	// this happens in background too, so token does not expire during long applies which read no secrets.
+	VaultClient struct {
+		Config *VaultConfig
+		http   *http.Client
+
+		lock           sync.Mutex
+		token          *LockedBuffer
+		tokenTTL       time.Duration
+		tokenExpires   time.Time
+		tokenRenewable bool
+		// renewerDone stops background renewer (nil if it is not running)
+		renewerDone chan struct{}
+		// mounts maps KV mount path to its version
+		mounts map[string]int
+	}
+
+	SecretsProviderVault struct {
+		Client *VaultClient
+	}
+
+	vaultAuth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	}
+	vaultResponse struct {
+		Data   map[string]interface{} `json:"data"`
+		Auth   *vaultAuth             `json:"auth"`
+		Errors []string               `json:"errors"`
+	}
+	vaultStatusError struct {
+		Status int
+		Errors []string
+	}
+)
+
+const (
+	VaultDefaultAddress      = "https://127.0.0.1:8200"
+	VaultDefaultAppRoleMount = "approle"
+	VaultRequestTimeout      = 60 * time.Second
+	// VaultRenewRetryWait is a wait before background renewal is retried after failure.
+	VaultRenewRetryWait = 10 * time.Second
+
+	vaultFieldSep = "#"
+)
+
+func (e *vaultStatusError) Error() string {
+	if len(e.Errors) == 0 {
+		return "vault responded with status " + strconv.Itoa(e.Status)
+	}
+	return "vault responded with status " + strconv.Itoa(e.Status) + ": " + strings.Join(e.Errors, ", ")
+}
+
+// VaultSplitSource splits source into secret path and field (optional): secret/myapp/db#password.
+func VaultSplitSource(source string) (string, string) {
+	n := strings.LastIndex(source, vaultFieldSep)
+	if n < 0 {
+		return strings.Trim(source, "/"), ""
+	}
+	return strings.Trim(source[:n], "/"), source[n+1:]
+}
+
+// WithDefaults returns a copy of configuration with empty settings filled
+// from environment variables used by vault cli.
+func (c VaultConfig) WithDefaults() *VaultConfig {
+	env := func(value *string, name string) {
+		if *value == "" {
+			*value = os.Getenv(name)
+		}
+	}
+	env(&c.Address, "VAULT_ADDR")
+	env(&c.Namespace, "VAULT_NAMESPACE")
+	env(&c.TLS.CACert, "VAULT_CACERT")
+	env(&c.TLS.ClientCert, "VAULT_CLIENT_CERT")
+	env(&c.TLS.ClientKey, "VAULT_CLIENT_KEY")
+	env(&c.TLS.ServerName, "VAULT_TLS_SERVER_NAME")
+	if !c.TLS.SkipVerify {
+		c.TLS.SkipVerify, _ = strconv.ParseBool(os.Getenv("VAULT_SKIP_VERIFY"))
+	}
+	if c.Address == "" {
+		c.Address = VaultDefaultAddress
+	}
+	if c.AppRole != nil && c.AppRole.Mount == "" {
+		appRole := *c.AppRole
+		appRole.Mount = VaultDefaultAppRoleMount
+		c.AppRole = &appRole
+	}
+	if c.Token == "" && c.AppRole == nil {
+		env(&c.Token, "VAULT_TOKEN")
+		if c.TokenFile == "" {
+			if home, err := os.UserHomeDir(); err == nil {
+				c.TokenFile = filepath.Join(home, ".vault-token")
+			}
+		}
+	}
+	return &c
+}
+
+// PoolKey identifies configurations which could share the client,
+// credentials are hashed, so they are not kept in plaintext as a part of the key.
+func (c *VaultConfig) PoolKey() string {
+	method, credentials := "token", []string{c.Token, c.TokenFile}
+	if c.AppRole != nil {
+		method, credentials = "approle", []string{c.AppRole.Mount, c.AppRole.RoleId, c.AppRole.SecretId, c.AppRole.SecretIdFile}
+	}
+	hash := sha256.New()
+	for _, credential := range credentials {
+		hash.Write([]byte(credential))
+		hash.Write([]byte{0})
+	}
+	return strings.Join([]string{
+		c.Address, c.Namespace, method,
+		strconv.Itoa(c.KvVersion),
+		// NOTE: TLS settings are file paths, not credentials
+		fmt.Sprintf("%#v", c.TLS),
+		hex.EncodeToString(hash.Sum(nil)),
+	}, "\n")
+}
+
+func (c *VaultConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.SkipVerify,
+	}
+	if c.TLS.CACert != "" {
+		buf, err := ioutil.ReadFile(c.TLS.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read vault ca certificate")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, errors.Errorf("no certificates found in %q", c.TLS.CACert)
+		}
+	}
+	if c.TLS.ClientCert != "" || c.TLS.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(c.TLS.ClientCert, c.TLS.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load vault client certificate")
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+//
+
+func (c *VaultClient) request(method string, path string, body interface{}, token string) (*vaultResponse, error) {
+	var payload *bytes.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = bytes.NewReader(buf)
+	} else {
+		payload = bytes.NewReader(nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), VaultRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.Config.Address, "/")+"/v1/"+path, payload)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.Config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Config.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	response := &vaultResponse{}
+	if res.StatusCode != http.StatusNoContent {
+		err = json.NewDecoder(res.Body).Decode(response)
+		if err != nil && res.StatusCode < 400 {
+			return nil, errors.Wrapf(err, "failed to decode vault response for %q", path)
+		}
+	}
+	if res.StatusCode >= 400 {
+		return nil, &vaultStatusError{Status: res.StatusCode, Errors: response.Errors}
+	}
+	return response, nil
+}
+
+func (c *VaultClient) setToken(token string, ttl time.Duration, renewable bool) {
+	if c.token != nil {
+		c.token.Destroy()
+	}
+	c.token = NewLockedBuffer([]byte(token))
+	c.tokenTTL = ttl
+	c.tokenRenewable = renewable
+	c.tokenExpires = time.Time{}
+	if ttl > 0 {
+		c.tokenExpires = time.Now().Add(ttl)
+	}
+}
+
+func (c *VaultClient) login() error {
+	appRole := c.Config.AppRole
+	if appRole != nil {
+		secretId := appRole.SecretId
+		if secretId == "" && appRole.SecretIdFile != "" {
+			buf, err := ioutil.ReadFile(appRole.SecretIdFile)
+			if err != nil {
+				return errors.Wrap(err, "failed to read vault approle secret id")
+			}
+			secretId = strings.TrimSpace(string(buf))
+		}
+		response, err := c.request(http.MethodPost, "auth/"+strings.Trim(appRole.Mount, "/")+"/login", map[string]string{
+			"role_id":   appRole.RoleId,
+			"secret_id": secretId,
+		}, "")
+		if err != nil {
+			return errors.Wrap(err, "failed to login into vault with approle")
+		}
+		if response.Auth == nil || response.Auth.ClientToken == "" {
+			return errors.New("vault approle login response has no token")
+		}
+		c.setToken(
+			response.Auth.ClientToken,
+			time.Duration(response.Auth.LeaseDuration)*time.Second,
+			response.Auth.Renewable,
+		)
+		return nil
+	}
+
+	token := c.Config.Token
+	if token == "" && c.Config.TokenFile != "" {
+		buf, err := ioutil.ReadFile(c.Config.TokenFile)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to read vault token file")
+		}
+		token = strings.TrimSpace(string(buf))
+	}
+	if token == "" {
+		return errors.New("no vault credentials configured, set token, token file or approle")
+	}
+
+	// NOTE: token may have no permission to lookup itself, so it is used without renewal in this case
+	var (
+		ttl       time.Duration
+		renewable bool
+	)
+	response, err := c.request(http.MethodGet, "auth/token/lookup-self", nil, token)
+	if err == nil {
+		if value, ok := response.Data["ttl"].(float64); ok {
+			ttl = time.Duration(value) * time.Second
+		}
+		renewable, _ = response.Data["renewable"].(bool)
+	}
+	c.setToken(token, ttl, renewable)
+	return nil
+}
+
+func (c *VaultClient) renew() error {
+	response, err := c.request(http.MethodPost, "auth/token/renew-self", map[string]string{}, string(c.token.Bytes()))
+	if err != nil {
+		return err
+	}
+	if response.Auth == nil {
+		return errors.New("vault token renewal response has no auth information")
+	}
+	c.setToken(
+		string(c.token.Bytes()),
+		time.Duration(response.Auth.LeaseDuration)*time.Second,
+		response.Auth.Renewable,
+	)
+	return nil
+}
+
+// refresh renews token (AppRole login is repeated if renewal is not possible)
+// when less than a half of its TTL remains, lock should be held by the caller.
+func (c *VaultClient) refresh() error {
+	if c.tokenExpires.IsZero() || time.Until(c.tokenExpires) >= c.tokenTTL/2 {
+		return nil
+	}
+	var err error
+	if c.tokenRenewable {
+		err = c.renew()
+	}
+	if (err != nil || !c.tokenRenewable) && c.Config.AppRole != nil {
+		err = c.login()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to renew vault token")
+	}
+	return nil
+}
+
+// renewable reports whether token could be refreshed, lock should be held by the caller.
+func (c *VaultClient) renewable() bool {
+	return c.token != nil && !c.tokenExpires.IsZero() && (c.tokenRenewable || c.Config.AppRole != nil)
+}
+
+// renewer refreshes token in background when a half of its TTL passes until done is closed.
+// NOTE: failures are not fatal here, they are reported by Token when token is used
+func (c *VaultClient) renewer(done chan struct{}) {
+	wait := time.Duration(0)
+	for {
+		c.lock.Lock()
+		if !c.renewable() {
+			if c.renewerDone == done {
+				c.renewerDone = nil
+			}
+			c.lock.Unlock()
+			return
+		}
+		if wait == 0 {
+			wait = time.Until(c.tokenExpires) - c.tokenTTL/2
+		}
+		c.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		c.lock.Lock()
+		wait = 0
+		if c.token != nil && c.refresh() != nil {
+			wait = VaultRenewRetryWait
+		}
+		c.lock.Unlock()
+	}
+}
+
+// Token returns token to authenticate requests with,
+// it is renewed when less than a half of its TTL remains (AppRole login is repeated if renewal is not possible).
+func (c *VaultClient) Token() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.token == nil {
+		err := c.login()
+		if err != nil {
+			return "", err
+		}
+	} else {
+		err := c.refresh()
+		if err != nil {
+			return "", err
+		}
+	}
+	if c.renewerDone == nil && c.renewable() {
+		c.renewerDone = make(chan struct{})
+		go c.renewer(c.renewerDone)
+	}
+	return string(c.token.Bytes()), nil
+}
+
+// MountVersion returns KV mount path & version of the secrets engine path belongs to.
+func (c *VaultClient) MountVersion(path, token string) (string, int, error) {
+	if c.Config.KvVersion != 0 {
+		return strings.SplitN(path, "/", 2)[0] + "/", c.Config.KvVersion, nil
+	}
+
+	c.lock.Lock()
+	for mount, version := range c.mounts {
+		if strings.HasPrefix(path+"/", mount) {
+			c.lock.Unlock()
+			return mount, version, nil
+		}
+	}
+	c.lock.Unlock()
+
+	response, err := c.request(http.MethodGet, "sys/internal/ui/mounts/"+path, nil, token)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "failed to detect kv version of %q (set kv version explicitly if token is not allowed to)", path)
+	}
+	mount, _ := response.Data["path"].(string)
+	if mount == "" {
+		return "", 0, errors.Errorf("failed to detect mount of %q", path)
+	}
+	version := 1
+	if options, ok := response.Data["options"].(map[string]interface{}); ok {
+		if value, ok := options["version"].(string); ok && value == "2" {
+			version = 2
+		}
+	}
+
+	c.lock.Lock()
+	c.mounts[mount] = version
+	c.lock.Unlock()
+
+	return mount, version, nil
+}
+
+// Read returns data of the KV secret.
+func (c *VaultClient) Read(path string) (map[string]interface{}, error) {
+	token, err := c.Token()
+	if err != nil {
+		return nil, err
+	}
+	mount, version, err := c.MountVersion(path, token)
+	if err != nil {
+		return nil, err
+	}
+
+	apiPath := path
+	if version == 2 {
+		apiPath = mount + "data/" + strings.TrimPrefix(path, mount)
+	}
+	response, err := c.request(http.MethodGet, apiPath, nil, token)
+	if err != nil {
+		if e, ok := err.(*vaultStatusError); ok && e.Status == http.StatusNotFound {
+			return nil, errors.Errorf("vault secret %q not found", path)
+		}
+		return nil, errors.Wrapf(err, "failed to read vault secret %q", path)
+	}
+
+	data := response.Data
+	if version == 2 {
+		data, _ = data["data"].(map[string]interface{})
+		if data == nil {
+			return nil, errors.Errorf("vault secret %q is deleted", path)
+		}
+	}
+	return data, nil
+}
+
+func (c *VaultClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.renewerDone != nil {
+		close(c.renewerDone)
+		c.renewerDone = nil
+	}
+	if c.token != nil {
+		c.token.Destroy()
+		c.token = nil
+	}
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+func NewVaultClient(config *VaultConfig) (*VaultClient, error) {
+	config = config.WithDefaults()
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &VaultClient{
+		Config: config,
+		http:   &http.Client{Transport: transport},
+		mounts: map[string]int{},
+	}, nil
+}
+
+//
+
+func (p *SecretsProviderVault) Name() string {
+	return string(SecretsProviderNameVault)
+}
+
+// Get returns field of the secret (source is secret/myapp/db#password),
+// all fields are returned as JSON if field is not specified.
+func (p *SecretsProviderVault) Get(source string) ([]byte, error) {
+	path, field := VaultSplitSource(source)
+	data, err := p.Client.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if field == "" {
+		return json.Marshal(data)
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return nil, errors.Errorf("field %q not found in vault secret %q", field, path)
+	}
+	if s, ok := value.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(value)
+}
+
+func NewSecretsProviderVault(client *VaultClient) *SecretsProviderVault {
+	return &SecretsProviderVault{Client: client}
+}
+
+var (
+	_ SecretsProvider = &SecretsProviderVault{}
+)
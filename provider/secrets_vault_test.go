@@ -0,0 +1,205 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// vaultDevServer is a stand-in for `vault server -dev` with KV v2 at secret/, KV v1 at kv/ and approle auth.
+type vaultDevServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	tokenTTL int
+	renewals int
+	logins   int
+}
+
+func newVaultDevServer(t *testing.T) *vaultDevServer {
+	s := &vaultDevServer{tokenTTL: 3600}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		reply := func(status int, v interface{}) {
+			w.WriteHeader(status)
+			_ = json.NewEncoder(w).Encode(v)
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+		if path == "auth/approle/login" {
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			if body["role_id"] != "role" || body["secret_id"] != "secret" {
+				reply(http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid role or secret ID"}})
+				return
+			}
+			s.logins++
+			reply(http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{
+				"client_token": "approle-token", "lease_duration": s.tokenTTL, "renewable": false,
+			}})
+			return
+		}
+
+		token := r.Header.Get("X-Vault-Token")
+		if token != "root" && token != "approle-token" {
+			reply(http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		if r.Header.Get("X-Vault-Namespace") != "team" {
+			reply(http.StatusNotFound, map[string]interface{}{"errors": []string{"no handler for route"}})
+			return
+		}
+
+		switch {
+		case path == "auth/token/lookup-self":
+			reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": s.tokenTTL, "renewable": true}})
+		case path == "auth/token/renew-self":
+			s.renewals++
+			reply(http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{
+				"client_token": token, "lease_duration": 3600, "renewable": true,
+			}})
+		case strings.HasPrefix(path, "sys/internal/ui/mounts/secret/"):
+			reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+				"path": "secret/", "type": "kv", "options": map[string]interface{}{"version": "2"},
+			}})
+		case strings.HasPrefix(path, "sys/internal/ui/mounts/kv/"):
+			reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+				"path": "kv/", "type": "kv", "options": nil,
+			}})
+		case path == "secret/data/myapp/db":
+			reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]interface{}{"password": "hunter2", "port": 5432},
+				"metadata": map[string]interface{}{"version": 1},
+			}})
+		case path == "kv/legacy":
+			reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"token": "s3cr3t"}})
+		default:
+			reply(http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSecretsProviderVault(t *testing.T) {
+	server := newVaultDevServer(t)
+
+	client, err := NewVaultClient(&VaultConfig{Address: server.URL, Namespace: "team", Token: "root"})
+	assert.NoError(t, err)
+	defer client.Close()
+	provider := NewSecretsProviderVault(client)
+
+	for source, expected := range map[string]string{
+		"secret/myapp/db#password": "hunter2",
+		"secret/myapp/db#port":     "5432",
+		"secret/myapp/db":          `{"password":"hunter2","port":5432}`,
+		"kv/legacy#token":          "s3cr3t",
+	} {
+		buf, err := provider.Get(source)
+		assert.NoError(t, err, source)
+		assert.Equal(t, expected, string(buf), source)
+	}
+
+	_, err = provider.Get("secret/myapp/db#missing")
+	assert.ErrorContains(t, err, `field "missing" not found`)
+	_, err = provider.Get("secret/myapp/missing#password")
+	assert.ErrorContains(t, err, "not found")
+
+	// NOTE: token is renewed when less than a half of its ttl remains
+	client.lock.Lock()
+	client.tokenExpires = time.Now().Add(time.Minute)
+	client.lock.Unlock()
+	_, err = provider.Get("kv/legacy#token")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.renewals)
+	_, err = provider.Get("kv/legacy#token")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.renewals)
+}
+
+func TestVaultClientRenewer(t *testing.T) {
+	server := newVaultDevServer(t)
+	server.tokenTTL = 2
+
+	client, err := NewVaultClient(&VaultConfig{Address: server.URL, Namespace: "team", Token: "root"})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Token()
+	assert.NoError(t, err)
+
+	// NOTE: token is renewed in background when a half of its ttl passes, no secrets are read meanwhile
+	renewals := func() int {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		return server.renewals
+	}
+	assert.Eventually(t, func() bool { return renewals() == 1 }, 5*time.Second, 50*time.Millisecond)
+
+	client.lock.Lock()
+	assert.Equal(t, time.Hour, client.tokenTTL)
+	assert.NotNil(t, client.renewerDone)
+	client.lock.Unlock()
+
+	assert.NoError(t, client.Close())
+	client.lock.Lock()
+	assert.Nil(t, client.renewerDone)
+	client.lock.Unlock()
+}
+
+func TestSecretsProviderVaultAppRole(t *testing.T) {
+	server := newVaultDevServer(t)
+
+	client, err := NewVaultClient(&VaultConfig{
+		Address:   server.URL,
+		Namespace: "team",
+		AppRole:   &VaultAppRole{RoleId: "role", SecretId: "secret"},
+		KvVersion: 2,
+	})
+	assert.NoError(t, err)
+	defer client.Close()
+	provider := NewSecretsProviderVault(client)
+
+	buf, err := provider.Get("secret/myapp/db#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", string(buf))
+	assert.Equal(t, 1, server.logins)
+
+	// NOTE: approle tokens which are not renewable are obtained with login again
+	client.lock.Lock()
+	client.tokenExpires = time.Now().Add(time.Minute)
+	client.lock.Unlock()
+	_, err = provider.Get("secret/myapp/db#password")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, server.renewals)
+	assert.Equal(t, 2, server.logins)
+
+	client, err = NewVaultClient(&VaultConfig{
+		Address:   server.URL,
+		Namespace: "team",
+		AppRole:   &VaultAppRole{RoleId: "role", SecretId: "wrong"},
+	})
+	assert.NoError(t, err)
+	_, err = NewSecretsProviderVault(client).Get("secret/myapp/db#password")
+	assert.ErrorContains(t, err, "invalid role or secret ID")
+}
+
+func TestVaultConfigPoolKey(t *testing.T) {
+	config := &VaultConfig{Address: "https://vault:8200", Namespace: "team", Token: "s.hunter2"}
+	key := config.PoolKey()
+	assert.NotContains(t, key, "hunter2")
+	assert.Equal(t, key, (&VaultConfig{Address: "https://vault:8200", Namespace: "team", Token: "s.hunter2"}).PoolKey())
+	assert.NotEqual(t, key, (&VaultConfig{Address: "https://vault:8200", Namespace: "team", Token: "s.other"}).PoolKey())
+
+	config.AppRole = &VaultAppRole{RoleId: "role", SecretId: "s3cr3t"}
+	assert.NotContains(t, config.PoolKey(), "s3cr3t")
+	assert.NotEqual(t, key, config.PoolKey())
+}
@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Semaphore limits amount of concurrent operations shared between resources.
+type Semaphore struct {
+	Name  string
+	slots chan struct{}
+}
+
+// Acquire waits for free slot and returns function which releases it.
+// Waiting time is logged so operators could see why resource is queued.
+func (s *Semaphore) Acquire(ctx context.Context) (func(), error) {
+	if s.slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-s.slots }
+
+	select {
+	case s.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	started := time.Now()
+	tflog.Info(ctx, fmt.Sprintf(
+		"waiting for %s slot, all %d slots are in use",
+		s.Name, cap(s.slots),
+	))
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	tflog.Info(ctx, fmt.Sprintf(
+		"acquired %s slot after waiting for %s",
+		s.Name, time.Since(started),
+	))
+
+	return release, nil
+}
+
+// NewSemaphore creates semaphore with size slots, size <= 0 means unlimited.
+func NewSemaphore(name string, size int) *Semaphore {
+	s := &Semaphore{Name: name}
+	if size > 0 {
+		s.slots = make(chan struct{}, size)
+	}
+	return s
+}
@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSemaphoreLimit(t *testing.T) {
+	var (
+		semaphore = NewSemaphore("build", 2)
+		active    int32
+		peak      int32
+		wg        sync.WaitGroup
+	)
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := semaphore.Acquire(context.Background())
+			assert.NoError(t, err)
+			defer release()
+
+			current := atomic.AddInt32(&active, 1)
+			for {
+				max := atomic.LoadInt32(&peak)
+				if current <= max || atomic.CompareAndSwapInt32(&peak, max, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), peak)
+}
+
+func TestSemaphoreCancel(t *testing.T) {
+	semaphore := NewSemaphore("copy", 1)
+	release, err := semaphore.Acquire(context.Background())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := make(chan error)
+	go func() {
+		_, err := semaphore.Acquire(ctx)
+		acquired <- err
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("slot is acquired while all slots are in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	assert.ErrorIs(t, <-acquired, context.Canceled)
+
+	// NOTE: cancelled waiter should not hold the slot
+	release()
+	release, err = semaphore.Acquire(context.Background())
+	assert.NoError(t, err)
+	release()
+}
+
+func TestSemaphoreUnlimited(t *testing.T) {
+	semaphore := NewSemaphore("activation", 0)
+	for n := 0; n < 100; n++ {
+		_, err := semaphore.Acquire(context.Background())
+		assert.NoError(t, err)
+	}
+}
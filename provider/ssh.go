@@ -1,93 +1,260 @@
 package provider
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type (
 	Ssh struct {
-		Arguments  []string
-		Finalizers []func()
-	}
-	SshOption         func(*Ssh)
-	SshFinalizer      func(*Ssh)
-	SshConfigKeyValue struct {
-		Key   string
-		Value string
-	}
-	SshConfigPairs = []SshConfigKeyValue
-	SshConfigMap   struct {
-		index map[string]int
-		store SshConfigPairs
+		Arguments   []string
+		Finalizers  []func()
+		Environment Environment
+		// Become escalates privileges of remote commands executed with this ssh.
+		Become *Become
+		// Client is a native connection, when set remote commands
+		// are executed with it instead of ssh(1).
+		Client *SshClient
 	}
+	SshOption    func(*Ssh)
+	SshFinalizer func(*Ssh)
+)
+
+const (
+	SshConfigKeyHost         = "host"
+	SshConfigKeyUser         = "user"
+	SshConfigKeyPort         = "port"
+	SshConfigKeyProxyCommand = "proxyCommand"
+
+	SshConfigKeyControlMaster  = "controlMaster"
+	SshConfigKeyControlPath    = "controlPath"
+	SshConfigKeyControlPersist = "controlPersist"
+
+	SshConfigKeyHostKeyAlias          = "hostKeyAlias"
+	SshConfigKeyHostKeyAlgorithms     = "hostKeyAlgorithms"
+	SshConfigKeyUserKnownHostsFile    = "userKnownHostsFile"
+	SshConfigKeyGlobalKnownHostsFile  = "globalKnownHostsFile"
+	SshConfigKeyStrictHostKeyChecking = "strictHostKeyChecking"
+	SshConfigKeyHashKnownHosts        = "hashKnownHosts"
+
+	SshConfigKeyIdentityAgent                = "identityAgent"
+	SshConfigKeyPasswordAuthentication       = "passwordAuthentication"
+	SshConfigKeyKbdInteractiveAuthentication = "kbdInteractiveAuthentication"
+	SshConfigKeyBatchMode                    = "batchMode"
+)
+
+const (
+	SshCertificateKeyId     = "terraform-provider-nixos"
+	SshCertificateClockSkew = 5 * time.Minute
+)
+
+const (
+	// NOTE: host keys are pinned under aliases, so they do not depend on
+	// address (and port) which was used to connect to the host
+	SshHostKeyAliasTarget = "nixos-target"
+)
+
+const (
+	// SshControlPersist is a time master connection stays open after last client is gone,
+	// masters which are still alive are closed with the provider.
+	SshControlPersist = "60"
 )
 
-func (m *SshConfigMap) Set(key, value string) {
-	lkey := strings.ToLower(key)
-	i, found := m.index[lkey]
-	if found {
-		m.store[i].Value = value
-	} else {
-		m.index[lkey] = len(m.store)
-		m.store = append(m.store, SshConfigKeyValue{
-			Key:   lkey,
-			Value: value,
-		})
+func SshHostKeyAliasBastion(hop int) string {
+	return "nixos-bastion-" + strconv.Itoa(hop)
+}
+
+//
+
+// SshParseHostKey parses host key in authorized_keys format ("ssh-ed25519 AAAA...").
+func SshParseHostKey(key string) (ssh.PublicKey, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse host key %q", key)
 	}
+	return publicKey, nil
 }
 
-func (m *SshConfigMap) Get(key string) (string, bool) {
-	i, found := m.index[strings.ToLower(key)]
-	if !found {
-		return "", false
+// SshKnownHostsLine returns known_hosts line for the key under alias.
+func SshKnownHostsLine(alias string, key string) (string, error) {
+	publicKey, err := SshParseHostKey(key)
+	if err != nil {
+		return "", err
 	}
-	return m.store[i].Value, true
+	return knownhosts.Line([]string{alias}, publicKey) + "\n", nil
 }
 
-func (m *SshConfigMap) Extend(em *SshConfigMap) {
-	for _, pair := range em.Pairs() {
-		m.Set(pair.Key, pair.Value)
+// SshSignCertificate generates ephemeral ed25519 key and signs user certificate for it
+// with the certificate authority private key, certificate is valid for principals during validity
+// (start time is shifted back to tolerate clock skew).
+func SshSignCertificate(authorityKey []byte, principals []string, validity time.Duration) (ed25519.PrivateKey, *ssh.Certificate, error) {
+	authority, err := ssh.ParsePrivateKey(authorityKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse certificate authority key (passphrase protected keys are not supported)")
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	certificate := &ssh.Certificate{
+		Key:             publicKey,
+		CertType:        ssh.UserCert,
+		KeyId:           SshCertificateKeyId,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-SshCertificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":              "",
+				"permit-port-forwarding":  "",
+				"permit-agent-forwarding": "",
+			},
+		},
 	}
+	err = certificate.SignCert(rand.Reader, authority)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, certificate, nil
 }
 
-func (m *SshConfigMap) Copy() *SshConfigMap {
-	nm := NewSshConfigMap()
-	nm.Extend(m)
-	return nm
+// SshKnownHostsKey returns first key (in authorized_keys format) from known_hosts content.
+func SshKnownHostsKey(buf []byte) (string, error) {
+	_, _, publicKey, _, _, err := ssh.ParseKnownHosts(buf)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse known hosts")
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), nil
 }
 
-func (m *SshConfigMap) Len() int {
-	return len(m.store)
+// SshConfigHostKeyPin makes ssh accept only keys from knownHostsFile stored under alias.
+func SshConfigHostKeyPin(m *SshConfigMap, alias string, knownHostsFile string) {
+	m.Set(SshConfigKeyHostKeyAlias, alias)
+	m.Set(SshConfigKeyUserKnownHostsFile, knownHostsFile)
+	m.Set(SshConfigKeyGlobalKnownHostsFile, "/dev/null")
+	m.Set(SshConfigKeyStrictHostKeyChecking, "yes")
 }
 
-func (m *SshConfigMap) Pairs() SshConfigPairs {
-	ps := make(SshConfigPairs, len(m.store))
-	copy(ps, m.store)
+// SshConfigHostKeyObserve makes ssh record host key of one of algorithms into knownHostsFile under alias,
+// password authentication is disabled, so password is never sent to the server which is not verified.
+func SshConfigHostKeyObserve(m *SshConfigMap, alias string, algorithms string, knownHostsFile string) {
+	m.Set(SshConfigKeyHostKeyAlias, alias)
+	m.Set(SshConfigKeyHostKeyAlgorithms, algorithms)
+	m.Set(SshConfigKeyUserKnownHostsFile, knownHostsFile)
+	m.Set(SshConfigKeyGlobalKnownHostsFile, "/dev/null")
+	m.Set(SshConfigKeyStrictHostKeyChecking, "accept-new")
+	m.Set(SshConfigKeyHashKnownHosts, "no")
+	m.Set(SshConfigKeyPasswordAuthentication, "no")
+	m.Set(SshConfigKeyKbdInteractiveAuthentication, "no")
+	m.Set(SshConfigKeyBatchMode, "yes")
+}
 
-	return ps
+// SshHostKeyAlgorithms returns host key algorithms which should be negotiated
+// to receive host key of the same type as hostKey (ed25519 if it is empty).
+func SshHostKeyAlgorithms(hostKey string) string {
+	if hostKey == "" {
+		return ssh.KeyAlgoED25519
+	}
+	publicKey, err := SshParseHostKey(hostKey)
+	if err != nil {
+		return ssh.KeyAlgoED25519
+	}
+	if publicKey.Type() == ssh.KeyAlgoRSA {
+		return strings.Join([]string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}, ",")
+	}
+	return publicKey.Type()
 }
 
-func NewSshConfigMap() *SshConfigMap {
-	return &SshConfigMap{
-		index: map[string]int{},
+// SshHostKeyEqual reports whether host keys are the same (comments are ignored).
+func SshHostKeyEqual(a string, b string) bool {
+	aKey, err := SshParseHostKey(a)
+	if err != nil {
+		return false
+	}
+	bKey, err := SshParseHostKey(b)
+	if err != nil {
+		return false
 	}
+	return bytes.Equal(aKey.Marshal(), bKey.Marshal())
 }
 
-const (
-	SshConfigKeyHost         = "host"
-	SshConfigKeyUser         = "user"
-	SshConfigKeyPort         = "port"
-	SshConfigKeyProxyCommand = "proxyCommand"
+var (
+	// SshConnectionErrors are messages reported by ssh(1) and the native transport
+	// when host could not be reached (as opposed to failures of remote commands).
+	SshConnectionErrors = []string{
+		"connection refused",
+		"connection timed out",
+		"connection reset by peer",
+		"no route to host",
+		"network is unreachable",
+		"host is unreachable",
+		"i/o timeout",
+		"kex_exchange_identification",
+		"connection closed by",
+	}
+	// SshAuthenticationErrors are messages reported by ssh(1) and the native transport
+	// when server rejected all credentials.
+	SshAuthenticationErrors = []string{
+		"permission denied",
+		"unable to authenticate",
+	}
 )
 
-//
+// IsSshConnectionError reports whether err is caused by inability to connect to the host.
+func IsSshConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, connectionError := range SshConnectionErrors {
+		if strings.Contains(message, connectionError) {
+			return true
+		}
+	}
+	return false
+}
 
-func SshSerializeConfig(ps SshConfigPairs) string {
-	var config string
-	for _, v := range ps {
-		config += v.Key + " " + v.Value + "\n"
+// IsSshAuthenticationError reports whether err is caused by rejected credentials.
+func IsSshAuthenticationError(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, authenticationError := range SshAuthenticationErrors {
+		if strings.Contains(message, authenticationError) {
+			return true
+		}
 	}
-	return config
+	return false
+}
+
+// IsSshNotReadyError reports whether err is expected while the host is booting:
+// it is not reachable yet or authorized keys are not installed yet.
+func IsSshNotReadyError(err error) bool {
+	return IsSshConnectionError(err) || IsSshAuthenticationError(err)
+}
+
+// SshProxyCommand returns ProxyCommand value (which is executed by the shell) for command.
+func SshProxyCommand(command string, arguments ...string) string {
+	quoted := make([]string, 0, len(arguments)+1)
+	for _, argument := range append([]string{command}, arguments...) {
+		quoted = append(quoted, ShellQuote(argument))
+	}
+	return strings.Join(quoted, " ")
 }
 
 //
@@ -108,7 +275,7 @@ func SshOptionConfigMap(m *SshConfigMap) SshOption {
 		if err != nil {
 			panic(err)
 		}
-		_, err = fd.Write([]byte(SshSerializeConfig(m.Pairs())))
+		_, err = fd.Write([]byte(SshSerializeConfig(m)))
 		if err != nil {
 			panic(err)
 		}
@@ -130,6 +297,30 @@ func SshOptionCommand(cmd string) SshOption {
 	}
 }
 
+func SshOptionControl(path string, command string) SshOption {
+	return func(s *Ssh) {
+		s.Arguments = append(s.Arguments, "-o", SshConfigKeyControlPath+"="+path, "-O", command)
+	}
+}
+
+func SshOptionEnv(env Environment) SshOption {
+	return func(s *Ssh) {
+		s.Environment = s.Environment.With(env)
+	}
+}
+
+func SshOptionBecome(become *Become) SshOption {
+	return func(s *Ssh) {
+		s.Become = become
+	}
+}
+
+func SshOptionFinalizers(finalizers ...func()) SshOption {
+	return func(s *Ssh) {
+		s.Finalizers = append(s.Finalizers, finalizers...)
+	}
+}
+
 func SshOptionNonInteractive() SshOption {
 	return func(s *Ssh) {
 		s.Arguments = append(s.Arguments, "-N")
@@ -142,6 +333,12 @@ func SshOptionIORedirection(host, port string) SshOption {
 	}
 }
 
+func SshOptionClient(client *SshClient) SshOption {
+	return func(s *Ssh) {
+		s.Client = client
+	}
+}
+
 //
 
 func SshFinalizerFile(fd File) SshFinalizer {
@@ -157,8 +354,11 @@ func SshFinalizerFile(fd File) SshFinalizer {
 
 func (s *Ssh) With(options ...SshOption) *Ssh {
 	ss := &Ssh{
-		Arguments:  make([]string, len(s.Arguments)),
-		Finalizers: make([]func(), len(s.Finalizers)),
+		Arguments:   make([]string, len(s.Arguments)),
+		Finalizers:  make([]func(), len(s.Finalizers)),
+		Environment: s.Environment.Copy(),
+		Become:      s.Become,
+		Client:      s.Client,
 	}
 	copy(ss.Arguments, s.Arguments)
 	copy(ss.Finalizers, s.Finalizers)
@@ -170,7 +370,11 @@ func (s *Ssh) With(options ...SshOption) *Ssh {
 }
 
 func (s *Ssh) Command() (string, []string, []CommandOption) {
-	return "ssh", s.Arguments, nil
+	var options []CommandOption
+	if len(s.Environment) > 0 {
+		options = append(options, CommandOptionEnv(s.Environment))
+	}
+	return "ssh", s.Arguments, options
 }
 
 func (s *Ssh) Execute(result interface{}) error {
@@ -0,0 +1,286 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type (
+	// SshAgent is an in-process ssh-agent which keeps private keys in locked memory,
+	// keys are parsed only for the time of signing.
+	SshAgent struct {
+		Path string
+
+		lock sync.Mutex
+
+		listener net.Listener
+		keys     []*sshAgentKey
+		sources  map[string]bool
+	}
+	sshAgentKey struct {
+		publicKey ssh.PublicKey
+		comment   string
+		buffer    *LockedBuffer
+		signer    func([]byte) (ssh.Signer, func(), error)
+		expires   time.Time
+	}
+)
+
+var (
+	_ agent.ExtendedAgent = &SshAgent{}
+)
+
+func (a *SshAgent) find(key ssh.PublicKey) *sshAgentKey {
+	a.expire()
+	blob := key.Marshal()
+	for _, k := range a.keys {
+		if bytes.Equal(k.publicKey.Marshal(), blob) {
+			return k
+		}
+	}
+	return nil
+}
+
+func sshAgentParseKey(buf []byte) (ssh.Signer, func(), error) {
+	signer, err := ssh.ParsePrivateKey(buf)
+	return signer, func() {}, err
+}
+
+// sshAgentEd25519Key returns signer for raw ed25519 key,
+// key is copied out of locked memory (crypto/ed25519 could not use it) and wiped after use.
+func sshAgentEd25519Key(buf []byte) (ssh.Signer, func(), error) {
+	key := make(ed25519.PrivateKey, len(buf))
+	copy(key, buf)
+	wipe := func() {
+		for n := range key {
+			key[n] = 0
+		}
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		wipe()
+		return nil, nil, err
+	}
+	return signer, wipe, nil
+}
+
+// expire removes keys which lifetime is over.
+func (a *SshAgent) expire() {
+	now := time.Now()
+	keys := a.keys[:0]
+	for _, k := range a.keys {
+		if !k.expires.IsZero() && now.After(k.expires) {
+			k.buffer.Destroy()
+			continue
+		}
+		keys = append(keys, k)
+	}
+	for n := len(keys); n < len(a.keys); n++ {
+		a.keys[n] = nil
+	}
+	a.keys = keys
+}
+
+// AddSource adds private key (in PEM/OpenSSH format) retrieved from the secrets provider.
+// Key is loaded only once per source.
+func (a *SshAgent) AddSource(provider SecretsProvider, source string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	id := provider.Name() + ":" + source
+	if a.sources[id] {
+		return nil
+	}
+
+	buf, err := provider.Get(source)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get ssh private key %q from %q secrets provider", source, provider.Name())
+	}
+	buffer := NewLockedBuffer(buf)
+
+	signer, err := ssh.ParsePrivateKey(buffer.Bytes())
+	if err != nil {
+		buffer.Destroy()
+		return errors.Wrapf(err, "failed to parse ssh private key %q (passphrase protected keys are not supported)", source)
+	}
+
+	if a.find(signer.PublicKey()) != nil {
+		buffer.Destroy()
+	} else {
+		a.keys = append(a.keys, &sshAgentKey{
+			publicKey: signer.PublicKey(),
+			comment:   id,
+			buffer:    buffer,
+			signer:    sshAgentParseKey,
+		})
+	}
+	a.sources[id] = true
+
+	return nil
+}
+
+func (a *SshAgent) List() ([]*agent.Key, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.expire()
+	keys := make([]*agent.Key, len(a.keys))
+	for n, k := range a.keys {
+		keys[n] = &agent.Key{
+			Format:  k.publicKey.Type(),
+			Blob:    k.publicKey.Marshal(),
+			Comment: k.comment,
+		}
+	}
+	return keys, nil
+}
+
+func (a *SshAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *SshAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	k := a.find(key)
+	if k == nil {
+		return nil, errors.New("key not found")
+	}
+	signer, wipe, err := k.signer(k.buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer wipe()
+
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if ok {
+		switch {
+		case flags&agent.SignatureFlagRsaSha256 != 0:
+			return algorithmSigner.SignWithAlgorithm(nil, data, ssh.KeyAlgoRSASHA256)
+		case flags&agent.SignatureFlagRsaSha512 != 0:
+			return algorithmSigner.SignWithAlgorithm(nil, data, ssh.KeyAlgoRSASHA512)
+		}
+	}
+	return signer.Sign(nil, data)
+}
+
+func (a *SshAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("signers are not exported by the agent")
+}
+
+// Add adds ed25519 private key (optionally with certificate) which is used for the key lifetime,
+// it is meant for ephemeral keys, memory of the private key is wiped.
+func (a *SshAgent) Add(key agent.AddedKey) error {
+	var privateKey ed25519.PrivateKey
+	switch k := key.PrivateKey.(type) {
+	case ed25519.PrivateKey:
+		privateKey = k
+	case *ed25519.PrivateKey:
+		privateKey = *k
+	default:
+		return errors.Errorf("adding %T keys is not supported", key.PrivateKey)
+	}
+
+	var publicKey ssh.PublicKey = key.Certificate
+	if key.Certificate == nil {
+		var err error
+		publicKey, err = ssh.NewPublicKey(privateKey.Public())
+		if err != nil {
+			return err
+		}
+	}
+	k := &sshAgentKey{
+		publicKey: publicKey,
+		comment:   key.Comment,
+		buffer:    NewLockedBuffer(privateKey),
+		signer:    sshAgentEd25519Key,
+	}
+	if key.LifetimeSecs > 0 {
+		k.expires = time.Now().Add(time.Duration(key.LifetimeSecs) * time.Second)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.keys = append(a.keys, k)
+	return nil
+}
+
+func (a *SshAgent) Remove(key ssh.PublicKey) error {
+	return errors.New("removing keys is not supported")
+}
+
+func (a *SshAgent) RemoveAll() error {
+	return errors.New("removing keys is not supported")
+}
+
+func (a *SshAgent) Lock(passphrase []byte) error {
+	return errors.New("locking is not supported")
+}
+
+func (a *SshAgent) Unlock(passphrase []byte) error {
+	return errors.New("locking is not supported")
+}
+
+func (a *SshAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+//
+
+func (a *SshAgent) serve() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = agent.ServeAgent(a, conn)
+		}()
+	}
+}
+
+func (a *SshAgent) Close() error {
+	err := a.listener.Close()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, k := range a.keys {
+		k.buffer.Destroy()
+	}
+	a.keys = nil
+
+	return err
+}
+
+// NewSshAgent starts agent listening on unix socket at path.
+func NewSshAgent(path string) (*SshAgent, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen for ssh agent connections on %q", path)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	a := &SshAgent{
+		Path:     path,
+		listener: listener,
+		sources:  map[string]bool{},
+	}
+	go a.serve()
+
+	return a, nil
+}
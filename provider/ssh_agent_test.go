@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSshAgent(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		keyFile = filepath.Join(dir, "id_ecdsa")
+	)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	assert.NoError(t, err)
+
+	a, err := NewSshAgent(filepath.Join(dir, "agent"))
+	assert.NoError(t, err)
+	defer a.Close()
+	assert.NoError(t, a.AddSource(NewSecretsProviderFilesystem(), keyFile))
+	assert.NoError(t, a.AddSource(NewSecretsProviderFilesystem(), keyFile))
+
+	conn, err := net.Dial("unix", a.Path)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	signers, err := agent.NewClient(conn).Signers()
+	assert.NoError(t, err)
+	assert.Len(t, signers, 1)
+
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	signature, err := signers[0].Sign(rand.Reader, []byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, publicKey.Verify([]byte("data"), signature))
+}
+
+func TestSshAskpass(t *testing.T) {
+	var (
+		dir          = t.TempDir()
+		passwordFile = filepath.Join(dir, "password")
+	)
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("secret"), 0600))
+
+	a, err := NewSshAskpass(filepath.Join(dir, "askpass"))
+	assert.NoError(t, err)
+	defer a.Close()
+	assert.NoError(t, a.AddSource(NewSecretsProviderFilesystem(), passwordFile, "root", "10.0.0.1"))
+
+	for _, prompt := range []string{
+		"root@10.0.0.1's password: ",
+		"(root@10.0.0.1) Password: ",
+	} {
+		password := bytes.NewBuffer(nil)
+		assert.NoError(t, SshAskpassMain(a.Path, prompt, password))
+		assert.Equal(t, "secret\n", password.String())
+	}
+
+	assert.Error(t, SshAskpassMain(a.Path, "admin@10.0.0.1's password: ", bytes.NewBuffer(nil)))
+}
+
+func TestSshAgentCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	authority, err := ssh.NewPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	privateKey, certificate, err := SshSignCertificate(
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		[]string{"deploy"}, time.Minute,
+	)
+	assert.NoError(t, err)
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), authority.Marshal())
+		},
+	}
+	assert.NoError(t, checker.CheckCert("deploy", certificate))
+	assert.Error(t, checker.CheckCert("root", certificate))
+
+	a, err := NewSshAgent(filepath.Join(t.TempDir(), "agent"))
+	assert.NoError(t, err)
+	defer a.Close()
+	assert.NoError(t, a.Add(agent.AddedKey{
+		PrivateKey:   privateKey,
+		Certificate:  certificate,
+		LifetimeSecs: 60,
+	}))
+	for _, b := range privateKey {
+		assert.Zero(t, b)
+	}
+
+	conn, err := net.Dial("unix", a.Path)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	signers, err := agent.NewClient(conn).Signers()
+	assert.NoError(t, err)
+	assert.Len(t, signers, 1)
+	assert.Equal(t, certificate.Marshal(), signers[0].PublicKey().Marshal())
+
+	signature, err := signers[0].Sign(rand.Reader, []byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, certificate.Key.Verify([]byte("data"), signature))
+}
@@ -0,0 +1,182 @@
+package provider
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// SshAskpass serves passwords to ssh through SSH_ASKPASS helper,
+	// helper is the provider executable itself which connects to the unix socket
+	// and prints password it received from the provider.
+	SshAskpass struct {
+		Path string
+
+		lock      sync.Mutex
+		listener  net.Listener
+		passwords map[string]*LockedBuffer
+	}
+)
+
+const (
+	// SshAskpassEnvSocket makes provider executable act as SSH_ASKPASS helper.
+	SshAskpassEnvSocket = "TERRAFORM_PROVIDER_NIXOS_ASKPASS_SOCKET"
+)
+
+var (
+	// NOTE: matches "user@host's password: " and "(user@host) Password: "
+	sshAskpassPromptRegexp = regexp.MustCompile(`\(?([^@\s()']+)@([^\s()']+?)(\)|'s password)`)
+)
+
+func sshAskpassKey(user string, host string) string {
+	return user + "@" + host
+}
+
+// AddSource adds password for user@host retrieved from the secrets provider.
+func (a *SshAskpass) AddSource(provider SecretsProvider, source string, user string, host string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := sshAskpassKey(user, host)
+	if _, ok := a.passwords[key]; ok {
+		return nil
+	}
+
+	buf, err := provider.Get(source)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get ssh password %q from %q secrets provider", source, provider.Name())
+	}
+	a.passwords[key] = NewLockedBuffer(buf)
+
+	return nil
+}
+
+// Alias makes password for user@host available for user@alias.
+func (a *SshAskpass) Alias(user string, host string, alias string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	password, ok := a.passwords[sshAskpassKey(user, host)]
+	if ok {
+		a.passwords[sshAskpassKey(user, alias)] = password
+	}
+}
+
+// Password writes password for user@host into w.
+func (a *SshAskpass) Password(user string, host string, w io.Writer) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	password, ok := a.passwords[sshAskpassKey(user, host)]
+	if !ok {
+		return false, nil
+	}
+	_, err := w.Write(password.Bytes())
+	return true, err
+}
+
+// Environment returns variables which make ssh use askpass helper.
+func (a *SshAskpass) Environment() (Environment, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	env := NewEnvironment().
+		Set("SSH_ASKPASS", executable).
+		Set("SSH_ASKPASS_REQUIRE", "force").
+		Set(SshAskpassEnvSocket, a.Path)
+	if os.Getenv("DISPLAY") == "" {
+		// NOTE: ssh before 8.4 uses askpass only when DISPLAY is set
+		env.Set("DISPLAY", "none")
+	}
+	return env, nil
+}
+
+func (a *SshAskpass) handle(conn net.Conn) {
+	defer conn.Close()
+
+	prompt, err := Readln(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	match := sshAskpassPromptRegexp.FindSubmatch(prompt)
+	if match == nil {
+		return
+	}
+	_, _ = a.Password(string(match[1]), string(match[2]), conn)
+}
+
+func (a *SshAskpass) serve() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *SshAskpass) Close() error {
+	err := a.listener.Close()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for key, password := range a.passwords {
+		password.Destroy()
+		delete(a.passwords, key)
+	}
+
+	return err
+}
+
+// NewSshAskpass starts askpass server listening on unix socket at path.
+func NewSshAskpass(path string) (*SshAskpass, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen for ssh askpass connections on %q", path)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	a := &SshAskpass{
+		Path:      path,
+		listener:  listener,
+		passwords: map[string]*LockedBuffer{},
+	}
+	go a.serve()
+
+	return a, nil
+}
+
+// SshAskpassMain is an entrypoint of the askpass helper,
+// it asks provider listening on socket for the password matching prompt.
+func SshAskpassMain(socket string, prompt string, w io.Writer) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(prompt + "\n"))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, conn)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.Errorf("no password for prompt %q", prompt)
+	}
+	_, err = w.Write([]byte("\n"))
+	return err
+}
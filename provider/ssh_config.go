@@ -0,0 +1,319 @@
+package provider
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/pkg/errors"
+)
+
+type (
+	SshConfigKeyValue struct {
+		Key   string
+		Value string
+	}
+	SshConfigPairs = []SshConfigKeyValue
+
+	// SshConfigMap is an ordered list of ssh_config directives,
+	// Set keeps single value per directive, Add appends one more value (IdentityFile, LocalForward, etc).
+	// Host directive is a destination the configuration is scoped to.
+	SshConfigMap struct {
+		store SshConfigPairs
+		// Blocks are conditional (Host or Match) sections which go after directives.
+		Blocks []*SshConfigBlock
+		// Includes are included after everything else,
+		// so directives from this configuration take precedence (first obtained value is used by ssh).
+		Includes []string
+	}
+	SshConfigBlock struct {
+		Condition string
+		Config    *SshConfigMap
+	}
+)
+
+const (
+	SshConfigHostAny = "*"
+
+	SshConfigConditionHost  = "Host"
+	SshConfigConditionMatch = "Match"
+)
+
+var (
+	// SshConfigDirectives are known ssh_config(5) directives (lowercased name to canonical name).
+	SshConfigDirectives = sshConfigDirectives(
+		"AddKeysToAgent", "AddressFamily", "BatchMode", "BindAddress", "BindInterface",
+		"CanonicalDomains", "CanonicalizeFallbackLocal", "CanonicalizeHostname", "CanonicalizeMaxDots",
+		"CanonicalizePermittedCNAMEs", "CASignatureAlgorithms", "CertificateFile", "ChallengeResponseAuthentication",
+		"ChannelTimeout", "CheckHostIP", "Ciphers", "ClearAllForwardings", "Compression", "ConnectionAttempts",
+		"ConnectTimeout", "ControlMaster", "ControlPath", "ControlPersist", "DynamicForward",
+		"EnableEscapeCommandline", "EnableSSHKeysign", "EscapeChar", "ExitOnForwardFailure", "FingerprintHash",
+		"ForkAfterAuthentication", "ForwardAgent", "ForwardX11", "ForwardX11Timeout", "ForwardX11Trusted",
+		"GatewayPorts", "GlobalKnownHostsFile", "GSSAPIAuthentication", "GSSAPIDelegateCredentials",
+		"HashKnownHosts", "HostbasedAcceptedAlgorithms", "HostbasedAuthentication", "HostbasedKeyTypes",
+		"HostKeyAlgorithms", "HostKeyAlias", "Hostname", "IdentitiesOnly", "IdentityAgent", "IdentityFile",
+		"IgnoreUnknown", "IPQoS", "KbdInteractiveAuthentication", "KbdInteractiveDevices", "KexAlgorithms",
+		"KnownHostsCommand", "LocalCommand", "LocalForward", "LogLevel", "LogVerbose", "MACs",
+		"NoHostAuthenticationForLocalhost", "NumberOfPasswordPrompts", "ObscureKeystrokeTiming",
+		"PasswordAuthentication", "PermitLocalCommand", "PermitRemoteOpen", "PKCS11Provider", "Port",
+		"PreferredAuthentications", "ProxyCommand", "ProxyJump", "ProxyUseFdpass", "PubkeyAcceptedAlgorithms",
+		"PubkeyAcceptedKeyTypes", "PubkeyAuthentication", "RekeyLimit", "RemoteCommand", "RemoteForward",
+		"RequestTTY", "RequiredRSASize", "RevokedHostKeys", "SecurityKeyProvider", "SendEnv",
+		"ServerAliveCountMax", "ServerAliveInterval", "SessionType", "SetEnv", "StdinNull",
+		"StreamLocalBindMask", "StreamLocalBindUnlink", "StrictHostKeyChecking", "SyslogFacility", "Tag",
+		"TCPKeepAlive", "Tunnel", "TunnelDevice", "UpdateHostKeys", "User", "UserKnownHostsFile",
+		"VerifyHostKeyDNS", "VisualHostKey", "XAuthLocation",
+	)
+	// SshConfigMultiValued are directives which accumulate values instead of using the first one.
+	SshConfigMultiValued = map[string]bool{
+		"certificatefile": true,
+		"dynamicforward":  true,
+		"identityfile":    true,
+		"localforward":    true,
+		"remoteforward":   true,
+		"sendenv":         true,
+		"setenv":          true,
+	}
+)
+
+func sshConfigDirectives(names ...string) map[string]string {
+	directives := make(map[string]string, len(names))
+	for _, name := range names {
+		directives[strings.ToLower(name)] = name
+	}
+	return directives
+}
+
+// SshConfigCanonicalKey returns directive name as it is spelled in ssh_config(5),
+// unknown names are returned as is.
+func SshConfigCanonicalKey(key string) string {
+	lkey := strings.ToLower(key)
+	if lkey == SshConfigKeyHost {
+		return SshConfigConditionHost
+	}
+	if name, ok := SshConfigDirectives[lkey]; ok {
+		return name
+	}
+	return key
+}
+
+// Set replaces all values of the directive with value.
+func (m *SshConfigMap) Set(key, value string) {
+	key = SshConfigCanonicalKey(key)
+	for n, pair := range m.store {
+		if strings.EqualFold(pair.Key, key) {
+			m.store[n].Value = value
+			m.remove(key, n+1)
+			return
+		}
+	}
+	m.store = append(m.store, SshConfigKeyValue{Key: key, Value: value})
+}
+
+// Add appends value of the directive (for multi-valued directives),
+// for other directives it is the same as Set.
+func (m *SshConfigMap) Add(key, value string) {
+	if !SshConfigMultiValued[strings.ToLower(key)] {
+		m.Set(key, value)
+		return
+	}
+	m.store = append(m.store, SshConfigKeyValue{Key: SshConfigCanonicalKey(key), Value: value})
+}
+
+func (m *SshConfigMap) remove(key string, from int) {
+	store := m.store[:from]
+	for _, pair := range m.store[from:] {
+		if !strings.EqualFold(pair.Key, key) {
+			store = append(store, pair)
+		}
+	}
+	m.store = store
+}
+
+// Get returns first value of the directive.
+func (m *SshConfigMap) Get(key string) (string, bool) {
+	for _, pair := range m.store {
+		if strings.EqualFold(pair.Key, key) {
+			return pair.Value, true
+		}
+	}
+	return "", false
+}
+
+// Values returns all values of the directive in order.
+func (m *SshConfigMap) Values(key string) []string {
+	values := []string{}
+	for _, pair := range m.store {
+		if strings.EqualFold(pair.Key, key) {
+			values = append(values, pair.Value)
+		}
+	}
+	return values
+}
+
+// Extend overrides directives with directives from em (all values of directive are replaced),
+// blocks & includes of em are appended.
+func (m *SshConfigMap) Extend(em *SshConfigMap) {
+	replaced := map[string]bool{}
+	for _, pair := range em.Pairs() {
+		lkey := strings.ToLower(pair.Key)
+		if !replaced[lkey] {
+			m.Set(pair.Key, pair.Value)
+			replaced[lkey] = true
+			continue
+		}
+		m.store = append(m.store, pair)
+	}
+	for _, block := range em.Blocks {
+		m.AddBlock(block.Condition, block.Config)
+	}
+	for _, include := range em.Includes {
+		m.AddInclude(include)
+	}
+}
+
+func (m *SshConfigMap) AddBlock(condition string, config *SshConfigMap) {
+	m.Blocks = append(m.Blocks, &SshConfigBlock{
+		Condition: condition,
+		Config:    config.Copy(),
+	})
+}
+
+func (m *SshConfigMap) AddInclude(path string) {
+	for _, include := range m.Includes {
+		if include == path {
+			return
+		}
+	}
+	m.Includes = append(m.Includes, path)
+}
+
+func (m *SshConfigMap) Copy() *SshConfigMap {
+	nm := NewSshConfigMap()
+	nm.Extend(m)
+	return nm
+}
+
+func (m *SshConfigMap) Len() int {
+	return len(m.store) + len(m.Blocks) + len(m.Includes)
+}
+
+// Pairs returns directives (without blocks & includes).
+func (m *SshConfigMap) Pairs() SshConfigPairs {
+	ps := make(SshConfigPairs, len(m.store))
+	copy(ps, m.store)
+
+	return ps
+}
+
+func NewSshConfigMap() *SshConfigMap {
+	return &SshConfigMap{}
+}
+
+//
+
+// SshSerializeConfig renders configuration in ssh_config(5) format,
+// directives are scoped to the Host (any host if it is not set) followed by blocks & includes.
+// NOTE: includes are wrapped into Match all, otherwise they would be scoped to the last block.
+func SshSerializeConfig(m *SshConfigMap) string {
+	var (
+		config strings.Builder
+		host   = SshConfigHostAny
+	)
+	if value, ok := m.Get(SshConfigKeyHost); ok && value != "" {
+		host = value
+	}
+
+	serialize := func(header string, directives SshConfigPairs) {
+		config.WriteString(header + "\n")
+		for _, pair := range directives {
+			if strings.EqualFold(pair.Key, SshConfigKeyHost) {
+				continue
+			}
+			config.WriteString("  " + pair.Key + " " + pair.Value + "\n")
+		}
+	}
+
+	serialize(SshConfigConditionHost+" "+host, m.Pairs())
+	for _, block := range m.Blocks {
+		serialize(block.Condition, block.Config.Pairs())
+	}
+	if len(m.Includes) > 0 {
+		includes := make(SshConfigPairs, len(m.Includes))
+		for n, include := range m.Includes {
+			includes[n] = SshConfigKeyValue{Key: "Include", Value: include}
+		}
+		serialize(SshConfigConditionMatch+" all", includes)
+	}
+	return config.String()
+}
+
+//
+
+// SshConfigValidateDirective checks directive is known and could be set as a directive
+// (Host, Match & Include have dedicated settings).
+func SshConfigValidateDirective(key string) error {
+	lkey := strings.ToLower(key)
+	switch lkey {
+	case strings.ToLower(SshConfigConditionHost), strings.ToLower(SshConfigConditionMatch):
+		return errors.Errorf("ssh configuration directive %q could not be used here, use %q blocks instead", key, KeySshConfigBlock)
+	case "include":
+		return errors.Errorf("ssh configuration directive %q could not be used here, use %q instead", key, KeySshConfigInclude)
+	}
+	if _, ok := SshConfigDirectives[lkey]; !ok {
+		return errors.Errorf("unknown ssh configuration directive %q", key)
+	}
+	return nil
+}
+
+// SshConfigValidateCondition checks block condition starts with Host or Match.
+func SshConfigValidateCondition(condition string) error {
+	fields := strings.Fields(condition)
+	if len(fields) < 2 {
+		return errors.Errorf("ssh configuration block condition %q should have a form of: Host <patterns> or Match <criteria>", condition)
+	}
+	switch strings.ToLower(fields[0]) {
+	case strings.ToLower(SshConfigConditionHost), strings.ToLower(SshConfigConditionMatch):
+		return nil
+	default:
+		return errors.Errorf("ssh configuration block condition %q should start with Host or Match", condition)
+	}
+}
+
+func sshConfigValidateDiag(validate func(string) error) func(interface{}, cty.Path) diag.Diagnostics {
+	return func(value interface{}, path cty.Path) diag.Diagnostics {
+		err := validate(value.(string))
+		if err != nil {
+			return diag.Diagnostics{{
+				Severity:      diag.Error,
+				Summary:       err.Error(),
+				AttributePath: path,
+			}}
+		}
+		return nil
+	}
+}
+
+// SshConfigValidateMapDiag validates keys of the ssh configuration map.
+func SshConfigValidateMapDiag(value interface{}, path cty.Path) diag.Diagnostics {
+	var (
+		diags diag.Diagnostics
+		keys  = []string{}
+	)
+	for key := range value.(map[string]interface{}) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		err := SshConfigValidateDirective(key)
+		if err != nil {
+			diags = append(diags, diag.Diagnostic{
+				Severity:      diag.Error,
+				Summary:       err.Error(),
+				AttributePath: path.IndexString(key),
+			})
+		}
+	}
+	return diags
+}
@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSshConfigMap(t *testing.T) {
+	m := NewSshConfigMap()
+	m.Set("user", "root")
+	m.Add("identityfile", "~/.ssh/id_a")
+	m.Add("IdentityFile", "~/.ssh/id_b")
+	m.Set(SshConfigKeyUser, "deploy")
+	assert.Equal(t, []string{"~/.ssh/id_a", "~/.ssh/id_b"}, m.Values("IDENTITYFILE"))
+
+	hop := NewSshConfigMap()
+	hop.Set(SshConfigKeyHost, "bastion.example")
+	hop.Add("IdentityFile", "~/.ssh/id_bastion")
+	hop.AddBlock("Match user deploy", NewSshConfigMap())
+	hop.AddInclude("~/.ssh/config")
+
+	bastion := m.Copy()
+	bastion.Extend(hop)
+	assert.Equal(t, []string{"~/.ssh/id_bastion"}, bastion.Values("IdentityFile"))
+	assert.Len(t, m.Values("IdentityFile"), 2)
+
+	block := NewSshConfigMap()
+	block.Add("LocalForward", "8080 localhost:80")
+	block.Add("LocalForward", "8443 localhost:443")
+	bastion.AddBlock("Host *.internal", block)
+
+	assert.Equal(t, ""+
+		"Host bastion.example\n"+
+		"  User deploy\n"+
+		"  IdentityFile ~/.ssh/id_bastion\n"+
+		"Match user deploy\n"+
+		"Host *.internal\n"+
+		"  LocalForward 8080 localhost:80\n"+
+		"  LocalForward 8443 localhost:443\n"+
+		"Match all\n"+
+		"  Include ~/.ssh/config\n",
+		SshSerializeConfig(bastion),
+	)
+	assert.Equal(t, "Host *\n  User deploy\n  IdentityFile ~/.ssh/id_a\n  IdentityFile ~/.ssh/id_b\n", SshSerializeConfig(m))
+}
+
+func TestSshConfigValidate(t *testing.T) {
+	assert.NoError(t, SshConfigValidateDirective("identityfile"))
+	assert.NoError(t, SshConfigValidateDirective("ProxyJump"))
+	assert.Error(t, SshConfigValidateDirective("IdentityFiles"))
+	assert.Error(t, SshConfigValidateDirective("Host"))
+	assert.Error(t, SshConfigValidateDirective("Include"))
+
+	assert.NoError(t, SshConfigValidateCondition("Host *.internal"))
+	assert.NoError(t, SshConfigValidateCondition("match user deploy"))
+	assert.Error(t, SshConfigValidateCondition("Host"))
+	assert.Error(t, SshConfigValidateCondition("User deploy"))
+
+	assert.Len(t, SshConfigValidateMapDiag(map[string]interface{}{"user": "root", "foo": "bar"}, nil), 1)
+}
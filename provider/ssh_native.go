@@ -0,0 +1,578 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type (
+	// SshClientConfig is a subset of ssh_config(5) understood by the native transport.
+	SshClientConfig struct {
+		Host                   string
+		Port                   int
+		User                   string
+		IdentityFiles          []string
+		KnownHostsFiles        []string
+		GlobalKnownHostsFiles  []string
+		HostKeyAlias           string
+		HostKeyAlgorithms      []string
+		StrictHostKeyChecking  string
+		PasswordAuthentication bool
+		PasswordCallback       func(user string, host string) (string, error)
+		IdentityAgent          string
+		ServerAliveInterval    time.Duration
+		ConnectTimeout         time.Duration
+		// TunnelPort is a port sshd listens on the target itself,
+		// it differs from Port when target is reached through port forwarding.
+		TunnelPort int
+	}
+
+	// SshClient is a native SSH connection (possibly through jump hosts)
+	// which is reused for all remote commands & nix copy tunnels to the target.
+	SshClient struct {
+		*ssh.Client
+		Config *SshClientConfig
+
+		hops    []*ssh.Client
+		closers []io.Closer
+		done    chan struct{}
+		close   sync.Once
+		err     error
+
+		tunnelLock sync.Mutex
+		tunnel     net.Listener
+	}
+)
+
+const (
+	SshTransportOpenSSH = "openssh"
+	SshTransportNative  = "native"
+)
+
+const (
+	SshDefaultPort                = 22
+	SshDefaultServerAliveInterval = 30 * time.Second
+	SshDefaultConnectTimeout      = 30 * time.Second
+)
+
+var (
+	SshTransports = []string{
+		SshTransportOpenSSH,
+		SshTransportNative,
+	}
+	SshDefaultIdentityFiles = []string{
+		"~/.ssh/id_ed25519",
+		"~/.ssh/id_ecdsa",
+		"~/.ssh/id_rsa",
+	}
+	SshDefaultKnownHostsFiles = []string{
+		"~/.ssh/known_hosts",
+	}
+	SshDefaultGlobalKnownHostsFiles = []string{
+		"/etc/ssh/ssh_known_hosts",
+	}
+)
+
+func sshExpandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+func sshExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+//
+
+func (c *SshClientConfig) Address() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+func (c *SshClientConfig) HostKeyCallback() (ssh.HostKeyCallback, error) {
+	strict := strings.ToLower(c.StrictHostKeyChecking)
+	switch strict {
+	case "no", "off":
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	var (
+		files     = []string{}
+		acceptNew = strict == "accept-new"
+		// NOTE: new keys are recorded into the first user known hosts file (like ssh does)
+		acceptFile string
+	)
+	for n, file := range append(append([]string{}, c.KnownHostsFiles...), c.GlobalKnownHostsFiles...) {
+		file = sshExpandHome(file)
+		if n == 0 && acceptNew {
+			acceptFile = file
+		}
+		if sshExists(file) {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 && !acceptNew {
+		return nil, errors.Errorf(
+			"no known hosts files found at %v to check host key of %q (set strictHostKeyChecking to no to disable checking)",
+			c.KnownHostsFiles, c.Host,
+		)
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return &knownhosts.KeyError{}
+	}
+	if len(files) > 0 {
+		var err error
+		callback, err = knownhosts.New(files...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load known hosts files %v", files)
+		}
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if c.HostKeyAlias != "" {
+			// NOTE: alias is used without port, same as ssh does
+			hostname = net.JoinHostPort(c.HostKeyAlias, strconv.Itoa(SshDefaultPort))
+		}
+		err := callback(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) > 0 {
+				return errors.Wrapf(err, "host key of %q has changed, refusing to connect", c.Host)
+			}
+			if acceptNew && acceptFile != "" {
+				return sshAcceptHostKey(acceptFile, hostname, key)
+			}
+		}
+		return err
+	}, nil
+}
+
+func sshAcceptHostKey(file string, hostname string, key ssh.PublicKey) error {
+	fd, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open known hosts file %q", file)
+	}
+	defer fd.Close()
+
+	_, err = fd.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	return err
+}
+
+func (c *SshClientConfig) AuthMethods() ([]ssh.AuthMethod, []io.Closer, error) {
+	var (
+		methods []ssh.AuthMethod
+		closers []io.Closer
+		signers []ssh.Signer
+	)
+
+	files := c.IdentityFiles
+	explicit := len(files) > 0
+	if !explicit {
+		files = SshDefaultIdentityFiles
+	}
+	for _, file := range files {
+		file = sshExpandHome(file)
+		if !explicit && !sshExists(file) {
+			continue
+		}
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to read identity file %q", file)
+		}
+		signer, err := ssh.ParsePrivateKey(buf)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to parse identity file %q", file)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	socket := c.IdentityAgent
+	if socket == "" || socket == "SSH_AUTH_SOCK" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket != "" && socket != "none" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to connect to ssh agent at %q", socket)
+		}
+		closers = append(closers, conn)
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if c.PasswordCallback != nil {
+		methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+			return c.PasswordCallback(c.User, c.Host)
+		}))
+	} else if c.PasswordAuthentication {
+		methods = append(methods, ssh.Password(""))
+	}
+
+	return methods, closers, nil
+}
+
+// NewSshClientConfig maps ssh_config(5) directives to the native transport configuration.
+// NOTE: conditional blocks & includes are not evaluated by the native transport,
+// configuration which has them is rejected instead of being partially applied.
+func NewSshClientConfig(m *SshConfigMap) (*SshClientConfig, error) {
+	if len(m.Blocks) > 0 {
+		return nil, errors.Errorf("%q is not supported by %q transport, use %q", KeySshConfigBlock, SshTransportNative, SshTransportOpenSSH)
+	}
+	if len(m.Includes) > 0 {
+		return nil, errors.Errorf("%q is not supported by %q transport, use %q", KeySshConfigInclude, SshTransportNative, SshTransportOpenSSH)
+	}
+
+	c := &SshClientConfig{
+		Port:                  SshDefaultPort,
+		TunnelPort:            SshDefaultPort,
+		User:                  DefaultUser,
+		KnownHostsFiles:       SshDefaultKnownHostsFiles,
+		GlobalKnownHostsFiles: SshDefaultGlobalKnownHostsFiles,
+		StrictHostKeyChecking: "yes",
+		ServerAliveInterval:   SshDefaultServerAliveInterval,
+		ConnectTimeout:        SshDefaultConnectTimeout,
+	}
+
+	seconds := func(key string, value string) (time.Duration, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to parse ssh configuration key %q value %q", key, value)
+		}
+		return time.Duration(n) * time.Second, nil
+	}
+
+	var err error
+	for _, pair := range m.Pairs() {
+		switch strings.ToLower(pair.Key) {
+		case SshConfigKeyHost:
+			c.Host = pair.Value
+		case SshConfigKeyUser:
+			c.User = pair.Value
+		case SshConfigKeyPort:
+			c.Port, err = strconv.Atoi(pair.Value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to parse ssh port %q", pair.Value)
+			}
+		case "identityfile":
+			c.IdentityFiles = append(c.IdentityFiles, pair.Value)
+		case "userknownhostsfile":
+			c.KnownHostsFiles = strings.Fields(pair.Value)
+		case "identityagent":
+			c.IdentityAgent = sshExpandHome(pair.Value)
+		case "globalknownhostsfile":
+			c.GlobalKnownHostsFiles = strings.Fields(pair.Value)
+		case "hostkeyalias":
+			c.HostKeyAlias = pair.Value
+		case "hostkeyalgorithms":
+			c.HostKeyAlgorithms = strings.Split(pair.Value, ",")
+		case "stricthostkeychecking":
+			c.StrictHostKeyChecking = pair.Value
+		case "passwordauthentication":
+			c.PasswordAuthentication = strings.ToLower(pair.Value) == "yes"
+		case "serveraliveinterval":
+			c.ServerAliveInterval, err = seconds(pair.Key, pair.Value)
+		case "connecttimeout":
+			c.ConnectTimeout, err = seconds(pair.Key, pair.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+//
+
+func (c *SshClient) dial(ctx context.Context, via *ssh.Client, config *SshClientConfig) (*ssh.Client, error) {
+	hostKeyCallback, err := config.HostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	auth, closers, err := config.AuthMethods()
+	if err != nil {
+		return nil, err
+	}
+	c.closers = append(c.closers, closers...)
+
+	var (
+		address = config.Address()
+		conn    net.Conn
+	)
+	if via == nil {
+		dialer := &net.Dialer{Timeout: config.ConnectTimeout}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = via.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %q", address)
+	}
+
+	// NOTE: ClientConfig.Timeout is used only by ssh.Dial, so handshake is limited with deadline
+	if config.ConnectTimeout > 0 {
+		err = conn.SetDeadline(time.Now().Add(config.ConnectTimeout))
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "failed to set handshake deadline for %q", address)
+		}
+	}
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:              config.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: config.HostKeyAlgorithms,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "ssh handshake with %q failed", address)
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		clientConn.Close()
+		return nil, errors.Wrapf(err, "failed to reset handshake deadline for %q", address)
+	}
+
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
+
+func (c *SshClient) keepalive(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if !c.Alive() {
+				return
+			}
+		}
+	}
+}
+
+// Alive checks connection is still usable, dead connection is closed.
+func (c *SshClient) Alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+
+	var err error
+	select {
+	case err = <-reply:
+	case <-time.After(c.Config.ConnectTimeout):
+		err = errors.Errorf("keepalive timed out after %s", c.Config.ConnectTimeout)
+	}
+	if err != nil {
+		c.Close()
+		return false
+	}
+	return true
+}
+
+// Run executes command on the remote host, command is interpreted by the remote shell.
+func (c *SshClient) Run(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	session, err := c.NewSession()
+	if err != nil {
+		return errors.Wrapf(err, "failed to open ssh session to %q", c.Config.Address())
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	return session.Run(command)
+}
+
+// Tunnel returns local address which is forwarded to the target SSH server
+// through this connection, it is used to run nix copy over the native connection.
+// NOTE: server is dialed on the loopback of the target, external address may not be reachable
+// from the target itself (NAT, floating addresses, sshd listening on some interfaces)
+func (c *SshClient) Tunnel() (string, error) {
+	c.tunnelLock.Lock()
+	defer c.tunnelLock.Unlock()
+
+	if c.tunnel != nil {
+		return c.tunnel.Addr().String(), nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to listen for ssh tunnel")
+	}
+	c.tunnel = listener
+
+	go func() {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.forward(local)
+		}
+	}()
+
+	return listener.Addr().String(), nil
+}
+
+func (c *SshClient) forward(local net.Conn) {
+	defer local.Close()
+	remote, err := c.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(c.Config.TunnelPort)))
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() { _, _ = io.Copy(remote, local); done <- struct{}{} }()
+	go func() { _, _ = io.Copy(local, remote); done <- struct{}{} }()
+	<-done
+}
+
+func (c *SshClient) Close() error {
+	c.close.Do(func() { c.err = c.shutdown() })
+	return c.err
+}
+
+func (c *SshClient) shutdown() error {
+	close(c.done)
+
+	c.tunnelLock.Lock()
+	if c.tunnel != nil {
+		c.tunnel.Close()
+	}
+	c.tunnelLock.Unlock()
+
+	var err error
+	if c.Client != nil {
+		err = c.Client.Close()
+	}
+	for n := len(c.hops) - 1; n >= 0; n-- {
+		c.hops[n].Close()
+	}
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+	return err
+}
+
+// DialSsh connects to the target through jump hosts (in order).
+func DialSsh(ctx context.Context, target *SshClientConfig, jumps ...*SshClientConfig) (*SshClient, error) {
+	c := &SshClient{
+		Config: target,
+		done:   make(chan struct{}),
+	}
+
+	var via *ssh.Client
+	for _, config := range append(jumps, target) {
+		client, err := c.dial(ctx, via, config)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if via != nil {
+			c.hops = append(c.hops, via)
+		}
+		via = client
+	}
+	c.Client = via
+
+	go c.keepalive(target.ServerAliveInterval)
+
+	return c, nil
+}
+
+//
+
+// CommandExecuteRemote executes command on the remote host with native SSH client
+// applying the same options as CommandExecute.
+func CommandExecuteRemote(client *SshClient, command string, arguments []string, options ...CommandOption) ([]byte, error) {
+	// NOTE: exec.Cmd is never started, it is used to collect stdio from options
+	execCmd := exec.Command(command, arguments...)
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	execCmd.Stdout = stdout
+	execCmd.Stderr = stderr
+
+	cmd := &Cmd{
+		Cmd:    execCmd,
+		Stdout: stdout,
+		Stderr: stderr,
+		Env:    NewEnvironment(),
+	}
+	for _, option := range options {
+		option(cmd)
+	}
+	for _, hook := range cmd.PreRunHooks {
+		hook(cmd)
+	}
+
+	commandLine := strings.Join(append([]string{command}, arguments...), " ")
+	if len(cmd.Env) > 0 {
+		// NOTE: servers usually accept only a few variables with setenv requests (AcceptEnv),
+		// so environment is passed to the remote command with env(1)
+		names := make([]string, 0, len(cmd.Env))
+		for name := range cmd.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		assignments := make([]string, len(names))
+		for n, name := range names {
+			assignments[n] = ShellQuote(name + "=" + strings.Join(cmd.Env[name], " "))
+		}
+		commandLine = "env " + strings.Join(assignments, " ") + " " + commandLine
+	}
+	err := client.Run(commandLine, cmd.Cmd.Stdin, cmd.Cmd.Stdout, cmd.Cmd.Stderr)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "remote command %q on %q exited with: %s",
+			commandLine, client.Config.Address(),
+			stderr.String(),
+		)
+	}
+	return stdout.Bytes(), nil
+}
+
+func CommandExecuteRemoteUnmarshal(client *SshClient, command string, arguments []string, unmarshaler Unmarshaler, result interface{}, options ...CommandOption) error {
+	output, err := CommandExecuteRemote(client, command, arguments, options...)
+	if err != nil {
+		return err
+	}
+	return CommandUnmarshal(output, unmarshaler, result)
+}
@@ -0,0 +1,349 @@
+package provider
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewSshClientConfig(t *testing.T) {
+	m := NewSshConfigMap()
+	m.Set(SshConfigKeyHost, "::1")
+	m.Set(SshConfigKeyPort, "2222")
+	m.Set(SshConfigKeyUser, "admin")
+	m.Set("StrictHostKeyChecking", "no")
+	m.Set("ServerAliveInterval", "5")
+	m.Set("IdentityFile", "/tmp/id_ed25519")
+
+	c, err := NewSshClientConfig(m)
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:2222", c.Address())
+	assert.Equal(t, "admin", c.User)
+	assert.Equal(t, "no", c.StrictHostKeyChecking)
+	assert.Equal(t, 5*time.Second, c.ServerAliveInterval)
+	assert.Equal(t, SshDefaultConnectTimeout, c.ConnectTimeout)
+	assert.Equal(t, []string{"/tmp/id_ed25519"}, c.IdentityFiles)
+
+	m.Set(SshConfigKeyPort, "ssh")
+	_, err = NewSshClientConfig(m)
+	assert.Error(t, err)
+
+	m = NewSshConfigMap()
+	m.AddInclude("~/.ssh/config")
+	_, err = NewSshClientConfig(m)
+	assert.ErrorContains(t, err, KeySshConfigInclude)
+
+	m = NewSshConfigMap()
+	m.AddBlock("Host *.internal", NewSshConfigMap())
+	_, err = NewSshClientConfig(m)
+	assert.ErrorContains(t, err, KeySshConfigBlock)
+}
+
+func TestSshClientConfigHostKeyCallback(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		key, err := ssh.NewPublicKey(publicKey)
+		assert.NoError(t, err)
+		return key
+	}
+	var (
+		key        = newKey()
+		otherKey   = newKey()
+		knownHosts = filepath.Join(t.TempDir(), "known_hosts")
+		remote     = &net.TCPAddr{IP: net.IPv6loopback, Port: 2222}
+	)
+
+	m := NewSshConfigMap()
+	m.Set(SshConfigKeyHost, "::1")
+	m.Set(SshConfigKeyPort, "2222")
+	SshConfigHostKeyObserve(m, SshHostKeyAliasTarget, ssh.KeyAlgoED25519, knownHosts)
+	c, err := NewSshClientConfig(m)
+	assert.NoError(t, err)
+	callback, err := c.HostKeyCallback()
+	assert.NoError(t, err)
+	assert.NoError(t, callback(c.Address(), remote, key))
+
+	buf, err := os.ReadFile(knownHosts)
+	assert.NoError(t, err)
+	observed, err := SshKnownHostsKey(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), observed)
+
+	SshConfigHostKeyPin(m, SshHostKeyAliasTarget, knownHosts)
+	c, err = NewSshClientConfig(m)
+	assert.NoError(t, err)
+	callback, err = c.HostKeyCallback()
+	assert.NoError(t, err)
+	assert.NoError(t, callback(c.Address(), remote, key))
+	assert.Error(t, callback(c.Address(), remote, otherKey))
+}
+
+// sshTestServer accepts any client and records exec requests & direct-tcpip destinations.
+type sshTestServer struct {
+	net.Listener
+	commands chan string
+	forwards chan string
+}
+
+func newSshTestServer(t *testing.T) *sshTestServer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	assert.NoError(t, err)
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &sshTestServer{
+		Listener: listener,
+		commands: make(chan string, 8),
+		forwards: make(chan string, 8),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *sshTestServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, channelRequests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				for request := range channelRequests {
+					if request.Type != "exec" {
+						_ = request.Reply(false, nil)
+						continue
+					}
+					var payload struct{ Command string }
+					_ = ssh.Unmarshal(request.Payload, &payload)
+					s.commands <- payload.Command
+					_ = request.Reply(true, nil)
+					_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+					channel.Close()
+				}
+			}()
+		case "direct-tcpip":
+			var payload struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			_ = ssh.Unmarshal(newChannel.ExtraData(), &payload)
+			s.forwards <- net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+			_ = newChannel.Reject(ssh.Prohibited, "test server does not forward")
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func (s *sshTestServer) config(t *testing.T) *SshClientConfig {
+	host, port, err := net.SplitHostPort(s.Addr().String())
+	assert.NoError(t, err)
+	m := NewSshConfigMap()
+	m.Set(SshConfigKeyHost, host)
+	m.Set(SshConfigKeyPort, port)
+	m.Set(SshConfigKeyUser, "root")
+	m.Set("StrictHostKeyChecking", "no")
+	m.Set("UserKnownHostsFile", "/dev/null")
+	c, err := NewSshClientConfig(m)
+	assert.NoError(t, err)
+	return c
+}
+
+func TestSshClientRemote(t *testing.T) {
+	server := newSshTestServer(t)
+	config := server.config(t)
+	// NOTE: target is dialed with external (forwarded) port, tunnel should use sshd port on the loopback of the target
+	config.Port = 2222
+	config.TunnelPort = 2022
+	client, err := DialSsh(context.Background(), server.config(t))
+	assert.NoError(t, err)
+	defer client.Close()
+	client.Config = config
+
+	_, err = CommandExecuteRemote(
+		client, "nix-store", []string{"--serve"},
+		CommandOptionEnv(Environment{"NIX_SSHOPTS": {"-p", "22"}, "LANG": {"C"}}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "env LANG=C 'NIX_SSHOPTS=-p 22' nix-store --serve", <-server.commands)
+
+	tunnel, err := client.Tunnel()
+	assert.NoError(t, err)
+	conn, err := net.Dial("tcp", tunnel)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1:2022", <-server.forwards)
+}
+
+func TestDialSshHandshakeTimeout(t *testing.T) {
+	// NOTE: server accepts connections but never sends ssh banner
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, err)
+	m := NewSshConfigMap()
+	m.Set(SshConfigKeyHost, host)
+	m.Set(SshConfigKeyPort, port)
+	m.Set("StrictHostKeyChecking", "no")
+	m.Set("ConnectTimeout", "1")
+	config, err := NewSshClientConfig(m)
+	assert.NoError(t, err)
+
+	started := time.Now()
+	_, err = DialSsh(context.Background(), config)
+	assert.ErrorContains(t, err, "ssh handshake")
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
+
+func TestProviderSshClientParallel(t *testing.T) {
+	p := &Provider{}
+	assert.NoError(t, p.initSshClients())
+	defer p.Close()
+
+	// NOTE: dead host accepts connections but never sends ssh banner
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer dead.Close()
+	go func() {
+		for {
+			conn, err := dead.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	server := newSshTestServer(t)
+
+	configs := func(address string) (string, *sshConfigs) {
+		host, port, err := net.SplitHostPort(address)
+		assert.NoError(t, err)
+		m := NewSshConfigMap()
+		m.Set(SshConfigKeyPort, port)
+		m.Set(SshConfigKeyUser, "root")
+		m.Set("StrictHostKeyChecking", "no")
+		m.Set("UserKnownHostsFile", "/dev/null")
+		m.Set("ConnectTimeout", "3")
+		return host, &sshConfigs{Target: m}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		host, deadConfigs := configs(dead.Addr().String())
+		_, err := p.sshClient(context.Background(), host, deadConfigs)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// NOTE: connection to the live host is not blocked by the dead host handshake
+	started := time.Now()
+	host, liveConfigs := configs(server.Addr().String())
+	client, err := p.sshClient(context.Background(), host, liveConfigs)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(started), 2*time.Second)
+	same, err := p.sshClient(context.Background(), host, liveConfigs)
+	assert.NoError(t, err)
+	assert.Same(t, client, same)
+
+	assert.Error(t, <-done)
+}
+
+func TestInstanceTrustHostKey(t *testing.T) {
+	server := newSshTestServer(t)
+	host, port, err := net.SplitHostPort(server.Addr().String())
+	assert.NoError(t, err)
+
+	p, err := NewProvider(&ResourceData{
+		ResourceBox: schema.TestResourceDataRaw(t, ProviderSchema.Schema, map[string]interface{}{}),
+		Schema:      ProviderSchema.Schema,
+	})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	assert.NoError(t, err)
+	pinned := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey())))
+
+	resource := schema.TestResourceDataRaw(
+		t, ProviderResourceMap[KeyNixosInstance].Schema,
+		map[string]interface{}{
+			KeyAddress: []interface{}{host},
+			KeyHostKey: pinned,
+			KeySsh: []interface{}{map[string]interface{}{
+				KeySshPort:      port,
+				KeySshTransport: SshTransportNative,
+			}},
+		},
+	)
+
+	// NOTE: key presented by the server is recorded even if it does not match pinned key
+	err = Instance{}.trustHostKey(context.Background(), resource, p)
+	assert.ErrorContains(t, err, "host key mismatch")
+	observed := resource.Get(KeyHostKeyObserved).(string)
+	assert.NotEmpty(t, observed)
+	assert.False(t, SshHostKeyEqual(pinned, observed))
+
+	assert.NoError(t, resource.Set(KeyHostKey, observed))
+	assert.NoError(t, Instance{}.trustHostKey(context.Background(), resource, p))
+}
+
+func TestSshHostKeyAlgorithms(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+	hostKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	assert.Equal(t, ssh.KeyAlgoED25519, SshHostKeyAlgorithms(""))
+	assert.Equal(t, ssh.KeyAlgoED25519, SshHostKeyAlgorithms(hostKey))
+	assert.True(t, SshHostKeyEqual(hostKey, hostKey+" root@host"))
+	assert.False(t, SshHostKeyEqual(hostKey, "not a key"))
+}
@@ -0,0 +1,97 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderNewSshBastionChain(t *testing.T) {
+	var (
+		p    = &Provider{}
+		hops = make([]*SshConfigMap, 2)
+	)
+	for n, host := range []string{"jump.corp", "bastion.vpc"} {
+		hops[n] = NewSshConfigMap()
+		hops[n].Set(SshConfigKeyHost, host)
+	}
+
+	ssh := p.newSsh(&sshConfigs{Target: NewSshConfigMap(), Bastions: hops})
+	defer ssh.Close()
+
+	// NOTE: -F <config>
+	config := func(arguments []string) string {
+		buf, err := os.ReadFile(arguments[1])
+		assert.NoError(t, err)
+		return string(buf)
+	}
+	proxyCommand := func(config string) []string {
+		for _, line := range strings.Split(config, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && strings.EqualFold(fields[0], SshConfigKeyProxyCommand) {
+				return fields[1:]
+			}
+		}
+		return nil
+	}
+
+	target := proxyCommand(config(ssh.Arguments))
+	assert.Equal(t, "bastion.vpc", target[len(target)-1])
+	hop := proxyCommand(config(target[1:]))
+	assert.Equal(t, "jump.corp", hop[len(hop)-1])
+	assert.Nil(t, proxyCommand(config(hop[1:])))
+	assert.Len(t, ssh.Finalizers, 3)
+}
+
+func TestProviderCloseRecreate(t *testing.T) {
+	p := &Provider{}
+	defer p.Close()
+
+	assert.NoError(t, p.initSshAgent())
+	assert.NotNil(t, p.sshDir)
+	dir := p.sshDir.Name()
+	assert.FileExists(t, p.sshAgent.Path)
+
+	assert.NoError(t, p.Close())
+	assert.Nil(t, p.sshAgent)
+	assert.Nil(t, p.sshCertificates)
+	assert.Nil(t, p.sshDir)
+	assert.NoDirExists(t, dir)
+
+	// NOTE: provider is usable after Close, ssh directory & agent are recreated
+	configMap := NewSshConfigMap()
+	assert.NoError(t, p.sshMultiplex(configMap))
+	assert.NotNil(t, p.sshDir)
+	assert.DirExists(t, p.sshDir.Name())
+	assert.NoError(t, p.initSshAgent())
+	assert.FileExists(t, p.sshAgent.Path)
+}
+
+func TestProviderNewSshError(t *testing.T) {
+	p, err := NewProvider(&ResourceData{
+		ResourceBox: schema.TestResourceDataRaw(t, ProviderSchema.Schema, map[string]interface{}{}),
+		Schema:      ProviderSchema.Schema,
+	})
+	assert.NoError(t, err)
+	defer p.Close()
+
+	resource := schema.TestResourceDataRaw(
+		t, ProviderResourceMap[KeyNixosInstance].Schema,
+		map[string]interface{}{
+			KeyAddress: []interface{}{"127.0.0.1"},
+			KeyHostKey: "not a host key",
+		},
+	)
+
+	ssh, err := p.NewSsh(context.Background(), resource)
+	assert.Error(t, err)
+	assert.Nil(t, ssh)
+
+	nix, err := p.NewNix(context.Background(), resource)
+	assert.Error(t, err)
+	assert.Nil(t, nix)
+}
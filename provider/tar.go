@@ -26,6 +26,12 @@ func TarOptionExtract() TarOption {
 	}
 }
 
+func TarOptionDereference() TarOption {
+	return func(t *Tar) {
+		t.Arguments = append(t.Arguments, "-h")
+	}
+}
+
 func TarOptionGzip() TarOption {
 	return func(t *Tar) {
 		t.Arguments = append(t.Arguments, "-z")
@@ -0,0 +1,9 @@
+{ config, lib, ... }: {
+  config = {
+    boot.loader.grub.enable = true;
+    boot.initrd.availableKernelModules = [ "virtio_pci" "virtio_blk" "virtio_net" ];
+    services.openssh.enable = true;
+    networking.useDHCP = lib.mkDefault true;
+    system.stateVersion = "23.05";
+  };
+}
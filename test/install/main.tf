@@ -0,0 +1,54 @@
+terraform {
+  required_providers {
+    nixos = {
+      source = "corpix/nixos"
+      version = "0.0.1"
+    }
+  }
+}
+
+locals {
+  authorized_key = file("${path.module}/vm/id_ed25519.pub")
+}
+
+# NOTE: target is a local VM started with `make run/vm` (ssh on 127.0.0.1:2223)
+
+provider "nixos" {
+  ssh {
+    port = 2223
+    config = {
+      identityFile = "${path.module}/vm/id_ed25519"
+      identitiesOnly = "yes"
+      userKnownHostsFile = "/dev/null"
+      strictHostKeyChecking = "no"
+    }
+  }
+}
+
+resource "nixos_install" "test" {
+  address = ["127.0.0.1"]
+  configuration = "configuration.nix"
+  disk_layout = "disk-layout.nix"
+  settings = jsonencode({
+    users = { users = { root = { openssh = { authorizedKeys = { keys = [local.authorized_key] } } } } }
+  })
+  installer_settings = jsonencode({
+    users = { users = { root = { openssh = { authorizedKeys = { keys = [local.authorized_key] } } } } }
+  })
+}
+
+resource "nixos_instance" "test" {
+  depends_on = [nixos_install.test]
+
+  address = ["127.0.0.1"]
+  configuration = "configuration.nix"
+  settings = jsonencode({
+    users = { users = { root = { openssh = { authorizedKeys = { keys = [local.authorized_key] } } } } }
+  })
+  host_key_tofu = true
+
+  secret {
+    content = "installed"
+    destination = "/run/secrets/test"
+  }
+}